@@ -0,0 +1,87 @@
+package loadbalancer
+
+import (
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend 定义一个结构体保存后端服务器状态信息
+type Backend struct {
+	URL          *url.URL
+	Alive        bool
+	mux          sync.RWMutex
+	ReverseProxy *httputil.ReverseProxy
+	// MaxConns 最大并发请求数，0 表示不限制
+	MaxConns int64
+	// 当前正在处理的请求数，使用原子操作读写
+	active int64
+	// 创建后端时使用的配置，服务发现用来判断参数是否发生变化
+	spec *BackendSpec
+	// SlowStart 后端新加入或者恢复可用后，有效权重从很小的值增加到完整权重所用的时间，0 表示不启用
+	SlowStart time.Duration
+	// 最近一次变为可用的时间，为零值时不做慢启动
+	upSince time.Time
+	// Backup 备用后端，只有主后端都不可用或者可用容量低于阈值时才使用
+	Backup bool
+	// Zone、Region 后端所在的可用区和地域，用于优先选择离负载均衡器近的后端
+	Zone   string
+	Region string
+}
+
+// SetAlive 设置服务可用
+func (b *Backend) SetAlive(alive bool) {
+	// 不同的 goroutine 会同时访问 Backend,使用 RWMutex 来串行化对 Alive 的访问操作
+	b.mux.Lock()
+	if alive && !b.Alive {
+		b.upSince = time.Now()
+	}
+	b.Alive = alive
+	b.mux.Unlock()
+}
+
+// IsAlive 服务可用返回true
+func (b *Backend) IsAlive() (alive bool) {
+	b.mux.RLock()
+	alive = b.Alive
+	b.mux.RUnlock()
+	return
+}
+
+// Saturated 后端是否已经达到连接上限
+func (b *Backend) Saturated() bool {
+	return b.MaxConns > 0 && atomic.LoadInt64(&b.active) >= b.MaxConns
+}
+
+// ActiveConns 返回后端当前正在处理的请求数
+func (b *Backend) ActiveConns() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// tryAcquire 占用一个连接名额，达到上限时返回 false
+func (b *Backend) tryAcquire() bool {
+	for {
+		active := atomic.LoadInt64(&b.active)
+		if b.MaxConns > 0 && active >= b.MaxConns {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.active, active, active+1) {
+			return true
+		}
+	}
+}
+
+// NewBackend 按配置创建后端，ReverseProxy 为空，四层负载均衡直接使用，HTTP 后端由 LoadBalancer 设置 ReverseProxy
+func NewBackend(spec *BackendSpec) *Backend {
+	return &Backend{
+		URL:       spec.URL,
+		Alive:     true,
+		MaxConns:  int64(spec.MaxConns),
+		SlowStart: spec.SlowStart,
+		Backup:    spec.Backup,
+		Zone:      spec.Zone,
+		Region:    spec.Region,
+	}
+}
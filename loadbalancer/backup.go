@@ -0,0 +1,37 @@
+package loadbalancer
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// primaryAvailable 主后端的可用容量是否足够，不需要启用备用后端
+// 达到连接上限的主后端不算可用，超出主后端承受能力的请求由备用后端分担。
+// 状态变化时记录日志和指标，主后端恢复后新请求不再分给备用后端，备用后端上的请求继续处理完
+func (s *ServerPool) primaryAvailable(backends []*Backend) bool {
+	total, available, backups := 0, 0, 0
+	for _, b := range backends {
+		if b.Backup {
+			backups++
+			continue
+		}
+		total++
+		if b.IsAlive() && !b.Saturated() {
+			available++
+		}
+	}
+	// 没有配置备用后端时不需要判断
+	if backups == 0 {
+		return true
+	}
+	ok := available > 0 && float64(available) >= s.backupThreshold*float64(total)
+
+	if !ok && atomic.CompareAndSwapInt32(&s.failedOver, 0, 1) {
+		log.Printf("%s: %d/%d primary servers available, failing over to backup servers\n", s.name, available, total)
+		s.failoverStats.Add(s.name+".failovers", 1)
+	} else if ok && atomic.CompareAndSwapInt32(&s.failedOver, 1, 0) {
+		log.Printf("%s: primary servers recovered, draining backup servers\n", s.name)
+		s.failoverStats.Add(s.name+".recoveries", 1)
+	}
+	return ok
+}
@@ -0,0 +1,68 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// contextKey 负载均衡器保存在请求 context 中的值的 key，使用单独的类型避免和其他包冲突
+type contextKey int
+
+const (
+	attemptsKey contextKey = iota
+	retryKey
+	upstreamKey
+	hedgerKey
+	leaseKey
+	traceKey
+)
+
+// GetRetryFromContext 返回重试次数
+func GetRetryFromContext(r *http.Request) int {
+	if retry, ok := r.Context().Value(retryKey).(int); ok {
+		return retry
+	}
+	return 0
+}
+
+// GetAttemptsFromContext 返回尝试次数
+func GetAttemptsFromContext(r *http.Request) int {
+	if attempts, ok := r.Context().Value(attemptsKey).(int); ok {
+		return attempts
+	}
+	return 1
+}
+
+// WithUpstream 指定请求使用的后端池
+func WithUpstream(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, upstreamKey, name)
+}
+
+// GetUpstreamFromContext 返回请求使用的后端池名称，没有指定时为 default
+func GetUpstreamFromContext(r *http.Request) string {
+	if name, ok := r.Context().Value(upstreamKey).(string); ok {
+		return name
+	}
+	return DefaultPool
+}
+
+// RequestTrace 负载均衡器处理请求的过程，外层中间件通过 WithTrace 放入 context，请求结束后读取
+// 用于把负载均衡器自己排队和拒绝的时间与后端的处理时间区分开
+type RequestTrace struct {
+	// Acquired 第一次拿到后端名额的时间，排队的请求为排队结束的时间，为零表示请求没有转发给后端
+	Acquired time.Time
+	// Shed 负载均衡器因为等待队列已满、排队超时或者客户端在排队时断开而返回了 503，请求没有到达后端
+	Shed bool
+}
+
+// WithTrace 让负载均衡器把请求的处理过程记录到 trace 中
+func WithTrace(ctx context.Context, trace *RequestTrace) context.Context {
+	return context.WithValue(ctx, traceKey, trace)
+}
+
+// getTrace 返回外层中间件放入的 RequestTrace，没有时返回 nil
+func getTrace(r *http.Request) *RequestTrace {
+	trace, _ := r.Context().Value(traceKey).(*RequestTrace)
+	return trace
+}
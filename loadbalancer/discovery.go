@@ -0,0 +1,174 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// DiscoveryProvider 服务发现，后端列表发生变化时通过 update 回调返回完整的后端列表
+// 出错时 provider 自己记录日志并保留上一次的结果，不应该因为一次解析失败就清空后端
+type DiscoveryProvider interface {
+	// Name 来源名称，用于区分不同 provider 提供的后端
+	Name() string
+	// Run 持续监听后端变化，直到 ctx 结束
+	Run(ctx context.Context, update func(specs []*BackendSpec))
+}
+
+// DiscoveryConfig 服务发现配置
+type DiscoveryConfig struct {
+	// Type file、dns 或者 kubernetes
+	Type string `mapstructure:"type"`
+	// Name 来源名称，默认为 type 加序号
+	Name string `mapstructure:"name"`
+
+	// Path file：后端列表文件，支持 JSON 和 YAML
+	Path string `mapstructure:"path"`
+
+	// Domain dns：需要解析的域名
+	Domain string `mapstructure:"domain"`
+	// Record dns：记录类型 A、AAAA 或 SRV
+	Record string `mapstructure:"record"`
+	// Server dns：DNS 服务器地址，默认使用 /etc/resolv.conf 中的第一个
+	Server string `mapstructure:"server"`
+	// Port dns：A/AAAA 记录没有端口，需要指定
+	Port int `mapstructure:"port"`
+	// Scheme dns/kubernetes：后端协议，默认为 http
+	Scheme string `mapstructure:"scheme"`
+	// Interval dns：重新解析的间隔，记录的 TTL 更短时按 TTL 解析
+	Interval time.Duration `mapstructure:"interval"`
+	// Params dns/kubernetes：附加给每个后端的参数，和 proxy_pass 中的格式相同，例如 "max_conns=200"
+	Params string `mapstructure:"params"`
+
+	// APIServer kubernetes：API Server 地址，为空时使用集群内的 ServiceAccount
+	APIServer string `mapstructure:"api_server"`
+	// Namespace kubernetes：Service 所在的命名空间，默认为 default
+	Namespace string `mapstructure:"namespace"`
+	// Service kubernetes：Service 名称
+	Service string `mapstructure:"service"`
+	// PortName kubernetes：使用的端口名称，默认使用第一个端口
+	PortName string `mapstructure:"port_name"`
+	// Zone kubernetes：负载均衡器所在的区域，端点带有拓扑提示时只使用本区域的端点
+	Zone string `mapstructure:"zone"`
+	// TokenFile kubernetes：访问 API Server 的 token 文件
+	TokenFile string `mapstructure:"token_file"`
+	// CAFile kubernetes：API Server 的 CA 证书
+	CAFile string `mapstructure:"ca_file"`
+}
+
+// NewDiscoveryProvider 按配置创建服务发现，defaults 为后端参数的默认值
+func NewDiscoveryProvider(cfg DiscoveryConfig, defaults BackendSpec) (DiscoveryProvider, error) {
+	switch cfg.Type {
+	case "file":
+		return newFileProvider(cfg, defaults)
+	case "dns":
+		return newDNSProvider(cfg, defaults)
+	case "kubernetes":
+		return newK8sProvider(cfg, defaults)
+	default:
+		return nil, fmt.Errorf("discovery: unknown type %q", cfg.Type)
+	}
+}
+
+// RunDiscovery 运行服务发现，把发现的后端同步到 pool，直到 ctx 结束
+func (s *ServerPool) RunDiscovery(ctx context.Context, provider DiscoveryProvider) {
+	provider.Run(ctx, func(specs []*BackendSpec) {
+		s.SyncBackends(provider.Name(), specs)
+	})
+}
+
+// SyncBackends 用 source 提供的后端列表更新 ServerPool
+// 所有来源的后端合并在一起，同一个 URL 出现在多个来源时只保留一个。
+// 被移除的后端标记为不可用，已经转发给它的请求会继续处理完，不会被中断
+func (s *ServerPool) SyncBackends(source string, specs []*BackendSpec) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.sources == nil {
+		s.sources = make(map[string]map[string]*BackendSpec)
+	}
+	set := make(map[string]*BackendSpec, len(specs))
+	for _, spec := range specs {
+		set[spec.URL.String()] = spec
+	}
+	s.sources[source] = set
+
+	// 合并所有来源，静态配置优先，其余按名称排序
+	names := make([]string, 0, len(s.sources))
+	for name := range s.sources {
+		if name != "static" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := s.sources["static"]; ok {
+		names = append([]string{"static"}, names...)
+	}
+	desired := make(map[string]*BackendSpec)
+	var order []string
+	for _, name := range names {
+		for _, spec := range sortedSpecs(s.sources[name]) {
+			key := spec.URL.String()
+			if _, ok := desired[key]; !ok {
+				desired[key] = spec
+				order = append(order, key)
+			}
+		}
+	}
+
+	// 保持已有后端的顺序，轮询不会因为后端变化而打乱
+	backends := make([]*Backend, 0, len(desired))
+	existing := make(map[string]bool, len(s.backends))
+	for _, b := range s.backends {
+		key := b.URL.String()
+		spec, ok := desired[key]
+		switch {
+		case !ok:
+			b.SetAlive(false)
+			log.Printf("Removed server: %s\n", b.URL)
+		case b.spec != nil && !b.spec.equal(spec):
+			// 参数发生变化，创建新的后端替换，旧后端上的请求继续处理
+			b.SetAlive(false)
+			nb := s.createBackend(spec)
+			// 只是参数变化，后端本身没有重新启动，继续之前的慢启动进度
+			b.mux.RLock()
+			nb.upSince = b.upSince
+			b.mux.RUnlock()
+			backends = append(backends, nb)
+			log.Printf("Updated server: %s\n", b.URL)
+			existing[key] = true
+		default:
+			backends = append(backends, b)
+			existing[key] = true
+		}
+	}
+	for _, key := range order {
+		if !existing[key] {
+			backends = append(backends, s.createBackend(desired[key]))
+			log.Printf("Configured server: %s\n", key)
+		}
+	}
+	s.backends = backends
+}
+
+// createBackend 用 newBackend 创建后端并记录它的配置
+func (s *ServerPool) createBackend(spec *BackendSpec) *Backend {
+	b := s.newBackend(spec)
+	b.spec = spec
+	s.markJoined(b)
+	return b
+}
+
+// sortedSpecs 按 URL 排序，保证合并结果稳定
+func sortedSpecs(set map[string]*BackendSpec) []*BackendSpec {
+	specs := make([]*BackendSpec, 0, len(set))
+	for _, spec := range set {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].URL.String() < specs[j].URL.String()
+	})
+	return specs
+}
@@ -0,0 +1,365 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsTimeout 单次 DNS 查询的超时时间
+	dnsTimeout = 2 * time.Second
+	// dnsMinInterval 最短的重新解析间隔，防止 TTL 为 0 的记录导致频繁查询
+	dnsMinInterval = time.Second
+)
+
+// dnsProvider 通过 DNS 的 A/AAAA 或 SRV 记录发现后端，按间隔重新解析，记录的 TTL 更短时按 TTL 解析
+type dnsProvider struct {
+	name     string
+	domain   string
+	record   dnsmessage.Type
+	server   string
+	port     int
+	scheme   string
+	interval time.Duration
+	params   string
+	defaults BackendSpec
+}
+
+func newDNSProvider(cfg DiscoveryConfig, defaults BackendSpec) (*dnsProvider, error) {
+	if cfg.Domain == "" {
+		return nil, errors.New("discovery dns: domain is required")
+	}
+	p := &dnsProvider{
+		name:     cfg.Name,
+		domain:   cfg.Domain,
+		server:   cfg.Server,
+		port:     cfg.Port,
+		scheme:   cfg.Scheme,
+		interval: cfg.Interval,
+		params:   cfg.Params,
+		defaults: defaults,
+	}
+	switch strings.ToUpper(cfg.Record) {
+	case "", "A":
+		p.record = dnsmessage.TypeA
+	case "AAAA":
+		p.record = dnsmessage.TypeAAAA
+	case "SRV":
+		p.record = dnsmessage.TypeSRV
+	default:
+		return nil, fmt.Errorf("discovery dns: unsupported record type %q", cfg.Record)
+	}
+	if p.scheme == "" {
+		p.scheme = "http"
+	}
+	if p.port == 0 && p.record != dnsmessage.TypeSRV {
+		p.port = 80
+		if p.scheme == "https" {
+			p.port = 443
+		}
+	}
+	if p.interval <= 0 {
+		p.interval = 30 * time.Second
+	}
+	if p.server == "" {
+		p.server = systemNameserver()
+	} else if _, _, err := net.SplitHostPort(p.server); err != nil {
+		p.server = net.JoinHostPort(p.server, "53")
+	}
+	// 检查参数格式，避免每次解析时才发现错误
+	if _, err := p.spec("127.0.0.1:80"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *dnsProvider) Name() string {
+	return p.name
+}
+
+// Run 按间隔重新解析，解析失败或者没有任何记录时保留上一次的结果
+func (p *dnsProvider) Run(ctx context.Context, update func(specs []*BackendSpec)) {
+	for {
+		wait := p.interval
+		specs, ttl, err := p.resolve(ctx)
+		switch {
+		case err != nil:
+			log.Printf("discovery %s: %s\n", p.name, err)
+		case len(specs) == 0:
+			// 一次 NXDOMAIN 或者空响应可能只是 DNS 服务器的临时问题，不能因此摘除所有后端
+			log.Printf("discovery %s: %s has no records, keeping the previous backends\n", p.name, p.domain)
+		default:
+			update(specs)
+			if ttl > 0 && ttl < wait {
+				wait = ttl
+			}
+		}
+		if wait < dnsMinInterval {
+			wait = dnsMinInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// resolve 解析域名，返回后端列表和所有记录中最小的 TTL
+func (p *dnsProvider) resolve(ctx context.Context) ([]*BackendSpec, time.Duration, error) {
+	var (
+		addrs []string
+		ttl   uint32
+		err   error
+	)
+	if p.record == dnsmessage.TypeSRV {
+		addrs, ttl, err = p.resolveSRV(ctx)
+	} else {
+		var ips []net.IP
+		ips, ttl, err = p.lookupIP(ctx, p.domain, []dnsmessage.Type{p.record}, nil)
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(p.port)))
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	specs := make([]*BackendSpec, 0, len(addrs))
+	for _, addr := range addrs {
+		spec, err := p.spec(addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, time.Duration(ttl) * time.Second, nil
+}
+
+// resolveSRV 解析 SRV 记录，只使用优先级最高(Priority 最小)的一组记录
+func (p *dnsProvider) resolveSRV(ctx context.Context) ([]string, uint32, error) {
+	resp, err := p.query(ctx, p.domain, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var srvs []*dnsmessage.SRVResource
+	ttl := uint32(0)
+	for _, rr := range resp.Answers {
+		if srv, ok := rr.Body.(*dnsmessage.SRVResource); ok {
+			srvs = append(srvs, srv)
+			ttl = minTTL(ttl, rr.Header.TTL)
+		}
+	}
+	if len(srvs) == 0 {
+		return nil, ttl, nil
+	}
+	sort.SliceStable(srvs, func(i, j int) bool { return srvs[i].Priority < srvs[j].Priority })
+
+	var addrs []string
+	for _, srv := range srvs {
+		if srv.Priority != srvs[0].Priority {
+			break
+		}
+		// 优先使用附加段中的地址，没有时再单独查询
+		ips, ipTTL, err := p.lookupIP(ctx, srv.Target.String(),
+			[]dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}, resp.Additionals)
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = minTTL(ttl, ipTTL)
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))))
+		}
+	}
+	return addrs, ttl, nil
+}
+
+// lookupIP 依次按 qtypes 查询地址，直到查到为止。additionals 中已经有目标的地址时不再查询
+func (p *dnsProvider) lookupIP(ctx context.Context, name string, qtypes []dnsmessage.Type, additionals []dnsmessage.Resource) ([]net.IP, uint32, error) {
+	if ips, ttl := extractIPs(name, additionals); len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	for _, qtype := range qtypes {
+		resp, err := p.query(ctx, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ips, ttl := extractIPs(name, resp.Answers); len(ips) > 0 {
+			return ips, ttl, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+// extractIPs 从资源记录中取出属于 name 的地址，CNAME 之后的记录也算在内
+func extractIPs(name string, rrs []dnsmessage.Resource) ([]net.IP, uint32) {
+	var ips []net.IP
+	ttl := uint32(0)
+	names := map[string]bool{strings.ToLower(fqdn(name)): true}
+	for _, rr := range rrs {
+		if c, ok := rr.Body.(*dnsmessage.CNAMEResource); ok && names[strings.ToLower(rr.Header.Name.String())] {
+			names[strings.ToLower(c.CNAME.String())] = true
+		}
+	}
+	for _, rr := range rrs {
+		if !names[strings.ToLower(rr.Header.Name.String())] {
+			continue
+		}
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		ttl = minTTL(ttl, rr.Header.TTL)
+	}
+	return ips, ttl
+}
+
+// query 发送 DNS 查询，先使用 UDP，响应被截断时改用 TCP
+func (p *dnsProvider) query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, err
+	}
+	// 查询 ID 需要不可预测，防止伪造响应
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	req := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.exchange(ctx, "udp", packed)
+	if err == nil && resp.Truncated {
+		resp, err = p.exchange(ctx, "tcp", packed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query %s %s: %s", name, qtype, err)
+	}
+	if resp.ID != id {
+		return nil, fmt.Errorf("query %s %s: mismatched response id", name, qtype)
+	}
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		// NXDOMAIN 表示域名不存在，返回空的结果，由 Run 决定是否保留原来的后端
+		return resp, nil
+	default:
+		return nil, fmt.Errorf("query %s %s: %s", name, qtype, resp.RCode)
+	}
+}
+
+// exchange 发送一次 DNS 请求并读取响应，TCP 需要在报文前加两个字节的长度
+func (p *dnsProvider) exchange(ctx context.Context, network string, packed []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, p.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	var buf []byte
+	if network == "tcp" {
+		msg := make([]byte, 2+len(packed))
+		binary.BigEndian.PutUint16(msg, uint16(len(packed)))
+		copy(msg[2:], packed)
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// spec 把解析出来的地址转换成后端配置
+func (p *dnsProvider) spec(addr string) (*BackendSpec, error) {
+	return ParseBackendSpec(strings.TrimSpace(p.scheme+"://"+addr+" "+p.params), p.defaults)
+}
+
+// systemNameserver 返回 /etc/resolv.conf 中的第一个 DNS 服务器
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// fqdn 在域名末尾加上 "."
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// minTTL 返回较小的 TTL，0 表示还没有记录
+func minTTL(a, b uint32) uint32 {
+	if a == 0 || b < a {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,303 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsHandler 测试 DNS 服务器的应答函数，tcp 表示查询是否通过 TCP 发送
+type dnsHandler func(q dnsmessage.Question, tcp bool) dnsmessage.Message
+
+// startTestDNSServer 在同一个端口上开启 UDP 和 TCP 的 DNS 服务器，返回服务器地址
+func startTestDNSServer(t *testing.T, handle dnsHandler) string {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := udp.LocalAddr().String()
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		_ = udp.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = udp.Close()
+		_ = tcp.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := answer(buf[:n], handle, false); resp != nil {
+				_, _ = udp.WriteTo(resp, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				req := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				resp := answer(req, handle, true)
+				if resp == nil {
+					return
+				}
+				msg := make([]byte, 2+len(resp))
+				binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+				copy(msg[2:], resp)
+				_, _ = conn.Write(msg)
+			}()
+		}
+	}()
+	return addr
+}
+
+// answer 解析查询并调用 handle 生成应答
+func answer(req []byte, handle dnsHandler, tcp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	resp := handle(msg.Questions[0], tcp)
+	resp.Header.ID = msg.Header.ID
+	resp.Header.Response = true
+	resp.Questions = msg.Questions
+	packed, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+func rrHeader(name string, typ dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET, TTL: ttl}
+}
+
+func aRecord(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{Header: rrHeader(name, dnsmessage.TypeA, ttl), Body: &dnsmessage.AResource{A: a}}
+}
+
+func aaaaRecord(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var a [16]byte
+	copy(a[:], net.ParseIP(ip).To16())
+	return dnsmessage.Resource{Header: rrHeader(name, dnsmessage.TypeAAAA, ttl), Body: &dnsmessage.AAAAResource{AAAA: a}}
+}
+
+func srvRecord(name string, ttl uint32, priority, port uint16, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: rrHeader(name, dnsmessage.TypeSRV, ttl),
+		Body:   &dnsmessage.SRVResource{Priority: priority, Weight: 10, Port: port, Target: dnsmessage.MustNewName(target)},
+	}
+}
+
+// specHosts 返回排序后的后端地址，服务发现的结果可能来自 map，顺序不固定
+func specHosts(specs []*BackendSpec) []string {
+	hosts := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		hosts = append(hosts, spec.URL.String())
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDNSProviderResolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    DiscoveryConfig
+		handle dnsHandler
+		want   []string
+		ttl    time.Duration
+	}{
+		{
+			name: "A",
+			cfg:  DiscoveryConfig{Domain: "svc.test", Port: 8080},
+			handle: func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+				return dnsmessage.Message{Answers: []dnsmessage.Resource{
+					aRecord("svc.test.", 30, "10.0.0.1"),
+					aRecord("svc.test.", 10, "10.0.0.2"),
+				}}
+			},
+			want: []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"},
+			ttl:  10 * time.Second,
+		},
+		{
+			name: "AAAA with CNAME",
+			cfg:  DiscoveryConfig{Domain: "svc.test", Record: "AAAA", Scheme: "https"},
+			handle: func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+				if q.Type != dnsmessage.TypeAAAA {
+					return dnsmessage.Message{}
+				}
+				return dnsmessage.Message{Answers: []dnsmessage.Resource{
+					{Header: rrHeader("svc.test.", dnsmessage.TypeCNAME, 60), Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("real.test.")}},
+					aaaaRecord("real.test.", 20, "fd00::1"),
+				}}
+			},
+			want: []string{"https://[fd00::1]:443"},
+			ttl:  20 * time.Second,
+		},
+		{
+			// 只使用优先级最高的一组，b.test 的地址不在附加段中，需要单独查询
+			name: "SRV",
+			cfg:  DiscoveryConfig{Domain: "_http._tcp.svc.test", Record: "SRV"},
+			handle: func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+				switch q.Name.String() {
+				case "_http._tcp.svc.test.":
+					return dnsmessage.Message{
+						Answers: []dnsmessage.Resource{
+							srvRecord("_http._tcp.svc.test.", 60, 20, 9002, "c.test."),
+							srvRecord("_http._tcp.svc.test.", 60, 10, 9000, "a.test."),
+							srvRecord("_http._tcp.svc.test.", 60, 10, 9001, "b.test."),
+						},
+						Additionals: []dnsmessage.Resource{aRecord("a.test.", 40, "10.0.0.1")},
+					}
+				case "b.test.":
+					if q.Type == dnsmessage.TypeA {
+						return dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord("b.test.", 5, "10.0.0.2")}}
+					}
+				}
+				return dnsmessage.Message{}
+			},
+			want: []string{"http://10.0.0.1:9000", "http://10.0.0.2:9001"},
+			ttl:  5 * time.Second,
+		},
+		{
+			// UDP 响应被截断时改用 TCP 重新查询
+			name: "truncated",
+			cfg:  DiscoveryConfig{Domain: "svc.test", Port: 80},
+			handle: func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+				if !tcp {
+					return dnsmessage.Message{Header: dnsmessage.Header{Truncated: true}}
+				}
+				return dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord("svc.test.", 30, "10.0.0.3")}}
+			},
+			want: []string{"http://10.0.0.3:80"},
+			ttl:  30 * time.Second,
+		},
+		{
+			name: "NXDOMAIN",
+			cfg:  DiscoveryConfig{Domain: "missing.test", Port: 80},
+			handle: func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+				return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}}
+			},
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Server = startTestDNSServer(t, tt.handle)
+			p, err := newDNSProvider(tt.cfg, BackendSpec{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			specs, ttl, err := p.resolve(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := specHosts(specs); !equalStrings(got, tt.want) {
+				t.Errorf("backends = %v, want %v", got, tt.want)
+			}
+			if ttl != tt.ttl {
+				t.Errorf("ttl = %s, want %s", ttl, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestDNSProviderServerFailure(t *testing.T) {
+	server := startTestDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}
+	})
+	p, err := newDNSProvider(DiscoveryConfig{Domain: "svc.test", Server: server}, BackendSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.resolve(context.Background()); err == nil {
+		t.Fatal("expected an error for SERVFAIL")
+	}
+}
+
+// 解析成功之后出现 NXDOMAIN，不能把后端清空
+func TestDNSProviderKeepsBackendsOnEmptyAnswer(t *testing.T) {
+	var queries int32
+	server := startTestDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		if atomic.AddInt32(&queries, 1) == 1 {
+			return dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord("svc.test.", 1, "10.0.0.1")}}
+		}
+		return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}}
+	})
+	p, err := newDNSProvider(DiscoveryConfig{Domain: "svc.test", Server: server, Port: 80}, BackendSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []*BackendSpec, 10)
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, func(specs []*BackendSpec) { updates <- specs })
+		close(done)
+	}()
+
+	select {
+	case specs := <-updates:
+		if got := specHosts(specs); !equalStrings(got, []string{"http://10.0.0.1:80"}) {
+			t.Fatalf("backends = %v", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no update")
+	}
+	// TTL 为 1 秒，等待第二次解析返回 NXDOMAIN
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt32(&queries) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&queries) < 2 {
+		t.Fatal("provider did not resolve again")
+	}
+	cancel()
+	<-done
+	select {
+	case specs := <-updates:
+		t.Fatalf("unexpected update with %d backends", len(specs))
+	default:
+	}
+}
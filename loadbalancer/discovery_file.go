@@ -0,0 +1,119 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+)
+
+// fileProvider 从 JSON/YAML 文件读取后端列表，文件修改后自动重新加载
+// 文件内容可以是后端数组，也可以是带 backends 字段的对象，每一项的格式和 proxy_pass 相同：
+//
+//	backends:
+//	  - "http://10.0.0.1:8080 max_conns=200"
+//	  - "http://10.0.0.2:8080"
+type fileProvider struct {
+	name     string
+	path     string
+	defaults BackendSpec
+}
+
+func newFileProvider(cfg DiscoveryConfig, defaults BackendSpec) (*fileProvider, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("discovery file: path is required")
+	}
+	path, err := filepath.Abs(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileProvider{name: cfg.Name, path: path, defaults: defaults}, nil
+}
+
+func (p *fileProvider) Name() string {
+	return p.name
+}
+
+// Run 监听文件所在的目录，编辑器保存文件时通常是先写临时文件再重命名，直接监听文件会丢失事件
+func (p *fileProvider) Run(ctx context.Context, update func(specs []*BackendSpec)) {
+	p.reload(update)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("discovery %s: %s\n", p.name, err)
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(p.path)); err != nil {
+		log.Printf("discovery %s: %s\n", p.name, err)
+		return
+	}
+
+	// 一次保存可能产生多个事件，等事件停止一段时间后再加载
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == p.path {
+				debounce = time.After(100 * time.Millisecond)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("discovery %s: %s\n", p.name, err)
+		case <-debounce:
+			p.reload(update)
+		}
+	}
+}
+
+// reload 读取文件，解析失败时保留上一次的结果
+func (p *fileProvider) reload(update func(specs []*BackendSpec)) {
+	specs, err := p.load()
+	if err != nil {
+		log.Printf("discovery %s: %s\n", p.name, err)
+		return
+	}
+	log.Printf("discovery %s: %d backends\n", p.name, len(specs))
+	update(specs)
+}
+
+func (p *fileProvider) load() ([]*BackendSpec, error) {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	// JSON 是 YAML 的子集，两种格式都用 YAML 解析
+	var list []string
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		var doc struct {
+			Backends []string `yaml:"backends"`
+		}
+		if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %s", p.path, err)
+		}
+		list = doc.Backends
+	}
+
+	specs := make([]*BackendSpec, 0, len(list))
+	for _, item := range list {
+		spec, err := ParseBackendSpec(item, p.defaults)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", p.path, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
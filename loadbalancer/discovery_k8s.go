@@ -0,0 +1,402 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 在集群内运行时 ServiceAccount 的凭证位置
+	k8sTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	k8sCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	// k8sWatchTimeout watch 请求的超时时间，到期后 API Server 关闭连接，重新 watch
+	k8sWatchTimeout = 5 * time.Minute
+	// k8sRetryInterval 出错后重新 list 的间隔
+	k8sRetryInterval = 5 * time.Second
+	// k8sMinWatchInterval 两次 watch 请求之间的最短间隔，
+	// 代理或者 API Server 返回 200 后立即关闭连接时，避免不停地重新 watch
+	k8sMinWatchInterval = time.Second
+)
+
+// endpointSlice discovery.k8s.io/v1 EndpointSlice 中用到的字段
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	AddressType string `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Serving     *bool `json:"serving"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		Zone  string `json:"zone"`
+		Hints *struct {
+			ForZones []struct {
+				Name string `json:"name"`
+			} `json:"forZones"`
+		} `json:"hints"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+}
+
+// endpointSliceList list 请求的响应
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []*endpointSlice `json:"items"`
+}
+
+// watchEvent watch 请求返回的事件
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// k8sProvider 监听 Service 的 EndpointSlice，同步后端列表
+// 直接调用 API Server 的 list/watch 接口，不依赖 client-go
+type k8sProvider struct {
+	name      string
+	apiServer string
+	namespace string
+	service   string
+	portName  string
+	zone      string
+	scheme    string
+	params    string
+	tokenFile string
+	defaults  BackendSpec
+	client    *http.Client
+
+	retryInterval    time.Duration
+	minWatchInterval time.Duration
+}
+
+func newK8sProvider(cfg DiscoveryConfig, defaults BackendSpec) (*k8sProvider, error) {
+	if cfg.Service == "" {
+		return nil, errors.New("discovery kubernetes: service is required")
+	}
+	p := &k8sProvider{
+		name:      cfg.Name,
+		apiServer: strings.TrimRight(cfg.APIServer, "/"),
+		namespace: cfg.Namespace,
+		service:   cfg.Service,
+		portName:  cfg.PortName,
+		zone:      cfg.Zone,
+		scheme:    cfg.Scheme,
+		params:    cfg.Params,
+		tokenFile: cfg.TokenFile,
+		defaults:  defaults,
+
+		retryInterval:    k8sRetryInterval,
+		minWatchInterval: k8sMinWatchInterval,
+	}
+	if p.namespace == "" {
+		p.namespace = "default"
+	}
+	if p.scheme == "" {
+		p.scheme = "http"
+	}
+
+	caFile := cfg.CAFile
+	if p.apiServer == "" {
+		// 在集群内运行，使用 ServiceAccount 访问 API Server
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("discovery kubernetes: api_server is required when running outside the cluster")
+		}
+		p.apiServer = "https://" + net.JoinHostPort(host, port)
+		if p.tokenFile == "" {
+			p.tokenFile = k8sTokenFile
+		}
+		if caFile == "" {
+			caFile = k8sCAFile
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("discovery kubernetes: no certificates in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	p.client = &http.Client{Transport: transport}
+
+	if _, err := p.spec("127.0.0.1", 80, ""); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *k8sProvider) Name() string {
+	return p.name
+}
+
+// Run 先 list 获取全部 EndpointSlice，再从返回的 resourceVersion 开始 watch 变化
+// watch 断开后从最后一个 resourceVersion 继续，resourceVersion 过期(410)或者出错时重新 list
+func (p *k8sProvider) Run(ctx context.Context, update func(specs []*BackendSpec)) {
+	for {
+		slices, rv, err := p.list(ctx)
+		if err == nil {
+			update(p.backends(slices))
+			err = p.watch(ctx, slices, rv, update)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("discovery %s: %s\n", p.name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.retryInterval):
+		}
+	}
+}
+
+// endpointSlicesURL 返回 Service 对应的 EndpointSlice 资源地址
+func (p *k8sProvider) endpointSlicesURL(query url.Values) string {
+	query.Set("labelSelector", "kubernetes.io/service-name="+p.service)
+	return fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		p.apiServer, url.PathEscape(p.namespace), query.Encode())
+}
+
+// get 发送带认证信息的 GET 请求
+func (p *k8sProvider) get(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if p.tokenFile != "" {
+		// token 会定期轮换，每次请求都重新读取
+		token, err := ioutil.ReadFile(p.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", rawURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// list 返回所有 EndpointSlice 以及当前的 resourceVersion
+func (p *k8sProvider) list(ctx context.Context) (map[string]*endpointSlice, string, error) {
+	resp, err := p.get(ctx, p.endpointSlicesURL(url.Values{}))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var list endpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	slices := make(map[string]*endpointSlice, len(list.Items))
+	for _, s := range list.Items {
+		slices[s.Metadata.Name] = s
+	}
+	return slices, list.Metadata.ResourceVersion, nil
+}
+
+// watch 监听 EndpointSlice 的变化，每次变化后重新计算后端列表
+func (p *k8sProvider) watch(ctx context.Context, slices map[string]*endpointSlice, rv string, update func(specs []*BackendSpec)) error {
+	for {
+		query := url.Values{}
+		query.Set("watch", "true")
+		query.Set("resourceVersion", rv)
+		query.Set("allowWatchBookmarks", "true")
+		query.Set("timeoutSeconds", strconv.Itoa(int(k8sWatchTimeout/time.Second)))
+		started := time.Now()
+		resp, err := p.get(ctx, p.endpointSlicesURL(query))
+		if err != nil {
+			return err
+		}
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var event watchEvent
+			if err := decoder.Decode(&event); err != nil {
+				resp.Body.Close()
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				// 到达 timeoutSeconds 后 API Server 正常关闭连接，从最后一个 resourceVersion 继续
+				break
+			}
+			if event.Type == "ERROR" {
+				resp.Body.Close()
+				// 通常是 410 Gone，resourceVersion 已经过期，需要重新 list
+				return fmt.Errorf("watch error: %s", event.Object)
+			}
+
+			var slice endpointSlice
+			if err := json.Unmarshal(event.Object, &slice); err != nil {
+				resp.Body.Close()
+				return err
+			}
+			rv = slice.Metadata.ResourceVersion
+			switch event.Type {
+			case "ADDED", "MODIFIED":
+				slices[slice.Metadata.Name] = &slice
+			case "DELETED":
+				delete(slices, slice.Metadata.Name)
+			default:
+				// BOOKMARK 只用来更新 resourceVersion
+				continue
+			}
+			update(p.backends(slices))
+		}
+
+		// 连接很快就被关闭时，等到最短间隔之后再重新 watch
+		if wait := p.minWatchInterval - time.Since(started); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// backends 根据 EndpointSlice 计算后端列表
+// 只使用 ready 的端点；没有 ready 的端点时，退而使用正在终止但仍然 serving 的端点，让请求平滑迁移。
+// 配置了 zone 并且所有端点都带有拓扑提示时，只使用提示给本区域的端点
+func (p *k8sProvider) backends(slices map[string]*endpointSlice) []*BackendSpec {
+	type endpoint struct {
+		host    string
+		port    int
+		zone    string
+		hinted  bool
+		forZone bool
+	}
+	var ready, terminating []endpoint
+
+	for _, s := range slices {
+		if s.AddressType != "IPv4" && s.AddressType != "IPv6" {
+			continue
+		}
+		port, ok := p.slicePort(s)
+		if !ok {
+			continue
+		}
+		for _, e := range s.Endpoints {
+			isReady := e.Conditions.Ready == nil || *e.Conditions.Ready
+			isServing := isReady
+			if e.Conditions.Serving != nil {
+				isServing = *e.Conditions.Serving
+			}
+			isTerminating := e.Conditions.Terminating != nil && *e.Conditions.Terminating
+
+			ep := endpoint{port: port, zone: e.Zone, hinted: e.Hints != nil && len(e.Hints.ForZones) > 0}
+			if ep.hinted {
+				for _, z := range e.Hints.ForZones {
+					if z.Name == p.zone {
+						ep.forZone = true
+					}
+				}
+			}
+			for _, addr := range e.Addresses {
+				ep.host = addr
+				switch {
+				case isReady && !isTerminating:
+					ready = append(ready, ep)
+				case isServing && isTerminating:
+					terminating = append(terminating, ep)
+				}
+			}
+		}
+	}
+
+	selected := ready
+	if len(selected) == 0 {
+		selected = terminating
+	}
+	if p.zone != "" {
+		allHinted := len(selected) > 0
+		var local []endpoint
+		for _, ep := range selected {
+			allHinted = allHinted && ep.hinted
+			if ep.forZone {
+				local = append(local, ep)
+			}
+		}
+		// 部分端点没有提示或者本区域没有端点时，和 kube-proxy 一样忽略提示
+		if allHinted && len(local) > 0 {
+			selected = local
+		}
+	}
+
+	specs := make([]*BackendSpec, 0, len(selected))
+	for _, ep := range selected {
+		spec, err := p.spec(ep.host, ep.port, ep.zone)
+		if err != nil {
+			log.Printf("discovery %s: %s\n", p.name, err)
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// slicePort 返回 EndpointSlice 中要使用的端口，没有指定 port_name 时使用第一个端口
+func (p *k8sProvider) slicePort(s *endpointSlice) (int, bool) {
+	for _, port := range s.Ports {
+		if port.Port == nil {
+			continue
+		}
+		name := ""
+		if port.Name != nil {
+			name = *port.Name
+		}
+		if p.portName == "" || p.portName == name {
+			return *port.Port, true
+		}
+	}
+	return 0, false
+}
+
+// spec 把端点地址转换成后端配置，端点的可用区用于就近选择后端
+func (p *k8sProvider) spec(host string, port int, zone string) (*BackendSpec, error) {
+	s := p.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+	if zone != "" {
+		s += " zone=" + zone
+	}
+	return ParseBackendSpec(strings.TrimSpace(s+" "+p.params), p.defaults)
+}
@@ -0,0 +1,264 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSlice 生成测试用的 EndpointSlice，endpoints 为 "地址 条件" 的列表，
+// 条件为 ready、serving(正在终止但仍然可以处理请求)或 terminating(正在终止并且不再处理请求)
+func testSlice(name, rv string, port int, endpoints ...string) map[string]interface{} {
+	eps := make([]interface{}, 0, len(endpoints))
+	for _, e := range endpoints {
+		fields := strings.Fields(e)
+		conditions := map[string]interface{}{}
+		switch fields[1] {
+		case "ready":
+			conditions = map[string]interface{}{"ready": true, "serving": true, "terminating": false}
+		case "serving":
+			conditions = map[string]interface{}{"ready": false, "serving": true, "terminating": true}
+		case "terminating":
+			conditions = map[string]interface{}{"ready": false, "serving": false, "terminating": true}
+		case "notready":
+			conditions = map[string]interface{}{"ready": false, "serving": false, "terminating": false}
+		}
+		eps = append(eps, map[string]interface{}{"addresses": []string{fields[0]}, "conditions": conditions})
+	}
+	return map[string]interface{}{
+		"metadata":    map[string]interface{}{"name": name, "resourceVersion": rv},
+		"addressType": "IPv4",
+		"endpoints":   eps,
+		"ports":       []interface{}{map[string]interface{}{"name": "http", "port": port}},
+	}
+}
+
+func TestK8sProviderBackends(t *testing.T) {
+	tests := []struct {
+		name   string
+		slices []map[string]interface{}
+		want   []string
+	}{
+		{
+			name: "only ready endpoints",
+			slices: []map[string]interface{}{
+				testSlice("web-1", "1", 8080, "10.0.0.1 ready", "10.0.0.2 serving", "10.0.0.3 terminating", "10.0.0.4 notready"),
+				testSlice("web-2", "1", 8080, "10.0.0.5 ready"),
+			},
+			want: []string{"http://10.0.0.1:8080", "http://10.0.0.5:8080"},
+		},
+		{
+			// 没有 ready 的端点时使用正在终止但仍然 serving 的端点
+			name: "fall back to serving terminating endpoints",
+			slices: []map[string]interface{}{
+				testSlice("web-1", "1", 8080, "10.0.0.2 serving", "10.0.0.3 terminating", "10.0.0.4 notready"),
+			},
+			want: []string{"http://10.0.0.2:8080"},
+		},
+		{
+			name: "no endpoints",
+			slices: []map[string]interface{}{
+				testSlice("web-1", "1", 8080, "10.0.0.3 terminating"),
+			},
+			want: []string{},
+		},
+	}
+	p, err := newK8sProvider(DiscoveryConfig{Service: "web", APIServer: "http://127.0.0.1"}, BackendSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slices := make(map[string]*endpointSlice)
+			for _, raw := range tt.slices {
+				data, _ := json.Marshal(raw)
+				var s endpointSlice
+				if err := json.Unmarshal(data, &s); err != nil {
+					t.Fatal(err)
+				}
+				slices[s.Metadata.Name] = &s
+			}
+			if got := specHosts(p.backends(slices)); !equalStrings(got, tt.want) {
+				t.Errorf("backends = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeAPIServer 模拟 API Server 的 EndpointSlice list/watch 接口
+// watches 按顺序处理每一次 watch 请求，用完之后的 watch 请求一直阻塞到客户端断开
+type fakeAPIServer struct {
+	t *testing.T
+
+	mux     sync.Mutex
+	lists   []map[string]interface{}
+	watches []func(w http.ResponseWriter, rv string)
+	// requests 收到的请求，例如 "list" 或 "watch rv=1"
+	requests []string
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices" {
+		http.NotFound(w, r)
+		return
+	}
+	if got := r.URL.Query().Get("labelSelector"); got != "kubernetes.io/service-name=web" {
+		s.t.Errorf("labelSelector = %q", got)
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	s.mux.Lock()
+	if r.URL.Query().Get("watch") != "true" {
+		s.requests = append(s.requests, "list")
+		list := s.lists[0]
+		if len(s.lists) > 1 {
+			s.lists = s.lists[1:]
+		}
+		s.mux.Unlock()
+		_ = json.NewEncoder(w).Encode(list)
+		return
+	}
+	rv := r.URL.Query().Get("resourceVersion")
+	s.requests = append(s.requests, "watch rv="+rv)
+	var handle func(w http.ResponseWriter, rv string)
+	if len(s.watches) > 0 {
+		handle, s.watches = s.watches[0], s.watches[1:]
+	}
+	s.mux.Unlock()
+
+	if handle == nil {
+		<-r.Context().Done()
+		return
+	}
+	handle(w, rv)
+}
+
+func (s *fakeAPIServer) requestLog() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// sendEvents 在 watch 响应中逐个发送事件
+func sendEvents(w http.ResponseWriter, events ...map[string]interface{}) {
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		_ = enc.Encode(e)
+		w.(http.Flusher).Flush()
+	}
+}
+
+func listOf(rv string, items ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": rv},
+		"items":    items,
+	}
+}
+
+// 先 list 再 watch，watch 正常结束后从最后的 resourceVersion 继续，410 之后重新 list
+func TestK8sProviderListWatch(t *testing.T) {
+	api := &fakeAPIServer{t: t}
+	api.lists = []map[string]interface{}{
+		listOf("10", testSlice("web-1", "10", 8080, "10.0.0.1 ready")),
+		listOf("30", testSlice("web-1", "30", 8080, "10.0.0.9 ready")),
+	}
+	api.watches = []func(w http.ResponseWriter, rv string){
+		func(w http.ResponseWriter, rv string) {
+			sendEvents(w,
+				map[string]interface{}{"type": "ADDED", "object": testSlice("web-2", "11", 8080, "10.0.0.2 ready")},
+				map[string]interface{}{"type": "BOOKMARK", "object": map[string]interface{}{"metadata": map[string]interface{}{"resourceVersion": "12"}}},
+			)
+		},
+		func(w http.ResponseWriter, rv string) {
+			sendEvents(w,
+				// 10.0.0.1 开始终止，10.0.0.2 仍然 ready，只使用 10.0.0.2
+				map[string]interface{}{"type": "MODIFIED", "object": testSlice("web-1", "13", 8080, "10.0.0.1 serving")},
+				map[string]interface{}{"type": "DELETED", "object": testSlice("web-2", "14", 8080)},
+			)
+		},
+		func(w http.ResponseWriter, rv string) {
+			sendEvents(w, map[string]interface{}{
+				"type":   "ERROR",
+				"object": map[string]interface{}{"kind": "Status", "code": 410, "reason": "Expired"},
+			})
+		},
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	p, err := newK8sProvider(DiscoveryConfig{Service: "web", APIServer: srv.URL}, BackendSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.retryInterval = 10 * time.Millisecond
+	p.minWatchInterval = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []string, 10)
+	go p.Run(ctx, func(specs []*BackendSpec) { updates <- specHosts(specs) })
+
+	want := [][]string{
+		{"http://10.0.0.1:8080"},
+		{"http://10.0.0.1:8080", "http://10.0.0.2:8080"},
+		// web-1 修改后只剩终止中的端点，web-2 仍然 ready
+		{"http://10.0.0.2:8080"},
+		// web-2 删除后没有 ready 的端点，使用终止中但仍然 serving 的端点
+		{"http://10.0.0.1:8080"},
+		// 410 之后重新 list
+		{"http://10.0.0.9:8080"},
+	}
+	for i, w := range want {
+		select {
+		case got := <-updates:
+			if !equalStrings(got, w) {
+				t.Fatalf("update %d = %v, want %v", i, got, w)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("update %d: timeout, requests %v", i, api.requestLog())
+		}
+	}
+
+	wantRequests := []string{"list", "watch rv=10", "watch rv=12", "watch rv=14", "list", "watch rv=30"}
+	deadline := time.Now().Add(time.Second)
+	for len(api.requestLog()) < len(wantRequests) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := api.requestLog(); !equalStrings(got, wantRequests) {
+		t.Errorf("requests = %v, want %v", got, wantRequests)
+	}
+}
+
+// watch 返回 200 但是立即关闭连接时，不能不停地重新 watch
+func TestK8sProviderWatchEmptyBody(t *testing.T) {
+	var watches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			atomic.AddInt32(&watches, 1)
+			return
+		}
+		fmt.Fprint(w, `{"metadata":{"resourceVersion":"1"},"items":[]}`)
+	}))
+	defer srv.Close()
+
+	p, err := newK8sProvider(DiscoveryConfig{Service: "web", APIServer: srv.URL}, BackendSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.minWatchInterval = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 350*time.Millisecond)
+	defer cancel()
+	p.Run(ctx, func(specs []*BackendSpec) {})
+
+	if n := atomic.LoadInt32(&watches); n > 5 {
+		t.Fatalf("%d watch requests in 350ms, expected at most 5", n)
+	}
+}
@@ -0,0 +1,9 @@
+module loadbalancer
+
+go 1.14
+
+require (
+	github.com/fsnotify/fsnotify v1.4.9
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	gopkg.in/yaml.v2 v2.2.4
+)
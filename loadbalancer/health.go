@@ -0,0 +1,101 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// IsBackendAlive 被动模式 检测服务可用性，建立tcp连接判断后台服务是否可用
+func IsBackendAlive(u *url.URL) bool {
+	timeout := 2 * time.Second
+	if u.Scheme == "udp" {
+		return isUDPAlive(u, timeout)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+	if err != nil {
+		log.Println("Site unreachable, error: ", err)
+		return false
+	}
+	// 执行完操作后要关闭连接，避免给服务器造成额外的负担，否则服务器会一直维护连接
+	_ = conn.Close()
+	return true
+}
+
+// isUDPAlive UDP 是无连接的，拨号总是成功，无法用来判断可用性。
+// 这里向后端发送一个空报文，端口没有监听时连接型 socket 会收到 ICMP 端口不可达，读取返回 connection refused；
+// 超时没有收到回复说明端口可能在监听，只是不回复空报文，认为后端可用。
+// 和转发时被动摘除使用相同的判断，被摘除的后端在端口恢复监听之前不会被健康检测重新放行
+func isUDPAlive(u *url.URL, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("udp", u.Host, timeout)
+	if err != nil {
+		log.Println("Site unreachable, error: ", err)
+		return false
+	}
+	defer conn.Close()
+	if _, err := conn.Write(nil); err != nil {
+		log.Println("Site unreachable, error: ", err)
+		return false
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout / 4))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return true
+		}
+		log.Println("Site unreachable, error: ", err)
+		return false
+	}
+	return true
+}
+
+// isAlive 检测后端是否可用，设置了 WithHealthCheckPath 的 HTTP 后端发送 GET 请求，其他后端建立 TCP 连接
+func (s *ServerPool) isAlive(u *url.URL) bool {
+	if s.healthPath == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return IsBackendAlive(u)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	target := *u
+	target.Path = strings.TrimRight(u.Path, "/") + s.healthPath
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		log.Println("Health check error: ", err)
+		return false
+	}
+	// 使用转发请求的连接池，注入相同的凭据，探测请求不计入 transport 指标
+	resp, err := s.healthTransport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		log.Println("Site unreachable, error: ", err)
+		return false
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		log.Printf("Health check %s returned %d\n", target.String(), resp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// RunHealthCheck 每隔 interval 执行一次健康检测，直到 ctx 结束，需要额外开启一个goroutine去执行此方法
+func (s *ServerPool) RunHealthCheck(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		// <-t.C 每隔 interval 返回一个值，select 会检测到这个事件。在没有 default case 的情况下，select 会一直等待，直到有满足条件的 case 被执行
+		case <-t.C:
+			log.Println("Starting health check...")
+			s.HealthCheck()
+			log.Println("Health check completed")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
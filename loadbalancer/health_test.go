@@ -0,0 +1,35 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// 健康检测的请求注入凭据，但是不计入连接复用的指标
+func TestHealthCheckNotCounted(t *testing.T) {
+	var authorization string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer backend.Close()
+
+	pool := NewServerPool("test", WithHealthCheckPath("/healthz"), WithHeaders(func() http.Header {
+		return http.Header{"Authorization": []string{"Bearer token"}}
+	}))
+	u, _ := url.Parse(backend.URL)
+	for i := 0; i < 3; i++ {
+		if !pool.isAlive(u) {
+			t.Fatal("backend should be alive")
+		}
+	}
+	if authorization != "Bearer token" {
+		t.Errorf("Authorization = %q, want the injected credentials", authorization)
+	}
+
+	ct := pool.transport.(*headerTransport).RoundTripper.(*countingTransport)
+	if n := ct.reused.Value() + ct.created.Value(); n != 0 {
+		t.Errorf("transport counted %d health check requests", n)
+	}
+}
@@ -0,0 +1,367 @@
+package loadbalancer
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgeConfig 请求对冲配置
+type HedgeConfig struct {
+	// Delay 第一个请求超过这个时间还没有响应时，向另一个后端再发送一次请求
+	// 配置了 Percentile 时作为延迟的下限，以及样本不足时使用的延迟
+	Delay time.Duration
+	// Percentile 按最近请求第一个后端返回响应头的延迟的百分位计算延迟，例如 95 表示 p95，0 表示使用固定的 Delay
+	Percentile float64
+	// BudgetPercent 对冲请求最多占请求数的百分比，默认为 10
+	BudgetPercent float64
+}
+
+const (
+	// hedgeSamples 计算百分位使用的最近请求数
+	hedgeSamples = 1000
+	// hedgeMinSamples 样本少于这个数量时使用固定的 Delay
+	hedgeMinSamples = 20
+	// hedgeBurst 预算最多累积的对冲请求数
+	hedgeBurst = 10
+)
+
+// Hedger 请求对冲，用于降低只读请求的长尾延迟
+// 第一个请求超过延迟还没有响应时，向另一个后端再发送一次相同的请求，使用先返回的响应，取消另一个请求。
+// 每个请求为预算增加 BudgetPercent/100 个额度，发送对冲请求消耗一个额度，额度用完时不再对冲
+type Hedger struct {
+	cfg HedgeConfig
+
+	mux     sync.Mutex
+	samples []hedgeSample
+	next    int
+	// delay 按百分位计算的延迟，每秒最多计算一次
+	delay      time.Duration
+	computedAt time.Time
+	budget     float64
+
+	hedged          *expvar.Int
+	wins            *expvar.Int
+	budgetExhausted *expvar.Int
+	noPeer          *expvar.Int
+}
+
+// NewHedger 创建名为 name 的请求对冲，通常一个路由一个，请求通过 WithHedger 使用它
+func (lb *LoadBalancer) NewHedger(name string, cfg HedgeConfig) *Hedger {
+	if cfg.BudgetPercent <= 0 {
+		cfg.BudgetPercent = 10
+	}
+	h := &Hedger{
+		cfg:             cfg,
+		delay:           cfg.Delay,
+		budget:          hedgeBurst,
+		hedged:          new(expvar.Int),
+		wins:            new(expvar.Int),
+		budgetExhausted: new(expvar.Int),
+		noPeer:          new(expvar.Int),
+	}
+	m := new(expvar.Map).Init()
+	// hedged 发送的对冲请求数，wins 对冲请求先返回的次数
+	m.Set("hedged", h.hedged)
+	m.Set("wins", h.wins)
+	m.Set("budget_exhausted", h.budgetExhausted)
+	m.Set("no_peer", h.noPeer)
+	m.Set("delay_ms", expvar.Func(func() interface{} {
+		return h.currentDelay().Milliseconds()
+	}))
+	statsMap(lb.stats, "hedge").Set(name, m)
+	return h
+}
+
+// hedgeSample 一个请求中第一个后端返回响应头的时间
+// 对冲请求先返回时第一个后端被取消，censored 为 true，latency 为取消时的时间，第一个后端实际的延迟不小于它
+type hedgeSample struct {
+	latency  time.Duration
+	censored bool
+}
+
+// WithHedger 返回带有对冲策略的 context，负载均衡器对其中的 GET、HEAD 请求进行对冲
+func WithHedger(ctx context.Context, h *Hedger) context.Context {
+	return context.WithValue(ctx, hedgerKey, h)
+}
+
+// getHedger 返回请求使用的对冲策略，没有时返回 nil
+func getHedger(r *http.Request) *Hedger {
+	h, _ := r.Context().Value(hedgerKey).(*Hedger)
+	return h
+}
+
+// observe 记录一个请求的第一个后端的延迟，并为预算增加额度
+// 不能记录胜出的延迟：对冲请求胜出时延迟接近 delay，百分位会一直停留在 delay，不能反映后端真实的延迟
+func (h *Hedger) observe(sample hedgeSample) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.budget += h.cfg.BudgetPercent / 100
+	if h.budget > hedgeBurst {
+		h.budget = hedgeBurst
+	}
+	if h.cfg.Percentile <= 0 {
+		return
+	}
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, sample)
+	} else {
+		h.samples[h.next] = sample
+		h.next = (h.next + 1) % hedgeSamples
+	}
+}
+
+// allow 消耗一个额度，额度不足时返回 false
+func (h *Hedger) allow() bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.budget < 1 {
+		h.budgetExhausted.Add(1)
+		return false
+	}
+	h.budget--
+	return true
+}
+
+// currentDelay 返回发送对冲请求前等待的时间
+// 百分位落在被取消的样本上时，第一个后端实际的百分位比它大，但不知道大多少，延迟加倍，直到足够多的请求不再需要对冲
+func (h *Hedger) currentDelay() time.Duration {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.cfg.Percentile <= 0 || len(h.samples) < hedgeMinSamples || time.Since(h.computedAt) < time.Second {
+		return h.delay
+	}
+	sorted := make([]hedgeSample, len(h.samples))
+	copy(sorted, h.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].latency < sorted[j].latency })
+	idx := int(float64(len(sorted)) * h.cfg.Percentile / 100)
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	if sorted[idx].censored {
+		// 在更小的延迟下被取消的样本不说明当前的延迟不够
+		if sorted[idx].latency >= h.delay {
+			h.delay *= 2
+		}
+		if h.delay < sorted[idx].latency {
+			h.delay = sorted[idx].latency
+		}
+	} else {
+		h.delay = sorted[idx].latency
+	}
+	if h.delay < h.cfg.Delay {
+		h.delay = h.cfg.Delay
+	}
+	h.computedAt = time.Now()
+	return h.delay
+}
+
+// serveHedged 把请求发给 primary，超过延迟还没有响应时再发给另一个后端，使用先返回的响应
+func (lb *LoadBalancer) serveHedged(w http.ResponseWriter, r *http.Request, pool *ServerPool, primary *Backend, h *Hedger) {
+	start := time.Now()
+	race := &hedgeRace{w: w}
+	finished := make(chan int, 2)
+	attempt := func(peer *Backend) {
+		ctx, cancel := context.WithCancel(r.Context())
+		idx := race.add(cancel)
+		hw := &hedgeWriter{race: race, idx: idx, header: make(http.Header)}
+		lease := &peerLease{pool: pool, peer: peer}
+		go func() {
+			// ReverseProxy 在复制响应体失败时会以 http.ErrAbortHandler panic，
+			// 这里没有人 recover，必须在 defer 中释放名额并通知 wait，panic 交给处理请求的 goroutine 重新抛出
+			defer func() {
+				if p := recover(); p != nil {
+					race.setPanic(idx, p)
+				}
+				lease.release()
+				cancel()
+				finished <- idx
+			}()
+			peer.ReverseProxy.ServeHTTP(hw, r.WithContext(context.WithValue(ctx, leaseKey, lease)))
+		}()
+	}
+
+	attempt(primary)
+	timer := time.NewTimer(h.currentDelay())
+	defer timer.Stop()
+	started := 1
+	select {
+	case idx := <-finished:
+		h.observe(race.primarySample(start))
+		race.repanic(race.wait(idx, finished, started-1))
+		return
+	case <-timer.C:
+	}
+
+	// 第一个请求超过延迟还没有响应，发给另一个后端
+	if race.winner() < 0 && h.allow() {
+		if peer := pool.TryAcquirePeerExcluding(primary); peer != nil {
+			h.hedged.Add(1)
+			attempt(peer)
+			started++
+		} else {
+			h.noPeer.Add(1)
+		}
+	}
+	idx := <-finished
+	winner := race.wait(idx, finished, started-1)
+	h.observe(race.primarySample(start))
+	if winner == 1 {
+		h.wins.Add(1)
+	}
+	race.repanic(winner)
+}
+
+// hedgeRace 同一个请求的多次尝试，第一个写响应头的尝试胜出，其余的被取消
+type hedgeRace struct {
+	w http.ResponseWriter
+
+	mux     sync.Mutex
+	cancels []context.CancelFunc
+	won     int
+	decided bool
+	// decidedAt 胜出的尝试写响应头的时间
+	decidedAt time.Time
+	// panics 以 panic 结束的尝试
+	panics map[int]interface{}
+}
+
+// add 添加一次尝试，返回它的序号
+func (race *hedgeRace) add(cancel context.CancelFunc) int {
+	race.mux.Lock()
+	defer race.mux.Unlock()
+	race.cancels = append(race.cancels, cancel)
+	return len(race.cancels) - 1
+}
+
+// claim 尝试 idx 准备写响应，第一个调用的尝试胜出并取消其余的尝试
+func (race *hedgeRace) claim(idx int) bool {
+	race.mux.Lock()
+	defer race.mux.Unlock()
+	if !race.decided {
+		race.decided = true
+		race.won = idx
+		race.decidedAt = time.Now()
+		for i, cancel := range race.cancels {
+			if i != idx {
+				cancel()
+			}
+		}
+	}
+	return race.won == idx
+}
+
+// winner 返回胜出的尝试，还没有决定时返回 -1
+func (race *hedgeRace) winner() int {
+	race.mux.Lock()
+	defer race.mux.Unlock()
+	if !race.decided {
+		return -1
+	}
+	return race.won
+}
+
+// primarySample 返回第一个尝试（序号 0）从 start 开始的延迟，其他尝试胜出时第一个尝试在那个时间被取消
+// 没有尝试写响应头时使用当前的时间
+func (race *hedgeRace) primarySample(start time.Time) hedgeSample {
+	race.mux.Lock()
+	defer race.mux.Unlock()
+	if !race.decided {
+		return hedgeSample{latency: time.Since(start)}
+	}
+	return hedgeSample{latency: race.decidedAt.Sub(start), censored: race.won != 0}
+}
+
+// wait 等待胜出的尝试写完响应，idx 为已经结束的尝试，pending 为还没有结束的尝试数
+// 被取消的尝试不会写响应，所有尝试都结束时返回
+func (race *hedgeRace) wait(idx int, finished chan int, pending int) int {
+	for {
+		if winner := race.winner(); winner == idx || pending == 0 {
+			return winner
+		}
+		idx = <-finished
+		pending--
+	}
+}
+
+// setPanic 记录尝试 idx 的 panic
+func (race *hedgeRace) setPanic(idx int, p interface{}) {
+	race.mux.Lock()
+	defer race.mux.Unlock()
+	if race.panics == nil {
+		race.panics = make(map[int]interface{})
+	}
+	race.panics[idx] = p
+}
+
+// repanic 在处理请求的 goroutine 中重新抛出胜出的尝试的 panic，让 http.Server 中断响应。
+// 没有尝试胜出时抛出任意一个 panic，被取消的尝试的 panic 不影响已经写出的响应
+func (race *hedgeRace) repanic(winner int) {
+	race.mux.Lock()
+	p, ok := race.panics[winner]
+	if winner < 0 {
+		for _, v := range race.panics {
+			p, ok = v, true
+			break
+		}
+	}
+	race.mux.Unlock()
+	if ok {
+		panic(p)
+	}
+}
+
+// hedgeWriter 一次尝试使用的 ResponseWriter，只有胜出的尝试会写到客户端
+type hedgeWriter struct {
+	race        *hedgeRace
+	idx         int
+	header      http.Header
+	wroteHeader bool
+	won         bool
+}
+
+func (hw *hedgeWriter) Header() http.Header {
+	if hw.won {
+		return hw.race.w.Header()
+	}
+	return hw.header
+}
+
+func (hw *hedgeWriter) WriteHeader(status int) {
+	if hw.wroteHeader {
+		return
+	}
+	hw.wroteHeader = true
+	if !hw.race.claim(hw.idx) {
+		return
+	}
+	hw.won = true
+	dst := hw.race.w.Header()
+	for k, v := range hw.header {
+		dst[k] = v
+	}
+	hw.race.w.WriteHeader(status)
+}
+
+func (hw *hedgeWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !hw.won {
+		return len(b), nil
+	}
+	return hw.race.w.Write(b)
+}
+
+// Flush ReverseProxy 转发流式响应时需要及时刷新
+func (hw *hedgeWriter) Flush() {
+	if !hw.won {
+		return
+	}
+	if f, ok := hw.race.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,108 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 后端在响应体中途断开时 ReverseProxy 以 http.ErrAbortHandler panic，
+// 对冲的请求不能一直阻塞，后端的名额也要释放
+func TestHedgeAttemptPanic(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	lb := New(WithBackends(&BackendSpec{URL: u, MaxConns: 1}))
+	h := lb.NewHedger("test", HedgeConfig{Delay: time.Second})
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lb.ServeHTTP(w, r.WithContext(WithHedger(r.Context(), h)))
+	}))
+	defer front.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(front.URL)
+		if err != nil {
+			return
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("hedged request did not finish after the attempt panicked")
+	}
+
+	peer := lb.Pool(DefaultPool).Backends()[0]
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&peer.active) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&peer.active); n != 0 {
+		t.Fatalf("active = %d after the request, want 0", n)
+	}
+}
+
+// 对冲请求胜出时记录的是第一个后端被取消的时间，延迟按第一个后端的百分位增长，不会停留在 Delay
+func TestHedgeDelayFollowsPrimaryLatency(t *testing.T) {
+	const slow = 100 * time.Millisecond
+	var mux sync.Mutex
+	seen := make(map[string]bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		mux.Lock()
+		first := !seen[id]
+		seen[id] = true
+		mux.Unlock()
+		// 十分之一的请求在第一个后端上很慢，对冲请求立即返回，第一个后端的 p95 为 slow
+		if first && strings.HasSuffix(id, "0") {
+			select {
+			case <-time.After(slow):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	// 同一个后端的两个地址，对冲请求发给另一个地址
+	u1, _ := url.Parse(backend.URL)
+	u2, _ := url.Parse(strings.Replace(backend.URL, "127.0.0.1", "localhost", 1))
+	lb := New(WithBackends(&BackendSpec{URL: u1}, &BackendSpec{URL: u2}))
+	h := lb.NewHedger("delay", HedgeConfig{Delay: 10 * time.Millisecond, Percentile: 95, BudgetPercent: 100})
+	for round := 0; round < 8; round++ {
+		for i := 0; i < 50; i++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-Request-Id", fmt.Sprintf("%d-%d", round, i))
+			lb.ServeHTTP(httptest.NewRecorder(), r.WithContext(WithHedger(r.Context(), h)))
+		}
+		// 不等一秒，每轮之后重新计算延迟
+		h.mux.Lock()
+		h.computedAt = time.Time{}
+		h.mux.Unlock()
+		h.currentDelay()
+	}
+	if d := h.currentDelay(); d < slow || d > 2*slow {
+		t.Errorf("delay = %s, want the primary p95 of %s", d, slow)
+	}
+}
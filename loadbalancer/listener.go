@@ -0,0 +1,298 @@
+package loadbalancer
+
+import (
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ListenerConfig 接收客户端请求的 http.Server 的超时时间和连接数限制，防止慢速客户端长时间占用连接
+type ListenerConfig struct {
+	// ReadHeaderTimeout 读取请求头的超时时间，慢速发送请求头(slowloris)的连接超时后被关闭
+	ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+	// ReadTimeout 读取整个请求(包括请求体)的超时时间，0 表示不限制
+	ReadTimeout time.Duration `mapstructure:"read_timeout"`
+	// WriteTimeout 从读完请求头到写完响应的超时时间，包括等待后端的时间，0 表示不限制
+	WriteTimeout time.Duration `mapstructure:"write_timeout"`
+	// IdleTimeout keep-alive 连接等待下一个请求的时间
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	// MaxHeaderBytes 请求行和请求头的最大字节数，超过时返回 431
+	MaxHeaderBytes int `mapstructure:"max_header_bytes"`
+	// MaxConns 同时打开的客户端连接数上限，超过时直接关闭新连接，0 表示不限制
+	MaxConns int `mapstructure:"max_conns"`
+	// MaxConnsPerIP 每个客户端 IP 同时打开的连接数上限，0 表示不限制
+	MaxConnsPerIP int `mapstructure:"max_conns_per_ip"`
+}
+
+// DefaultListenerConfig 默认的超时时间，只限制读取请求头和空闲连接的时间，不影响上传大文件和长时间的响应
+var DefaultListenerConfig = ListenerConfig{
+	ReadHeaderTimeout: 10 * time.Second,
+	IdleTimeout:       120 * time.Second,
+	MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+}
+
+// Apply 把超时时间和请求头大小设置到 srv 上，为 0 的字段使用 DefaultListenerConfig 中的值
+// ReadTimeout 和 WriteTimeout 默认不限制，设置为 0 时保持不限制
+func (c ListenerConfig) Apply(srv *http.Server) {
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = DefaultListenerConfig.ReadHeaderTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultListenerConfig.IdleTimeout
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = DefaultListenerConfig.MaxHeaderBytes
+	}
+	srv.ReadHeaderTimeout = c.ReadHeaderTimeout
+	srv.ReadTimeout = c.ReadTimeout
+	srv.WriteTimeout = c.WriteTimeout
+	srv.IdleTimeout = c.IdleTimeout
+	srv.MaxHeaderBytes = c.MaxHeaderBytes
+}
+
+// ConnLimitListener 限制同时打开的连接总数和每个 IP 的连接数，超过上限的连接被关闭
+// 连接总数在 Accept 中检查；每个 IP 的连接数在连接第一次读写时检查，放在解析 PROXY protocol 的监听器外面时，
+// 获取地址需要等待协议头，在连接自己的 goroutine 中检查不会阻塞 Accept
+type ConnLimitListener struct {
+	net.Listener
+	maxConns int
+	maxPerIP int
+	// Exempt 不受每个 IP 连接数限制的网段，例如发送 PROXY protocol 的上游负载均衡自己的连接
+	Exempt []*net.IPNet
+
+	mux   sync.Mutex
+	total int
+	perIP map[string]int
+
+	active        *expvar.Int
+	rejectedTotal *expvar.Int
+	rejectedPerIP *expvar.Int
+	clientIPs     *expvar.Int
+}
+
+// NewConnLimitListener 包装 l，连接数上限为 0 时不限制，指标放在 stats 中
+// 开启 PROXY protocol 时用两个 ConnLimitListener：解析协议头的监听器里面只限制连接总数，外面只按协议头中的客户端地址限制每个 IP 的连接数。
+// 两个 ConnLimitListener 可以使用同一个 stats，只设置各自限制的指标
+func NewConnLimitListener(l net.Listener, cfg ListenerConfig, stats *expvar.Map) *ConnLimitListener {
+	cl := &ConnLimitListener{
+		Listener:      l,
+		maxConns:      cfg.MaxConns,
+		maxPerIP:      cfg.MaxConnsPerIP,
+		perIP:         make(map[string]int),
+		active:        new(expvar.Int),
+		rejectedTotal: new(expvar.Int),
+		rejectedPerIP: new(expvar.Int),
+		clientIPs:     new(expvar.Int),
+	}
+	if stats != nil {
+		if cl.maxConns > 0 || cl.maxPerIP == 0 {
+			stats.Set("active", cl.active)
+			// rejected_total 因为连接总数达到上限被关闭的连接
+			stats.Set("rejected_total", cl.rejectedTotal)
+		}
+		if cl.maxPerIP > 0 || cl.maxConns == 0 {
+			// rejected_per_ip 因为单个 IP 的连接数达到上限被关闭的连接
+			stats.Set("rejected_per_ip", cl.rejectedPerIP)
+			stats.Set("client_ips", cl.clientIPs)
+		}
+	}
+	return cl
+}
+
+// Accept 接收连接，超过连接总数上限的连接关闭后继续等待下一个连接
+func (l *ConnLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if reason := l.acquire(); reason != "" {
+			log.Printf("%s connection rejected: %s\n", conn.RemoteAddr(), reason)
+			_ = conn.Close()
+			continue
+		}
+		return &limitedConn{Conn: conn, l: l}, nil
+	}
+}
+
+// acquire 占用一个连接总数的名额，超过上限时返回原因
+func (l *ConnLimitListener) acquire() string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.maxConns > 0 && l.total >= l.maxConns {
+		l.rejectedTotal.Add(1)
+		return "too many connections (" + strconv.Itoa(l.maxConns) + ")"
+	}
+	l.total++
+	l.active.Set(int64(l.total))
+	return ""
+}
+
+// acquireIP 为来自 ip 的连接占用一个名额，超过上限时返回原因
+func (l *ConnLimitListener) acquireIP(ip string) string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.perIP[ip] >= l.maxPerIP {
+		l.rejectedPerIP.Add(1)
+		return "too many connections from " + ip + " (" + strconv.Itoa(l.maxPerIP) + ")"
+	}
+	l.perIP[ip]++
+	l.clientIPs.Set(int64(len(l.perIP)))
+	return ""
+}
+
+// release 归还连接占用的名额，ip 为空表示没有占用 IP 的名额
+func (l *ConnLimitListener) release(ip string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.total--
+	l.active.Set(int64(l.total))
+	if ip == "" {
+		return
+	}
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	l.clientIPs.Set(int64(len(l.perIP)))
+}
+
+// errConnLimit 连接因为超过每个 IP 的连接数上限被关闭
+var errConnLimit = errors.New("connection closed: too many connections from this IP")
+
+// limitedConn 第一次读写时检查每个 IP 的连接数，关闭时归还名额，Close 可能被调用多次，只归还一次
+type limitedConn struct {
+	net.Conn
+	l *ConnLimitListener
+
+	// checked 保护 ip 和 err，Close 之后不再占用 IP 的名额
+	checked sync.Once
+	ip      string
+	err     error
+	closed  sync.Once
+}
+
+// checkIP 占用 IP 的名额，超过上限时关闭连接
+func (c *limitedConn) checkIP() error {
+	c.checked.Do(func() {
+		if c.l.maxPerIP <= 0 {
+			return
+		}
+		ip := AddrIP(c.Conn.RemoteAddr())
+		if ip == nil || IPInNets(ip, c.l.Exempt) {
+			return
+		}
+		if reason := c.l.acquireIP(ip.String()); reason != "" {
+			log.Printf("%s connection rejected: %s\n", c.Conn.RemoteAddr(), reason)
+			c.err = errConnLimit
+			// 在 checked.Do 里面，不能调用 Close
+			_ = c.close()
+			return
+		}
+		c.ip = ip.String()
+	})
+	return c.err
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if err := c.checkIP(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	if err := c.checkIP(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *limitedConn) Close() error {
+	// 还没有检查过的连接不再占用 IP 的名额
+	c.checked.Do(func() {})
+	return c.close()
+}
+
+func (c *limitedConn) close() error {
+	err := c.Conn.Close()
+	c.closed.Do(func() { c.l.release(c.ip) })
+	return err
+}
+
+// AddrIP 返回地址中的 IP，地址中没有 IP 时返回 nil
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// IPInNets ip 是否属于 nets 中的某个网段
+func IPInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrBodyTooLarge 请求体超过 MaxBodyHandler 限制的大小
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// MaxBodyHandler 限制请求体的大小，超过 n 字节时返回 413，n 为 0 时不限制
+// Content-Length 超过限制的请求直接拒绝，分块传输的请求在读取超过限制时中止转发
+func MaxBodyHandler(n int64, next http.Handler) http.Handler {
+	if n <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r = r.WithContext(r.Context())
+			r.Body = &limitedBody{ReadCloser: r.Body, remaining: n}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody 读取超过 remaining 字节时返回 ErrBodyTooLarge
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// 多读一个字节，用来判断请求体是否正好等于上限
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), ErrBodyTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,180 @@
+package loadbalancer
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestConnLimit 在随机端口上监听，accepted 接收 Accept 返回的连接
+func newTestConnLimit(t *testing.T, cfg ListenerConfig) (*ConnLimitListener, chan net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := NewConnLimitListener(l, cfg, nil)
+	t.Cleanup(func() { _ = cl.Close() })
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := cl.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return cl, accepted
+}
+
+// dial 连接 l 并发送一个字节
+func dial(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// closedByServer 服务端是否关闭了连接
+func closedByServer(conn net.Conn) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	return err == io.EOF || err != nil && !err.(net.Error).Timeout()
+}
+
+func accept(t *testing.T, accepted chan net.Conn) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-accepted:
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+		return nil
+	}
+}
+
+// 连接总数达到上限时关闭新连接，已有的连接关闭后归还名额
+func TestConnLimitListenerTotal(t *testing.T) {
+	cl, accepted := newTestConnLimit(t, ListenerConfig{MaxConns: 2})
+	dial(t, cl)
+	first := accept(t, accepted)
+	dial(t, cl)
+	accept(t, accepted)
+
+	if rejected := dial(t, cl); !closedByServer(rejected) {
+		t.Error("third connection was not closed")
+	}
+	if n := cl.rejectedTotal.Value(); n != 1 {
+		t.Errorf("rejected_total = %d, want 1", n)
+	}
+
+	// Close 调用多次只归还一次
+	_ = first.Close()
+	_ = first.Close()
+	if n := cl.active.Value(); n != 1 {
+		t.Errorf("active = %d after closing a connection, want 1", n)
+	}
+	dial(t, cl)
+	conn := accept(t, accepted)
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Errorf("read after a slot was released: %s", err)
+	}
+	if n := cl.active.Value(); n != 2 {
+		t.Errorf("active = %d, want 2", n)
+	}
+}
+
+// 每个 IP 的连接数在第一次读写时检查，超过上限的连接被关闭，Exempt 中的地址不受限制
+func TestConnLimitListenerPerIP(t *testing.T) {
+	cl, accepted := newTestConnLimit(t, ListenerConfig{MaxConnsPerIP: 1})
+	dial(t, cl)
+	first := accept(t, accepted)
+	if _, err := first.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := dial(t, cl)
+	if _, err := accept(t, accepted).Read(make([]byte, 1)); err != errConnLimit {
+		t.Errorf("second connection read error = %v, want %v", err, errConnLimit)
+	}
+	if !closedByServer(rejected) {
+		t.Error("second connection from the same IP was not closed")
+	}
+	if n := cl.rejectedPerIP.Value(); n != 1 {
+		t.Errorf("rejected_per_ip = %d, want 1", n)
+	}
+
+	_ = first.Close()
+	dial(t, cl)
+	if _, err := accept(t, accepted).Read(make([]byte, 1)); err != nil {
+		t.Errorf("read after the IP's slot was released: %s", err)
+	}
+	// 没有读写就关闭的连接不占用 IP 的名额
+	dial(t, cl)
+	_ = accept(t, accepted).Close()
+	cl.mux.Lock()
+	perIP, total := cl.perIP["127.0.0.1"], cl.total
+	cl.mux.Unlock()
+	if perIP != 1 || total != 1 {
+		t.Errorf("127.0.0.1 holds %d of %d connections, want 1 of 1", perIP, total)
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cl.Exempt = []*net.IPNet{loopback}
+	dial(t, cl)
+	if _, err := accept(t, accepted).Read(make([]byte, 1)); err != nil {
+		t.Errorf("exempt connection read error: %s", err)
+	}
+}
+
+func TestMaxBodyHandler(t *testing.T) {
+	const limit = 10
+	tests := []struct {
+		name    string
+		body    string
+		chunked bool
+		status  int
+		read    string
+	}{
+		{name: "under the limit", body: "hello", status: http.StatusOK, read: "hello"},
+		{name: "at the limit", body: "0123456789", status: http.StatusOK, read: "0123456789"},
+		{name: "content-length over the limit", body: "0123456789a", status: http.StatusRequestEntityTooLarge},
+		{name: "chunked under the limit", body: "hello", chunked: true, status: http.StatusOK, read: "hello"},
+		{name: "chunked at the limit", body: "0123456789", chunked: true, status: http.StatusOK, read: "0123456789"},
+		{name: "chunked crossing the limit", body: strings.Repeat("x", 100), chunked: true, status: http.StatusRequestEntityTooLarge,
+			read: strings.Repeat("x", limit)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var read string
+			h := MaxBodyHandler(limit, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := ioutil.ReadAll(r.Body)
+				read = string(body)
+				if err == ErrBodyTooLarge {
+					http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+				}
+			}))
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.status || read != tt.read {
+				t.Errorf("got %d with %q read, want %d with %q read", rec.Code, read, tt.status, tt.read)
+			}
+		})
+	}
+}
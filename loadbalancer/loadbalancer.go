@@ -0,0 +1,243 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+// DefaultPool 默认后端池的名称，请求没有指定后端池时使用
+const DefaultPool = "default"
+
+// LoadBalancer HTTP 负载均衡器，实现了 http.Handler
+// 按请求 context 中的后端池名称(见 WithUpstream)选择后端池，后端出错时重试，多次失败后把后端标记为宕机并换一个后端
+type LoadBalancer struct {
+	mux   sync.RWMutex
+	pools map[string]*ServerPool
+
+	stats               *expvar.Map
+	poolOptions         []PoolOption
+	backends            []*BackendSpec
+	maxAttempts         int
+	maxRetries          int
+	retryDelay          time.Duration
+	healthCheckInterval time.Duration
+}
+
+// Option LoadBalancer 的可选配置
+type Option func(lb *LoadBalancer)
+
+// WithBackends 默认后端池的后端
+func WithBackends(specs ...*BackendSpec) Option {
+	return func(lb *LoadBalancer) {
+		lb.backends = append(lb.backends, specs...)
+	}
+}
+
+// WithPoolOptions 默认后端池的配置
+func WithPoolOptions(opts ...PoolOption) Option {
+	return func(lb *LoadBalancer) {
+		lb.poolOptions = append(lb.poolOptions, opts...)
+	}
+}
+
+// WithStats 把所有后端池的指标放在 stats 中，不设置时指标不会导出
+func WithStats(stats *expvar.Map) Option {
+	return func(lb *LoadBalancer) {
+		lb.stats = stats
+	}
+}
+
+// WithMaxAttempts 一个请求最多尝试几个后端，默认为 3
+func WithMaxAttempts(n int) Option {
+	return func(lb *LoadBalancer) {
+		lb.maxAttempts = n
+	}
+}
+
+// WithMaxRetries 同一个后端最多重试几次，之后把它标记为宕机，默认为 3
+func WithMaxRetries(n int) Option {
+	return func(lb *LoadBalancer) {
+		lb.maxRetries = n
+	}
+}
+
+// WithHealthCheckInterval 健康检测的间隔，默认为 20 秒
+func WithHealthCheckInterval(d time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthCheckInterval = d
+	}
+}
+
+// New 创建负载均衡器以及名为 default 的默认后端池
+func New(opts ...Option) *LoadBalancer {
+	lb := &LoadBalancer{
+		pools:               make(map[string]*ServerPool),
+		maxAttempts:         3,
+		maxRetries:          3,
+		retryDelay:          10 * time.Millisecond,
+		healthCheckInterval: 20 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	if lb.stats == nil {
+		lb.stats = new(expvar.Map).Init()
+	}
+
+	pool, _ := lb.NewPool(DefaultPool, lb.poolOptions...)
+	if len(lb.backends) > 0 {
+		pool.SyncBackends("static", lb.backends)
+	}
+	return lb
+}
+
+// NewPool 创建一个名为 name 的后端池，请求通过 WithUpstream 指定使用它
+func (lb *LoadBalancer) NewPool(name string, opts ...PoolOption) (*ServerPool, error) {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	if _, ok := lb.pools[name]; ok {
+		return nil, fmt.Errorf("upstream %q already exists", name)
+	}
+	pool := NewServerPool(name, append([]PoolOption{WithPoolStats(lb.stats)}, opts...)...)
+	pool.newBackend = lb.httpBackendFactory(pool)
+	lb.pools[name] = pool
+	return pool, nil
+}
+
+// Pool 返回名为 name 的后端池，不存在时返回 nil
+func (lb *LoadBalancer) Pool(name string) *ServerPool {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	return lb.pools[name]
+}
+
+// Pools 返回所有后端池
+func (lb *LoadBalancer) Pools() map[string]*ServerPool {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	pools := make(map[string]*ServerPool, len(lb.pools))
+	for name, pool := range lb.pools {
+		pools[name] = pool
+	}
+	return pools
+}
+
+// RunHealthCheck 定期检测所有后端池，直到 ctx 结束，需要额外开启一个goroutine去执行此方法
+func (lb *LoadBalancer) RunHealthCheck(ctx context.Context) {
+	t := time.NewTicker(lb.healthCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			log.Println("Starting health check...")
+			for _, pool := range lb.Pools() {
+				pool.HealthCheck()
+			}
+			log.Println("Health check completed")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ServeHTTP 对接收到的请求进行负载均衡
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 限制重试次数
+	attempts := GetAttemptsFromContext(r)
+	if attempts > lb.maxAttempts {
+		log.Printf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
+		http.Error(w, "Service not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	pool := lb.Pool(GetUpstreamFromContext(r))
+	if pool == nil {
+		log.Printf("%s(%s) unknown upstream %q\n", r.RemoteAddr, r.URL.Path, GetUpstreamFromContext(r))
+		http.Error(w, "服务不可用", http.StatusServiceUnavailable)
+		return
+	}
+	peer, err := pool.AcquirePeer(r.Context())
+	log.Println("下一个peer ", peer)
+	trace := getTrace(r)
+	if peer != nil {
+		if trace != nil && trace.Acquired.IsZero() {
+			trace.Acquired = time.Now()
+		}
+		// 只对冲第一次尝试的只读请求，重试时不再对冲
+		if h := getHedger(r); h != nil && attempts == 1 && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			lb.serveHedged(w, r, pool, peer, h)
+			return
+		}
+		// ReverseProxy 在复制响应体失败时会以 http.ErrAbortHandler panic，名额必须在 defer 中释放
+		lease := &peerLease{pool: pool, peer: peer}
+		defer lease.release()
+		peer.ReverseProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), leaseKey, lease)))
+		return
+	}
+	if err != ErrNoBackend {
+		// 所有后端都达到连接上限，排队失败或者超时
+		log.Printf("%s(%s) %s\n", r.RemoteAddr, r.URL.Path, err.Error())
+		// 重试时排队失败的请求已经到达过后端，后端的失败仍然有效
+		if trace != nil && trace.Acquired.IsZero() {
+			trace.Shed = true
+		}
+	}
+	http.Error(w, "服务不可用", http.StatusServiceUnavailable)
+}
+
+// httpBackendFactory 返回 pool 用来创建 HTTP 后端以及转发请求的 ReverseProxy 的函数
+func (lb *LoadBalancer) httpBackendFactory(pool *ServerPool) func(spec *BackendSpec) *Backend {
+	return func(spec *BackendSpec) *Backend {
+		serverURL := spec.URL
+
+		proxy := httputil.NewSingleHostReverseProxy(serverURL)
+		proxy.Transport = pool.Transport()
+		//在处理当前请求时，如果发现当前的后端没有响应，就把它标记为已宕机,
+		//在发生错误时，ReverseProxy 会触发 ErrorHandler 回调函数，我们可以利用它来检查故障
+		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
+			log.Printf("[%s] %s\n", serverURL.Host, e.Error())
+			// 客户端断开或者对冲请求被取消，不是后端的问题，不重试也不标记宕机
+			if request.Context().Err() != nil {
+				return
+			}
+			// 请求体超过 MaxBodyHandler 的限制，同样不是后端的问题
+			if errors.Is(e, ErrBodyTooLarge) {
+				http.Error(writer, "Request entity too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			// 从context中获取重试次数
+			retries := GetRetryFromContext(request)
+			if retries < lb.maxRetries {
+				select {
+				case <-time.After(lb.retryDelay):
+					ctx := context.WithValue(request.Context(), retryKey, retries+1)
+					proxy.ServeHTTP(writer, request.WithContext(ctx))
+				}
+				return
+			}
+
+			// 多次重试后该服务设置为宕机
+			pool.MarkBackendStatus(serverURL, false)
+
+			// 同一个请求在尝试了几次后仍然失败，增加计数
+			attempts := GetAttemptsFromContext(request)
+			log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
+			ctx := context.WithValue(request.Context(), attemptsKey, attempts+1)
+			// 换后端之前释放当前后端的名额，不要在等待新后端时一直占用它
+			releaseLease(request)
+			// 通过lb选择一个新的后端来处理请求
+			lb.ServeHTTP(writer, request.WithContext(ctx))
+		}
+
+		b := NewBackend(spec)
+		b.ReverseProxy = proxy
+		return b
+	}
+}
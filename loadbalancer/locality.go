@@ -0,0 +1,96 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// 后端按离负载均衡器的远近分为三个层级
+const (
+	tierZone = iota
+	tierRegion
+	tierRemote
+)
+
+// tierNames 层级名称，用于日志和指标
+var tierNames = []string{"zone", "region", "remote"}
+
+// Locality 负载均衡器所在的位置
+type Locality struct {
+	// Zone 负载均衡器所在的可用区
+	Zone string `mapstructure:"zone"`
+	// Region 负载均衡器所在的地域
+	Region string `mapstructure:"region"`
+	// Threshold 已使用层级中可用后端的比例低于这个值时扩大到下一个层级，0 表示没有可用后端时才扩大
+	Threshold float64 `mapstructure:"threshold"`
+}
+
+// Validate 检查配置
+func (l Locality) Validate() error {
+	if l.Threshold < 0 || l.Threshold > 1 {
+		return fmt.Errorf("locality: threshold must be between 0 and 1")
+	}
+	return nil
+}
+
+// enabled 是否配置了负载均衡器的位置
+func (l Locality) enabled() bool {
+	return l.Zone != "" || l.Region != ""
+}
+
+// tier 返回后端所在的层级，没有配置位置时所有后端都在同一个层级
+func (l Locality) tier(b *Backend) int {
+	switch {
+	case !l.enabled():
+		return tierZone
+	case l.Zone != "" && b.Zone == l.Zone:
+		return tierZone
+	case l.Region != "" && b.Region == l.Region:
+		return tierRegion
+	default:
+		return tierRemote
+	}
+}
+
+// localityTier 返回这次选择可以使用的最远层级
+// 从同一个可用区开始逐级加入更远的层级，直到已加入层级中可用后端的比例达到阈值。
+// 更近的层级恢复后自动收回，层级变化时记录日志和指标
+func (s *ServerPool) localityTier(backends []*Backend, withBackup bool) int {
+	if !s.locality.enabled() {
+		return tierRemote
+	}
+	var total, available [tierRemote + 1]int
+	for _, b := range backends {
+		if b.Backup && !withBackup {
+			continue
+		}
+		t := s.locality.tier(b)
+		total[t]++
+		if b.IsAlive() && !b.Saturated() {
+			available[t]++
+		}
+	}
+
+	maxTier := tierRemote
+	sumTotal, sumAvailable := 0, 0
+	for t := tierZone; t <= tierRemote; t++ {
+		sumTotal += total[t]
+		sumAvailable += available[t]
+		if sumAvailable > 0 && float64(sumAvailable) >= s.locality.Threshold*float64(sumTotal) {
+			maxTier = t
+			break
+		}
+	}
+
+	prev := int(atomic.SwapInt32(&s.spillTier, int32(maxTier)))
+	switch {
+	case maxTier > prev:
+		log.Printf("%s: not enough %s servers available, spilling over to %s\n", s.name, tierNames[prev], tierNames[maxTier])
+		s.localityStats.Add(s.name+".spillovers", 1)
+	case maxTier < prev:
+		log.Printf("%s: %s servers recovered, stop spilling over to %s\n", s.name, tierNames[maxTier], tierNames[prev])
+		s.localityStats.Add(s.name+".recoveries", 1)
+	}
+	return maxTier
+}
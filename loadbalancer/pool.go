@@ -0,0 +1,380 @@
+package loadbalancer
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServerPool 要一种方式来跟踪所有后端，以及一个计算器变量
+type ServerPool struct {
+	// name 后端池名称，用于日志和指标
+	name     string
+	stats    *expvar.Map
+	backends []*Backend
+	current  uint64
+	// 服务发现会在运行时增删后端，修改时整体替换 backends，读取时先取快照，正在处理的请求不受影响
+	mux sync.RWMutex
+	// 服务发现添加后端时用来创建 Backend
+	newBackend func(spec *BackendSpec) *Backend
+	// 每个来源(静态配置、服务发现)提供的后端，按 URL 索引
+	sources map[string]map[string]*BackendSpec
+	// 所有后端都达到连接上限时请求排队的队列，为 nil 时不排队
+	queue        *requestQueue
+	queueSize    int
+	queueTimeout time.Duration
+	// backupThreshold 可用主后端占全部主后端的比例低于这个值时启用备用后端，0 表示主后端全部不可用时才启用
+	backupThreshold float64
+	// failedOver 当前是否在使用备用后端，使用原子操作读写
+	failedOver int32
+	// locality 负载均衡器所在的位置，为零值时不按位置选择后端
+	locality Locality
+	// spillTier 当前可以使用的最远层级，使用原子操作读写
+	spillTier int32
+	// 备用后端和就近选择的指标
+	failoverStats *expvar.Map
+	localityStats *expvar.Map
+	// transport 转发请求使用的连接池，后端池中的所有后端共用
+	transportCfg TransportConfig
+	transport    http.RoundTripper
+	// healthTransport 健康检测使用的 RoundTripper，和 transport 共用连接池和凭据，但是不计入连接复用的指标
+	healthTransport http.RoundTripper
+	// headers 注入到转发请求和健康检测请求中的请求头
+	headers HeaderSource
+	// healthPath 健康检测请求的路径，为空时只检测能否建立 TCP 连接
+	healthPath string
+	// serving 是否已经开始为请求选择后端，之后加入的后端需要慢启动，使用原子操作读写
+	serving int32
+}
+
+// PoolOption ServerPool 的可选配置
+type PoolOption func(s *ServerPool)
+
+// WithQueue 所有后端都达到连接上限时请求排队等待，最多 size 个请求，等待超过 timeout 返回 ErrQueueTimeout
+// size 为 0 时不排队，直接返回 ErrQueueFull
+func WithQueue(size int, timeout time.Duration) PoolOption {
+	return func(s *ServerPool) {
+		s.queueSize = size
+		s.queueTimeout = timeout
+	}
+}
+
+// WithBackupThreshold 可用主后端占全部主后端的比例低于 threshold 时启用备用后端
+func WithBackupThreshold(threshold float64) PoolOption {
+	return func(s *ServerPool) {
+		s.backupThreshold = threshold
+	}
+}
+
+// WithLocality 设置负载均衡器所在的位置，优先选择同一个可用区、地域的后端
+func WithLocality(l Locality) PoolOption {
+	return func(s *ServerPool) {
+		s.locality = l
+	}
+}
+
+// WithTransport 设置转发请求使用的连接配置，为 0 的字段使用 DefaultTransportConfig 中的值
+func WithTransport(cfg TransportConfig) PoolOption {
+	return func(s *ServerPool) {
+		s.transportCfg = cfg
+	}
+}
+
+// WithHeaders 向后端池转发的每个请求注入 headers 返回的请求头，客户端发送的同名请求头会被删除
+// 健康检测和通过 Transport() 发送的请求同样会注入
+func WithHeaders(headers HeaderSource) PoolOption {
+	return func(s *ServerPool) {
+		s.headers = headers
+	}
+}
+
+// WithHealthCheckPath 健康检测时向后端发送 GET path 请求，响应状态码为 2xx 或 3xx 时认为可用
+func WithHealthCheckPath(path string) PoolOption {
+	return func(s *ServerPool) {
+		s.healthPath = path
+	}
+}
+
+// WithBackendFactory 设置服务发现和 SyncBackends 创建后端使用的函数，默认为 NewBackend
+func WithBackendFactory(newBackend func(spec *BackendSpec) *Backend) PoolOption {
+	return func(s *ServerPool) {
+		s.newBackend = newBackend
+	}
+}
+
+// WithPoolStats 把等待队列、备用后端和就近选择的指标放在 stats 中，不设置时指标不会导出
+// 多个后端池可以共用一个 stats，指标按后端池名称区分
+func WithPoolStats(stats *expvar.Map) PoolOption {
+	return func(s *ServerPool) {
+		s.stats = stats
+	}
+}
+
+// NewServerPool 创建名为 name 的后端池
+func NewServerPool(name string, opts ...PoolOption) *ServerPool {
+	s := &ServerPool{name: name, newBackend: NewBackend}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.stats == nil {
+		s.stats = new(expvar.Map).Init()
+	}
+	s.failoverStats = statsMap(s.stats, "failover")
+	s.localityStats = statsMap(s.stats, "locality")
+	base := s.transportCfg.newTransport()
+	s.transport = newCountingTransport(base, statsMap(s.stats, "transport"), s.name)
+	s.healthTransport = base
+	if s.headers != nil {
+		s.transport = &headerTransport{RoundTripper: s.transport, headers: s.headers}
+		s.healthTransport = &headerTransport{RoundTripper: base, headers: s.headers}
+	}
+	if s.queueSize > 0 {
+		if s.queueTimeout <= 0 {
+			s.queueTimeout = 5 * time.Second
+		}
+		s.queue = newRequestQueue(statsMap(s.stats, "queue"), s.name, s.queueSize, s.queueTimeout)
+	}
+	return s
+}
+
+// Name 返回后端池名称
+func (s *ServerPool) Name() string {
+	return s.name
+}
+
+// Transport 返回后端池转发请求使用的 RoundTripper，向后端发送其他请求(例如流量镜像)时也应该使用它
+func (s *ServerPool) Transport() http.RoundTripper {
+	return s.transport
+}
+
+// Backends 返回当前的后端列表，返回的 slice 不能修改
+func (s *ServerPool) Backends() []*Backend {
+	return s.snapshot()
+}
+
+// NextIndex 因为有很多客户端连接到负载均衡器，所以发生竟态条件是不可避免的。
+// 为了防止这种情况，我们需要使用 mutex 给 ServerPool 加锁。但这样做对性能会有影响，更何况我们并不是真想要给 ServerPool 加锁，我们只是想要更新计数器。
+// 最理想的解决方案是使用原子操作，Go 语言的 atomic 包为此提供了很好的支持
+func (s *ServerPool) NextIndex() int {
+	return s.nextIndex(len(s.snapshot()))
+}
+
+// nextIndex 在长度为 n 的后端列表中计算下一个索引
+func (s *ServerPool) nextIndex(n int) int {
+	// 通过原子操作递增 current 的值，并通过对 slice 的长度取模来获得当前索引值。所以，返回值总是介于 0 和 slice 的长度之间，毕竟我们想要的是索引值，而不是总的计数值
+	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(n))
+}
+
+// snapshot 返回当前的后端列表，返回的 slice 不会被修改
+func (s *ServerPool) snapshot() []*Backend {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.backends
+}
+
+// GetNextPeer 获取下一个可用服务器
+// 主后端的可用容量足够时只使用主后端，否则备用后端也参与负载均衡。
+// 配置了 locality 时优先使用同一个可用区的后端，本地容量不足时再逐级扩大到同一个地域和其他地域
+func (s *ServerPool) GetNextPeer() *Backend {
+	return s.GetNextPeerExcluding(nil)
+}
+
+// GetNextPeerExcluding 和 GetNextPeer 相同，但是不选择 exclude，用于把同一个请求发给另一个后端
+func (s *ServerPool) GetNextPeerExcluding(exclude *Backend) *Backend {
+	if atomic.LoadInt32(&s.serving) == 0 {
+		atomic.StoreInt32(&s.serving, 1)
+	}
+	backends := s.snapshot()
+	// 服务发现可能还没有返回任何后端
+	if len(backends) == 0 {
+		return nil
+	}
+	withBackup := !s.primaryAvailable(backends)
+	maxTier := s.localityTier(backends, withBackup)
+	peer := s.nextPeer(backends, func(b *Backend) bool {
+		return b != exclude && (withBackup || !b.Backup) && s.locality.tier(b) <= maxTier
+	})
+	if peer != nil {
+		if peer.Backup {
+			s.failoverStats.Add(s.name+".backup_picks", 1)
+		}
+		if s.locality.enabled() {
+			s.localityStats.Add(s.name+".picks."+tierNames[s.locality.tier(peer)], 1)
+		}
+	}
+	return peer
+}
+
+// nextPeer 从 next 开始轮询，找到 allow 允许的可用后端
+func (s *ServerPool) nextPeer(backends []*Backend, allow func(b *Backend) bool) *Backend {
+	// 遍历后端列表，找到可用服务器
+	next := s.nextIndex(len(backends))
+	// log.Println("next ", next)
+	// 从next开始遍历
+	l := len(backends) + next
+	// log.Println("l ", l)
+	for i := next; i < l; i++ {
+		// 通过取模运算获取索引
+		idx := i % len(backends)
+		// log.Println("idx ", idx)
+		b := backends[idx]
+		//如果找到一个可用并且没有达到连接上限的服务器
+		if !allow(b) || !b.IsAlive() || b.Saturated() {
+			continue
+		}
+		if !admit(b) {
+			// 慢启动的后端让出的请求按有效权重分给其他后端，如果交给环上的下一个后端，
+			// 它会承担慢启动后端的全部份额；没有其他后端时仍然使用这个后端
+			if peer := weightedPeer(backends, func(c *Backend) bool { return c != b && allow(c) }); peer != nil {
+				return peer
+			}
+			return b
+		}
+		if i != next {
+			// 标记当前可用服务器
+			atomic.StoreUint64(&s.current, uint64(idx))
+		}
+		return b
+	}
+	return nil
+}
+
+// AcquirePeer 获取一个后端并占用它的一个连接名额，使用完后需要调用 ReleasePeer 释放
+// 所有可用后端都达到连接上限时，请求进入等待队列，直到有后端释放连接或者等待超时
+func (s *ServerPool) AcquirePeer(ctx context.Context) (*Backend, error) {
+	for {
+		peer := s.GetNextPeer()
+		if peer == nil {
+			break
+		}
+		// 其他请求可能刚好占用了最后一个名额，重新选择
+		if peer.tryAcquire() {
+			return peer, nil
+		}
+	}
+
+	if !s.hasAlive() {
+		return nil, ErrNoBackend
+	}
+	if s.queue == nil {
+		return nil, ErrQueueFull
+	}
+	return s.queue.wait(ctx)
+}
+
+// TryAcquirePeerExcluding 获取 exclude 以外的一个后端并占用它的一个连接名额，没有空闲的后端时返回 nil，不排队
+func (s *ServerPool) TryAcquirePeerExcluding(exclude *Backend) *Backend {
+	for {
+		peer := s.GetNextPeerExcluding(exclude)
+		if peer == nil || peer.tryAcquire() {
+			return peer
+		}
+	}
+}
+
+// ReleasePeer 释放后端的连接名额，有请求在排队时直接交给队头的请求
+func (s *ServerPool) ReleasePeer(peer *Backend) {
+	if s.queue != nil && peer.IsAlive() && s.queue.handoff(peer) {
+		return
+	}
+	atomic.AddInt64(&peer.active, -1)
+}
+
+// peerLease 请求占用的一个后端名额，保证只释放一次
+// 转发出错换后端时由 ErrorHandler 提前释放，处理结束或者 panic 时由 defer 释放
+type peerLease struct {
+	pool *ServerPool
+	peer *Backend
+	once sync.Once
+}
+
+func (l *peerLease) release() {
+	l.once.Do(func() { l.pool.ReleasePeer(l.peer) })
+}
+
+// releaseLease 释放请求占用的后端名额，请求没有占用名额时什么也不做
+func releaseLease(r *http.Request) {
+	if l, ok := r.Context().Value(leaseKey).(*peerLease); ok {
+		l.release()
+	}
+}
+
+// hasAlive 是否还有可用的后端
+func (s *ServerPool) hasAlive() bool {
+	for _, b := range s.snapshot() {
+		if b.IsAlive() {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats 返回每个后端的状态，用于导出指标
+func (s *ServerPool) Stats() interface{} {
+	snapshot := s.snapshot()
+	backends := make(map[string]interface{}, len(snapshot))
+	for _, b := range snapshot {
+		backends[b.URL.String()] = map[string]interface{}{
+			"alive":        b.IsAlive(),
+			"active_conns": b.ActiveConns(),
+			"max_conns":    b.MaxConns,
+			"weight":       b.WeightFactor(),
+			"backup":       b.Backup,
+			"zone":         b.Zone,
+			"region":       b.Region,
+		}
+	}
+	return backends
+}
+
+// HealthCheck 被动模式，遍历所有服务并并标记可用状态
+func (s *ServerPool) HealthCheck() {
+	for _, b := range s.snapshot() {
+		status := "up"
+
+		alive := s.isAlive(b.URL)
+
+		b.SetAlive(alive)
+		if !alive {
+			status = "down"
+		}
+
+		log.Printf("%s[%s]\n", b.URL, status)
+	}
+}
+
+// AddBackend 添加服务到ServerPool
+func (s *ServerPool) AddBackend(backend *Backend) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.markJoined(backend)
+	// 复制一份再追加，不影响正在使用旧快照的请求
+	backends := make([]*Backend, len(s.backends), len(s.backends)+1)
+	copy(backends, s.backends)
+	s.backends = append(backends, backend)
+}
+
+// MarkBackendStatus 标记服务状态
+func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
+	for _, b := range s.snapshot() {
+		if b.URL.String() == backendUrl.String() {
+			b.SetAlive(alive)
+			break
+		}
+	}
+}
+
+// statsMap 返回 parent 中名为 name 的一组指标，不存在时创建
+func statsMap(parent *expvar.Map, name string) *expvar.Map {
+	if m, ok := parent.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	parent.Set(name, m)
+	return m
+}
@@ -0,0 +1,124 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoBackend 没有可用的后端
+	ErrNoBackend = errors.New("no backend available")
+	// ErrQueueFull 所有后端都达到连接上限，并且等待队列已满
+	ErrQueueFull = errors.New("request queue is full")
+	// ErrQueueTimeout 在等待队列中超时
+	ErrQueueTimeout = errors.New("request queue timeout")
+)
+
+// requestQueue 所有后端都达到连接上限时，请求在这里按先进先出的顺序等待
+// 后端释放连接时直接把连接名额交给队头的请求，保证先来的请求先被处理
+type requestQueue struct {
+	size    int
+	timeout time.Duration
+
+	mux     sync.Mutex
+	waiters *list.List
+
+	queued   *expvar.Int
+	timeouts *expvar.Int
+	rejected *expvar.Int
+	// waitTime 累计等待时间(毫秒)，除以 queued 即为平均等待时间
+	waitTime *expvar.Int
+}
+
+// newRequestQueue 创建等待队列，指标以 name 为名称放在 stats 中
+func newRequestQueue(stats *expvar.Map, name string, size int, timeout time.Duration) *requestQueue {
+	q := &requestQueue{
+		size:     size,
+		timeout:  timeout,
+		waiters:  list.New(),
+		queued:   new(expvar.Int),
+		timeouts: new(expvar.Int),
+		rejected: new(expvar.Int),
+		waitTime: new(expvar.Int),
+	}
+	m := new(expvar.Map).Init()
+	m.Set("depth", expvar.Func(func() interface{} { return q.len() }))
+	m.Set("queued", q.queued)
+	m.Set("timeouts", q.timeouts)
+	m.Set("rejected", q.rejected)
+	m.Set("wait_ms_total", q.waitTime)
+	stats.Set(name, m)
+	return q
+}
+
+func (q *requestQueue) len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.waiters.Len()
+}
+
+// wait 排队等待其他请求释放连接，返回交接过来的后端，名额已经被占用
+func (q *requestQueue) wait(ctx context.Context) (*Backend, error) {
+	ch := make(chan *Backend, 1)
+
+	q.mux.Lock()
+	if q.waiters.Len() >= q.size {
+		q.mux.Unlock()
+		q.rejected.Add(1)
+		return nil, ErrQueueFull
+	}
+	e := q.waiters.PushBack(ch)
+	q.mux.Unlock()
+
+	q.queued.Add(1)
+	start := time.Now()
+	defer func() {
+		q.waitTime.Add(int64(time.Since(start) / time.Millisecond))
+	}()
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case peer := <-ch:
+		return peer, nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mux.Lock()
+	// 超时的同时可能刚好有后端把名额交给了我们，这时已经不在队列里了
+	for el := q.waiters.Front(); el != nil; el = el.Next() {
+		if el == e {
+			q.waiters.Remove(e)
+			q.mux.Unlock()
+			if err == ErrQueueTimeout {
+				q.timeouts.Add(1)
+			}
+			return nil, err
+		}
+	}
+	q.mux.Unlock()
+	// 名额已经交接，直接使用
+	return <-ch, nil
+}
+
+// handoff 把 peer 的连接名额交给队头的请求，队列为空时返回 false
+func (q *requestQueue) handoff(peer *Backend) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	e := q.waiters.Front()
+	if e == nil {
+		return false
+	}
+	q.waiters.Remove(e)
+	e.Value.(chan *Backend) <- peer
+	return true
+}
@@ -0,0 +1,75 @@
+package loadbalancer
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// slowStartMinFactor 慢启动开始时的有效权重比例
+const slowStartMinFactor = 0.1
+
+// WeightFactor 返回后端的有效权重比例，慢启动期间从 slowStartMinFactor 随时间线性增加到 1
+func (b *Backend) WeightFactor() float64 {
+	if b.SlowStart <= 0 {
+		return 1
+	}
+	b.mux.RLock()
+	since := b.upSince
+	b.mux.RUnlock()
+	if since.IsZero() {
+		return 1
+	}
+	elapsed := time.Since(since)
+	if elapsed >= b.SlowStart {
+		return 1
+	}
+	return slowStartMinFactor + (1-slowStartMinFactor)*float64(elapsed)/float64(b.SlowStart)
+}
+
+// admit 负载均衡策略选出候选后端后由 admit 决定是否接受，慢启动期间按有效权重的比例接受，
+// 没有接受的请求由 weightedPeer 按有效权重分给其他后端。慢启动不依赖具体的选择算法，所有策略都通过它过滤候选后端
+func admit(b *Backend) bool {
+	f := b.WeightFactor()
+	return f >= 1 || rand.Float64() < f
+}
+
+// markJoined 后端加入后端池时调用，后端池开始处理请求之前加入的后端(启动时的配置和第一次服务发现)
+// 直接使用完整权重，之后加入的后端需要慢启动
+func (s *ServerPool) markJoined(b *Backend) {
+	if atomic.LoadInt32(&s.serving) == 0 {
+		return
+	}
+	b.mux.Lock()
+	b.upSince = time.Now()
+	b.mux.Unlock()
+}
+
+// weightedPeer 按有效权重从 allow 允许的可用后端中随机选择一个，没有时返回 nil
+func weightedPeer(backends []*Backend, allow func(b *Backend) bool) *Backend {
+	factors := make([]float64, len(backends))
+	total := 0.0
+	for i, b := range backends {
+		if allow(b) && b.IsAlive() && !b.Saturated() {
+			factors[i] = b.WeightFactor()
+			total += factors[i]
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	point := rand.Float64() * total
+	last := -1
+	for i, f := range factors {
+		if f == 0 {
+			continue
+		}
+		if point < f {
+			return backends[i]
+		}
+		point -= f
+		last = i
+	}
+	// 浮点误差，落到最后一个候选后端
+	return backends[last]
+}
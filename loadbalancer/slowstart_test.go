@@ -0,0 +1,155 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWeightFactor(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		slowStart time.Duration
+		upSince   time.Time
+		want      float64
+	}{
+		{name: "disabled", upSince: now, want: 1},
+		{name: "never restarted", slowStart: time.Minute, want: 1},
+		{name: "just joined", slowStart: time.Minute, upSince: now, want: slowStartMinFactor},
+		{name: "halfway", slowStart: time.Minute, upSince: now.Add(-30 * time.Second), want: 0.55},
+		{name: "finished", slowStart: time.Minute, upSince: now.Add(-2 * time.Minute), want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Backend{SlowStart: tt.slowStart, upSince: tt.upSince}
+			if got := b.WeightFactor(); math.Abs(got-tt.want) > 0.01 {
+				t.Errorf("WeightFactor = %.3f, want %.3f", got, tt.want)
+			}
+		})
+	}
+}
+
+// newSlowStartPool 创建 n 个后端的后端池，第一个后端刚刚加入，处于慢启动中
+func newSlowStartPool(n int) *ServerPool {
+	pool := NewServerPool("slowstart")
+	for i := 0; i < n; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://10.0.0.%d:80", i+1))
+		b := &Backend{URL: u, Alive: true, SlowStart: time.Hour}
+		if i == 0 {
+			b.upSince = time.Now()
+		}
+		pool.AddBackend(b)
+	}
+	return pool
+}
+
+// 慢启动后端让出的请求平均分给其他后端，而不是都交给环上的下一个后端
+func TestNextPeerSpreadsSlowStartShare(t *testing.T) {
+	const n, picks = 4, 40000
+	pool := newSlowStartPool(n)
+	counts := make(map[string]int)
+	for i := 0; i < picks; i++ {
+		counts[pool.GetNextPeer().URL.Host]++
+	}
+
+	warming := float64(counts["10.0.0.1:80"]) / picks
+	if warming > 0.05 {
+		t.Errorf("warming backend got %.1f%% of requests, want about %.1f%%", warming*100, 100.0/n*slowStartMinFactor)
+	}
+	// 其余三个后端各占约 (1 - 2.5%) / 3
+	for i := 2; i <= n; i++ {
+		share := float64(counts[fmt.Sprintf("10.0.0.%d:80", i)]) / picks
+		if math.Abs(share-(1-warming)/(n-1)) > 0.02 {
+			t.Errorf("backend %d got %.1f%% of requests, want an even share of %.1f%%", i, share*100, (1-warming)/(n-1)*100)
+		}
+	}
+}
+
+// weightedPeer 按有效权重选择，不选择不可用和 allow 排除的后端
+func TestWeightedPeer(t *testing.T) {
+	const picks = 42000
+	now := time.Now()
+	backends := make([]*Backend, 5)
+	for i := range backends {
+		u, _ := url.Parse(fmt.Sprintf("http://10.0.0.%d:80", i+1))
+		backends[i] = &Backend{URL: u, Alive: true, SlowStart: time.Hour}
+	}
+	backends[2].upSince = now
+	backends[3].Alive = false
+	excluded := backends[4]
+
+	counts := make([]int, len(backends))
+	for i := 0; i < picks; i++ {
+		b := weightedPeer(backends, func(b *Backend) bool { return b != excluded })
+		for j := range backends {
+			if backends[j] == b {
+				counts[j]++
+			}
+		}
+	}
+	// 有效权重为 1、1、0.1，总和 2.1
+	want := []float64{1 / 2.1, 1 / 2.1, 0.1 / 2.1, 0, 0}
+	for i, w := range want {
+		if share := float64(counts[i]) / picks; math.Abs(share-w) > 0.015 {
+			t.Errorf("backend %d got %.1f%% of picks, want %.1f%%", i+1, share*100, w*100)
+		}
+	}
+
+	if b := weightedPeer(backends, func(b *Backend) bool { return false }); b != nil {
+		t.Errorf("weightedPeer = %s with no candidates, want nil", b.URL)
+	}
+}
+
+// 只有慢启动的后端可用时仍然使用它
+func TestNextPeerSlowStartOnlyBackend(t *testing.T) {
+	pool := newSlowStartPool(1)
+	for i := 0; i < 100; i++ {
+		if pool.GetNextPeer() == nil {
+			t.Fatal("no peer selected while the only backend is warming up")
+		}
+	}
+}
+
+// 后端池开始处理请求之前加入的后端直接使用完整权重，之后加入的后端需要慢启动
+func TestBackendJoinedAfterServingSlowStarts(t *testing.T) {
+	spec := func(host string) *BackendSpec {
+		u, _ := url.Parse("http://" + host)
+		return &BackendSpec{URL: u, SlowStart: time.Hour}
+	}
+	pool := NewServerPool("joined", WithBackendFactory(NewBackend))
+	pool.SyncBackends("discovery", []*BackendSpec{spec("10.0.0.1:80")})
+	static := NewBackend(spec("10.0.0.2:80"))
+	pool.AddBackend(static)
+	for _, b := range pool.Backends() {
+		if f := b.WeightFactor(); f != 1 {
+			t.Errorf("%s joined before serving: WeightFactor = %.2f, want 1", b.URL.Host, f)
+		}
+	}
+
+	pool.GetNextPeer()
+	pool.SyncBackends("discovery", []*BackendSpec{spec("10.0.0.1:80"), spec("10.0.0.3:80")})
+	added := NewBackend(spec("10.0.0.4:80"))
+	pool.AddBackend(added)
+	for _, b := range pool.Backends() {
+		joinedLate := b.URL.Host == "10.0.0.3:80" || b.URL.Host == "10.0.0.4:80"
+		if f := b.WeightFactor(); joinedLate != (f < 1) {
+			t.Errorf("%s: WeightFactor = %.2f, joined after serving = %v", b.URL.Host, f, joinedLate)
+		}
+	}
+}
+
+// 第一次服务发现的结果在后端池已经开始处理请求之后才到达时，也需要慢启动
+func TestFirstDiscoveryAfterServingSlowStarts(t *testing.T) {
+	pool := NewServerPool("late", WithBackendFactory(NewBackend))
+	if pool.GetNextPeer() != nil {
+		t.Fatal("empty pool returned a peer")
+	}
+	u, _ := url.Parse("http://10.0.0.1:80")
+	pool.SyncBackends("discovery", []*BackendSpec{{URL: u, SlowStart: time.Hour}})
+	if f := pool.Backends()[0].WeightFactor(); f >= 1 {
+		t.Errorf("WeightFactor = %.2f, want slow start for a backend discovered after serving began", f)
+	}
+}
@@ -0,0 +1,83 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackendSpec proxy_pass 中一个后端的配置
+// 格式为 "<url> [key=value ...]"，和 nginx 的 upstream server 指令类似，例如
+// "http://127.0.0.1:6000 max_conns=200"
+type BackendSpec struct {
+	URL *url.URL
+	// MaxConns 最大并发请求数，0 表示不限制
+	MaxConns int
+	// SlowStart 慢启动时间，例如 "slow_start=30s"
+	SlowStart time.Duration
+	// Backup 备用后端，写作 "backup"，不带值
+	Backup bool
+	// Zone、Region 后端所在的可用区和地域，例如 "zone=us-east-1a region=us-east-1"
+	Zone   string
+	Region string
+}
+
+// ParseBackendSpec 解析后端配置，defaults 提供未指定参数时的默认值
+func ParseBackendSpec(s string, defaults BackendSpec) (*BackendSpec, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty backend")
+	}
+	u, err := url.Parse(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("backend %q: missing host", fields[0])
+	}
+
+	spec := defaults
+	spec.URL = u
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		key, value := kv[0], ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch key {
+		case "max_conns":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("backend %q: invalid max_conns %q", fields[0], value)
+			}
+			spec.MaxConns = n
+		case "slow_start":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("backend %q: invalid slow_start %q", fields[0], value)
+			}
+			spec.SlowStart = d
+		case "backup":
+			if len(kv) == 2 {
+				return nil, fmt.Errorf("backend %q: backup does not take a value", fields[0])
+			}
+			spec.Backup = true
+		case "zone":
+			spec.Zone = value
+		case "region":
+			spec.Region = value
+		default:
+			return nil, fmt.Errorf("backend %q: unknown parameter %q", fields[0], key)
+		}
+	}
+	return &spec, nil
+}
+
+// equal 判断两个配置是否相同
+func (s *BackendSpec) equal(o *BackendSpec) bool {
+	a, b := *s, *o
+	a.URL, b.URL = nil, nil
+	return a == b && s.URL.String() == o.URL.String()
+}
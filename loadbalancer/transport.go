@@ -0,0 +1,153 @@
+package loadbalancer
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// TransportConfig 后端池转发请求使用的连接配置，为 0 的字段使用 DefaultTransportConfig 中的值
+type TransportConfig struct {
+	// DialTimeout 建立 TCP 连接的超时时间
+	DialTimeout time.Duration `mapstructure:"dial_timeout"`
+	// TLSHandshakeTimeout TLS 握手的超时时间
+	TLSHandshakeTimeout time.Duration `mapstructure:"tls_handshake_timeout"`
+	// ResponseHeaderTimeout 发送完请求后等待响应头的超时时间，避免卡住的后端一直占用客户端连接
+	ResponseHeaderTimeout time.Duration `mapstructure:"response_header_timeout"`
+	// IdleConnTimeout 空闲连接保留的时间
+	IdleConnTimeout time.Duration `mapstructure:"idle_conn_timeout"`
+	// MaxIdleConnsPerHost 每个后端保留的空闲连接数
+	MaxIdleConnsPerHost int `mapstructure:"max_idle_conns_per_host"`
+	// MaxConnsPerHost 每个后端的最大连接数，达到上限后请求等待空闲连接，0 表示不限制
+	MaxConnsPerHost int `mapstructure:"max_conns_per_host"`
+	// KeepAlive TCP keep-alive 探测的间隔，负数表示关闭
+	KeepAlive time.Duration `mapstructure:"keep_alive"`
+}
+
+// DefaultTransportConfig 默认的连接配置，和 http.DefaultTransport 相同，另外限制了等待响应头的时间，并保留更多的空闲连接
+var DefaultTransportConfig = TransportConfig{
+	DialTimeout:           30 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 60 * time.Second,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConnsPerHost:   32,
+	KeepAlive:             30 * time.Second,
+}
+
+// Inherit 返回 c 的副本，为 0 的字段使用 parent 中的值
+func (c TransportConfig) Inherit(parent TransportConfig) TransportConfig {
+	if c.DialTimeout == 0 {
+		c.DialTimeout = parent.DialTimeout
+	}
+	if c.TLSHandshakeTimeout == 0 {
+		c.TLSHandshakeTimeout = parent.TLSHandshakeTimeout
+	}
+	if c.ResponseHeaderTimeout == 0 {
+		c.ResponseHeaderTimeout = parent.ResponseHeaderTimeout
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = parent.IdleConnTimeout
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = parent.MaxIdleConnsPerHost
+	}
+	if c.MaxConnsPerHost == 0 {
+		c.MaxConnsPerHost = parent.MaxConnsPerHost
+	}
+	if c.KeepAlive == 0 {
+		c.KeepAlive = parent.KeepAlive
+	}
+	return c
+}
+
+// newTransport 按配置创建 http.Transport，后端池中的所有后端共用
+func (c TransportConfig) newTransport() *http.Transport {
+	c = c.Inherit(DefaultTransportConfig)
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: c.KeepAlive,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// countingTransport 统计请求使用的是复用的空闲连接还是新建的连接
+type countingTransport struct {
+	http.RoundTripper
+	reused  *expvar.Int
+	created *expvar.Int
+}
+
+// newCountingTransport 创建 countingTransport，指标放在 stats 中名为 name 的一组里
+func newCountingTransport(rt http.RoundTripper, stats *expvar.Map, name string) *countingTransport {
+	t := &countingTransport{
+		RoundTripper: rt,
+		reused:       new(expvar.Int),
+		created:      new(expvar.Int),
+	}
+	m := new(expvar.Map).Init()
+	m.Set("reused", t.reused)
+	m.Set("new", t.created)
+	// reuse_ratio 复用连接的请求占全部请求的比例，比例低说明空闲连接不够或者过早被关闭
+	m.Set("reuse_ratio", expvar.Func(func() interface{} {
+		reused, created := t.reused.Value(), t.created.Value()
+		if reused+created == 0 {
+			return 0.0
+		}
+		return float64(reused) / float64(reused+created)
+	}))
+	stats.Set(name, m)
+	return t
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.reused.Add(1)
+			} else {
+				t.created.Add(1)
+			}
+		},
+	}
+	return t.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// HeaderSource 返回需要注入到转发请求中的请求头，例如访问后端的凭据
+// 每次请求都会调用，返回值不能修改；值为空的请求头只删除客户端发送的同名请求头，不注入
+type HeaderSource func() http.Header
+
+// headerTransport 删除客户端发送的同名请求头，再注入 HeaderSource 返回的请求头
+type headerTransport struct {
+	http.RoundTripper
+	headers HeaderSource
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	headers := t.headers()
+	if len(headers) == 0 {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	// RoundTripper 不能修改传入的请求，复制一份再修改请求头
+	r := new(http.Request)
+	*r = *req
+	r.Header = req.Header.Clone()
+	for k, v := range headers {
+		r.Header.Del(k)
+		if len(v) > 0 && v[0] != "" {
+			r.Header[k] = v
+		}
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
@@ -0,0 +1,7 @@
+module simple_lb
+
+go 1.14
+
+require loadbalancer v0.0.0
+
+replace loadbalancer => ../loadbalancer
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"loadbalancer"
+	"simple_lb_2/config"
+)
+
+// AccessConfig [access] 基于客户端 IP 的访问控制
+type AccessConfig struct {
+	// Rules 全局规则，对所有请求生效，在路由的 access 规则之前检查
+	Rules []string `mapstructure:"rules"`
+	// TrustedProxies 受信任的代理网段，来自这些地址的请求从 RealIPHeader 中取真实的客户端 IP
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// RealIPHeader 保存客户端 IP 的请求头，默认为 X-Forwarded-For
+	RealIPHeader string `mapstructure:"real_ip_header"`
+}
+
+// accessRule 一条访问规则：allow 或 deny 一个网段
+type accessRule struct {
+	allow bool
+	// net 为 nil 时匹配所有地址
+	net *net.IPNet
+}
+
+// parseAccessRules 解析 "allow 10.0.0.0/8"、"deny 192.168.1.1"、"deny all" 形式的规则
+func parseAccessRules(rules []string) ([]accessRule, error) {
+	parsed := make([]accessRule, 0, len(rules))
+	for _, s := range rules {
+		fields := strings.Fields(s)
+		if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+			return nil, fmt.Errorf("invalid access rule %q, use allow <cidr> or deny <cidr>", s)
+		}
+		rule := accessRule{allow: fields[0] == "allow"}
+		if fields[1] != "all" {
+			nets, err := parseCIDRs(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid access rule %q: %s", s, err)
+			}
+			rule.net = nets[0]
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// allowed 按顺序检查规则，第一条匹配的规则决定结果，没有匹配的规则时允许访问
+func allowed(rules []accessRule, ip net.IP) bool {
+	for _, rule := range rules {
+		if rule.net == nil || (ip != nil && rule.net.Contains(ip)) {
+			return rule.allow
+		}
+	}
+	return true
+}
+
+// accessPolicy 编译后的访问控制配置，配置文件改变后整体替换
+type accessPolicy struct {
+	global  []accessRule
+	routes  map[string][]accessRule
+	trusted []*net.IPNet
+	header  string
+}
+
+// AccessControl 按客户端 IP 的 allow/deny 规则拒绝请求，被拒绝的请求返回 403
+type AccessControl struct {
+	policy atomic.Value
+}
+
+// accessStats 访问控制指标，denied 按规则所在的位置（global 或路由名称）统计拒绝的请求数
+var accessStats = newStatsMap("access")
+
+var (
+	accessAllowed = new(expvar.Int)
+	accessDenied  = new(expvar.Map).Init()
+)
+
+func init() {
+	accessStats.Set("allowed", accessAllowed)
+	accessStats.Set("denied", accessDenied)
+}
+
+// NewAccessControl 创建访问控制，routes 中的 access 为路由的规则
+func NewAccessControl(cfg AccessConfig, routes []*Route) (*AccessControl, error) {
+	policy, err := newAccessPolicy(cfg, routes)
+	if err != nil {
+		return nil, err
+	}
+	a := &AccessControl{}
+	a.policy.Store(policy)
+	return a, nil
+}
+
+func newAccessPolicy(cfg AccessConfig, routes []*Route) (*accessPolicy, error) {
+	p := &accessPolicy{routes: make(map[string][]accessRule), header: cfg.RealIPHeader}
+	if p.header == "" {
+		p.header = "X-Forwarded-For"
+	}
+	var err error
+	if p.global, err = parseAccessRules(cfg.Rules); err != nil {
+		return nil, fmt.Errorf("access: %s", err)
+	}
+	if p.trusted, err = parseCIDRs(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("access.trusted_proxies: %s", err)
+	}
+	for _, route := range routes {
+		if route == nil || len(route.Access) == 0 {
+			continue
+		}
+		rules, err := parseAccessRules(route.Access)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", route.Name, err)
+		}
+		p.routes[route.Name] = rules
+	}
+	return p, nil
+}
+
+// Reload 配置文件改变后重新读取规则，规则有误时继续使用原来的规则
+func (a *AccessControl) Reload() {
+	var cfg AccessConfig
+	if err := config.RuntimeViper.UnmarshalKey("access", &cfg); err != nil {
+		log.Printf("access: %s\n", err)
+		return
+	}
+	var routes []*Route
+	if err := config.RuntimeViper.UnmarshalKey("routes", &routes); err != nil {
+		log.Printf("access: %s\n", err)
+		return
+	}
+	policy, err := newAccessPolicy(cfg, routes)
+	if err != nil {
+		log.Printf("%s\n", err)
+		return
+	}
+	a.policy.Store(policy)
+	log.Printf("access: %d global rules, %d routes with rules\n", len(policy.global), len(policy.routes))
+}
+
+// Handler 解析真实的客户端 IP 保存到 context，然后检查全局规则和路由的规则，需要放在 RouteTable.Handler 之后
+// 之后的处理器从 context 中的 realClientIP 获取客户端 IP，不需要再解析一次
+func (a *AccessControl) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := a.policy.Load().(*accessPolicy)
+		ip := p.realIP(r)
+		if ip != nil {
+			r = r.WithContext(context.WithValue(r.Context(), realClientIP, ip.String()))
+		}
+		route := GetRouteFromContext(r)
+		routeRules := p.routes[route.Name]
+		if len(p.global) == 0 && len(routeRules) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		denied := ""
+		if !allowed(p.global, ip) {
+			denied = "global"
+		} else if !allowed(routeRules, ip) {
+			denied = route.Name
+		}
+		if denied != "" {
+			accessDenied.Add(denied, 1)
+			log.Printf("%s(%s) client %s denied by %s access rules\n", r.RemoteAddr, r.URL.Path, ip, denied)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		accessAllowed.Add(1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// realIP 返回真实的客户端 IP
+// 直接连接的地址属于受信任的代理时，从请求头中从右向左跳过受信任的代理，第一个不受信任的地址为客户端；
+// 客户端可以伪造请求头最左边的值，所以不能直接取第一个
+func (p *accessPolicy) realIP(r *http.Request) net.IP {
+	ip := net.ParseIP(peerIP(r))
+	if len(p.trusted) == 0 || !loadbalancer.IPInNets(ip, p.trusted) {
+		return ip
+	}
+	values := r.Header.Values(p.header)
+	var hops []string
+	for _, v := range values {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// 无法解析的值之前的内容都不可信
+			break
+		}
+		ip = hop
+		if !loadbalancer.IPInNets(hop, p.trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// peerIP 返回直接连接的对端 IP
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"loadbalancer"
+)
+
+// BodyLimiter 按路由限制请求体的大小，超过时返回 413
+type BodyLimiter struct {
+	global int64
+	// routes 设置了 max_body_bytes 的路由
+	routes map[string]int64
+}
+
+// NewBodyLimiter global 为 server.max_body_bytes，路由的 max_body_bytes 为 0 时使用 global，负数表示不限制
+func NewBodyLimiter(global int64, routes []*Route) *BodyLimiter {
+	l := &BodyLimiter{global: global, routes: make(map[string]int64)}
+	for _, route := range routes {
+		if route != nil && route.MaxBodyBytes != 0 {
+			l.routes[route.Name] = route.MaxBodyBytes
+		}
+	}
+	return l
+}
+
+// Handler 需要放在 RouteTable.Handler 之后，以及所有读取请求体的处理器之前
+func (l *BodyLimiter) Handler(next http.Handler) http.Handler {
+	global := loadbalancer.MaxBodyHandler(l.global, next)
+	handlers := make(map[string]http.Handler, len(l.routes))
+	for name, n := range l.routes {
+		handlers[name] = loadbalancer.MaxBodyHandler(n, next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := handlers[GetRouteFromContext(r).Name]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		global.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer"
+)
+
+// CacheConfig 响应缓存配置
+type CacheConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxBytes 缓存占用的最大字节数，超过后按 LRU 淘汰
+	MaxBytes int64 `mapstructure:"max_bytes"`
+	// MaxEntryBytes 单个响应的最大字节数，超过的响应不缓存
+	MaxEntryBytes int64 `mapstructure:"max_entry_bytes"`
+	// StaleIfError 后端不可用时，最多使用过期多久的缓存
+	StaleIfError time.Duration `mapstructure:"stale_if_error"`
+}
+
+// cacheEntry 一条缓存的响应
+type cacheEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	// 响应存入缓存的时间，以及上游返回的 Age
+	stored     time.Time
+	initialAge time.Duration
+	// 新鲜期，为 0 时每次使用都需要到上游验证
+	freshness time.Duration
+	// mustRevalidate 过期后不允许直接使用
+	mustRevalidate bool
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.key) + len(e.body))
+	for k, vs := range e.header {
+		n += int64(len(k))
+		for _, v := range vs {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// age 返回缓存的年龄
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.stored)
+}
+
+// fresh 缓存是否还在新鲜期内
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.age(now) < e.freshness
+}
+
+// hasValidator 是否可以向上游发送条件请求验证
+func (e *cacheEntry) hasValidator() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// ResponseCache 内存响应缓存，按 Cache-Control、Expires、Vary 等响应头决定是否缓存以及缓存多久
+// 缓存过期后带上 If-None-Match/If-Modified-Since 到上游验证，后端不可用时返回过期的缓存
+type ResponseCache struct {
+	cfg CacheConfig
+
+	mux     sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+	// vary 每个 URL 最近一次响应的 Vary 请求头，用来计算缓存 key
+	vary map[string][]string
+
+	hits        *expvar.Int
+	misses      *expvar.Int
+	revalidated *expvar.Int
+	stale       *expvar.Int
+	stores      *expvar.Int
+	evictions   *expvar.Int
+}
+
+// cacheStats 响应缓存指标
+var cacheStats = newStatsMap("cache")
+
+// NewResponseCache 创建响应缓存
+func NewResponseCache(cfg CacheConfig) *ResponseCache {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 64 << 20
+	}
+	if cfg.MaxEntryBytes <= 0 || cfg.MaxEntryBytes > cfg.MaxBytes {
+		cfg.MaxEntryBytes = 1 << 20
+	}
+	c := &ResponseCache{
+		cfg:         cfg,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		vary:        make(map[string][]string),
+		hits:        new(expvar.Int),
+		misses:      new(expvar.Int),
+		revalidated: new(expvar.Int),
+		stale:       new(expvar.Int),
+		stores:      new(expvar.Int),
+		evictions:   new(expvar.Int),
+	}
+	cacheStats.Set("hits", c.hits)
+	cacheStats.Set("misses", c.misses)
+	cacheStats.Set("revalidated", c.revalidated)
+	cacheStats.Set("stale_served", c.stale)
+	cacheStats.Set("stores", c.stores)
+	cacheStats.Set("evictions", c.evictions)
+	cacheStats.Set("entries", expvar.Func(func() interface{} {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		return c.lru.Len()
+	}))
+	cacheStats.Set("bytes", expvar.Func(func() interface{} {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		return c.bytes
+	}))
+	return c
+}
+
+// cacheKey 返回请求的缓存 key，HEAD 请求和 GET 请求共用缓存
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// variantKey 在缓存 key 后面拼上 Vary 请求头的值，流量拆分到其他后端池的请求再拼上后端池名称
+func variantKey(key string, varyHeaders []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	if upstream := loadbalancer.GetUpstreamFromContext(r); upstream != loadbalancer.DefaultPool {
+		b.WriteString("\x00@")
+		b.WriteString(upstream)
+	}
+	for _, h := range varyHeaders {
+		b.WriteString("\x00")
+		b.WriteString(h)
+		b.WriteString(":")
+		b.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return b.String()
+}
+
+// lookup 查找请求对应的缓存
+func (c *ResponseCache) lookup(r *http.Request) *cacheEntry {
+	key := cacheKey(r)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	varyHeaders, ok := c.vary[key]
+	if !ok {
+		return nil
+	}
+	e, ok := c.entries[variantKey(key, varyHeaders, r)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry)
+}
+
+// store 保存响应，超过容量时淘汰最久没有访问的缓存
+func (c *ResponseCache) store(r *http.Request, entry *cacheEntry, varyHeaders []string) {
+	key := cacheKey(r)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if old, ok := c.vary[key]; ok && strings.Join(old, ",") != strings.Join(varyHeaders, ",") {
+		// Vary 发生变化，旧的缓存无法再被命中
+		c.removePrefix(key + "\x00")
+		c.remove(key)
+	}
+	c.vary[key] = varyHeaders
+	entry.key = variantKey(key, varyHeaders, r)
+	c.remove(entry.key)
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.size()
+	c.stores.Add(1)
+	for c.bytes > c.cfg.MaxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+// remove 删除一条缓存，调用方需要持有锁
+func (c *ResponseCache) remove(key string) {
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*cacheEntry)
+	c.lru.Remove(e)
+	delete(c.entries, key)
+	c.bytes -= entry.size()
+}
+
+// removePrefix 删除 key 以 prefix 开头的所有缓存，调用方需要持有锁
+func (c *ResponseCache) removePrefix(prefix string) int {
+	n := 0
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(key)
+			n++
+		}
+	}
+	for key := range c.vary {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.vary, key)
+		}
+	}
+	return n
+}
+
+// Purge 删除缓存。url 为完整的 host+路径，prefix 为 true 时删除所有以它开头的缓存
+func (c *ResponseCache) Purge(url string, prefix bool) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if prefix {
+		return c.removePrefix(url)
+	}
+	n := c.removePrefix(url + "\x00")
+	if _, ok := c.entries[url]; ok {
+		c.remove(url)
+		n++
+	}
+	delete(c.vary, url)
+	return n
+}
+
+// Handler 响应缓存中间件
+func (c *ResponseCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || hasDirective(r.Header, "no-store") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		entry := c.lookup(r)
+		// 客户端要求验证缓存时不直接使用
+		clientNoCache := hasDirective(r.Header, "no-cache") || r.Header.Get("Pragma") == "no-cache"
+		if entry != nil && entry.fresh(now) && !clientNoCache {
+			c.hits.Add(1)
+			c.serve(w, r, entry, "HIT", now)
+			return
+		}
+		if entry == nil {
+			c.misses.Add(1)
+		}
+
+		outReq := r
+		if entry != nil && entry.hasValidator() {
+			// 过期的缓存带上验证器到上游做条件请求，上游返回 304 时继续使用缓存
+			outReq = r.Clone(r.Context())
+			outReq.Header.Del("If-None-Match")
+			outReq.Header.Del("If-Modified-Since")
+			if etag := entry.header.Get("ETag"); etag != "" {
+				outReq.Header.Set("If-None-Match", etag)
+			}
+			if lm := entry.header.Get("Last-Modified"); lm != "" {
+				outReq.Header.Set("If-Modified-Since", lm)
+			}
+		}
+
+		cw := &cacheWriter{
+			ResponseWriter: w,
+			header:         make(http.Header),
+			cache:          c,
+			entry:          entry,
+			revalidating:   outReq != r,
+			staleUsable:    entry != nil && c.staleUsable(entry, now),
+			capture:        r.Method == http.MethodGet,
+		}
+		next.ServeHTTP(cw, outReq)
+		cw.finish(r, now)
+	})
+}
+
+// staleUsable 后端不可用时是否可以使用这条过期的缓存
+func (c *ResponseCache) staleUsable(e *cacheEntry, now time.Time) bool {
+	if e.mustRevalidate {
+		return false
+	}
+	return e.age(now) < e.freshness+c.cfg.StaleIfError
+}
+
+// serve 使用缓存响应请求
+func (c *ResponseCache) serve(w http.ResponseWriter, r *http.Request, e *cacheEntry, state string, now time.Time) {
+	h := w.Header()
+	for k, vs := range e.header {
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+	h.Set("X-Cache", state)
+
+	// 客户端自己的条件请求
+	if etag := e.header.Get("ETag"); etag != "" && etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(e.body)
+	}
+}
+
+// etagMatch 判断 If-None-Match 是否匹配 ETag，按弱比较处理
+func etagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// StatsHandler 管理接口：返回缓存统计
+func (c *ResponseCache) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(cacheStats.String()))
+}
+
+// PurgeHandler 管理接口：删除缓存
+// POST /cache/purge?url=host/path 删除一个 URL 的所有变体，prefix=host/path 删除前缀匹配的缓存，不带参数时清空缓存
+func (c *ResponseCache) PurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var n int
+	switch {
+	case r.URL.Query().Get("url") != "":
+		n = c.Purge(r.URL.Query().Get("url"), false)
+	case r.URL.Query().Get("prefix") != "":
+		n = c.Purge(r.URL.Query().Get("prefix"), true)
+	default:
+		n = c.Purge("", true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"purged": n})
+}
+
+// cacheWriter 转发上游响应的同时把响应体保存下来
+// 上游返回 304 或者出错时不转发，改为使用缓存响应
+type cacheWriter struct {
+	http.ResponseWriter
+	header http.Header
+	cache  *ResponseCache
+	entry  *cacheEntry
+
+	revalidating bool
+	staleUsable  bool
+	capture      bool
+
+	status      int
+	wroteHeader bool
+	// notModified 上游返回 304，缓存仍然有效
+	notModified bool
+	// failed 上游出错，使用过期的缓存
+	failed bool
+	body   []byte
+	// tooLarge 响应体超过单条缓存上限，不再保存
+	tooLarge bool
+}
+
+func (w *cacheWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	if w.revalidating && status == http.StatusNotModified {
+		w.notModified = true
+		return
+	}
+	if w.staleUsable && status >= http.StatusInternalServerError {
+		w.failed = true
+		return
+	}
+	h := w.ResponseWriter.Header()
+	for k, vs := range w.header {
+		h[k] = vs
+	}
+	h.Set("X-Cache", "MISS")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified || w.failed {
+		return len(b), nil
+	}
+	if w.capture && !w.tooLarge {
+		if int64(len(w.body)+len(b)) > w.cache.cfg.MaxEntryBytes {
+			w.tooLarge = true
+			w.body = nil
+		} else {
+			w.body = append(w.body, b...)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheWriter) Flush() {
+	if w.notModified || w.failed {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish 上游响应结束后更新缓存
+func (w *cacheWriter) finish(r *http.Request, now time.Time) {
+	c := w.cache
+	switch {
+	case w.notModified:
+		c.revalidated.Add(1)
+		// 用 304 响应中的头更新缓存，并重新计算新鲜期
+		entry := *w.entry
+		entry.header = cloneHeader(w.entry.header)
+		for k, vs := range w.header {
+			entry.header[k] = vs
+		}
+		entry.stored = now
+		entry.initialAge = parseAge(w.header)
+		entry.freshness, entry.mustRevalidate = freshness(entry.header, now)
+		c.store(r, &entry, varyHeaders(entry.header))
+		c.serve(w.ResponseWriter, r, &entry, "REVALIDATED", now)
+	case w.failed:
+		c.stale.Add(1)
+		w.ResponseWriter.Header().Set("Warning", `111 - "Revalidation Failed"`)
+		c.serve(w.ResponseWriter, r, w.entry, "STALE", now)
+	case w.capture && !w.tooLarge && cacheable(r, w.status, w.header):
+		vary := varyHeaders(w.header)
+		fresh, mustRevalidate := freshness(w.header, now)
+		entry := &cacheEntry{
+			status:         w.status,
+			header:         cloneHeader(w.header),
+			body:           w.body,
+			stored:         now,
+			initialAge:     parseAge(w.header),
+			freshness:      fresh,
+			mustRevalidate: mustRevalidate,
+		}
+		// 既没有新鲜期也没有验证器的响应缓存了也用不上
+		if fresh > 0 || entry.hasValidator() {
+			c.store(r, entry, vary)
+		}
+	}
+}
+
+// cacheable 判断响应是否可以被共享缓存保存
+func cacheable(r *http.Request, status int, h http.Header) bool {
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently,
+		http.StatusNotFound, http.StatusGone:
+	default:
+		return false
+	}
+	if hasDirective(h, "no-store") || hasDirective(h, "private") {
+		return false
+	}
+	// 不同用户的 Cookie 不能共享
+	if h.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, v := range varyHeaders(h) {
+		if v == "*" {
+			return false
+		}
+	}
+	// 带认证信息的请求只有上游明确允许时才缓存
+	if r.Header.Get("Authorization") != "" && !hasDirective(h, "public") && directiveValue(h, "s-maxage") == "" {
+		return false
+	}
+	return true
+}
+
+// freshness 计算响应的新鲜期，优先级 s-maxage > max-age > Expires
+func freshness(h http.Header, now time.Time) (time.Duration, bool) {
+	mustRevalidate := hasDirective(h, "must-revalidate") || hasDirective(h, "proxy-revalidate") ||
+		hasDirective(h, "no-cache")
+	if hasDirective(h, "no-cache") {
+		return 0, mustRevalidate
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v := directiveValue(h, d); v != "" {
+			if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+				return time.Duration(secs) * time.Second, mustRevalidate
+			}
+			return 0, mustRevalidate
+		}
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// 无法解析的 Expires 视为已经过期
+			return 0, mustRevalidate
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		if expires.After(date) {
+			return expires.Sub(date), mustRevalidate
+		}
+	}
+	return 0, mustRevalidate
+}
+
+// parseAge 解析上游返回的 Age
+func parseAge(h http.Header) time.Duration {
+	secs, err := strconv.Atoi(h.Get("Age"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// varyHeaders 返回排序后的 Vary 请求头
+func varyHeaders(h http.Header) []string {
+	var headers []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				headers = append(headers, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(headers)
+	return headers
+}
+
+// hasDirective 判断 Cache-Control 中是否有某个指令
+func hasDirective(h http.Header, directive string) bool {
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name := strings.TrimSpace(strings.SplitN(d, "=", 2)[0])
+			if strings.EqualFold(name, directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// directiveValue 返回 Cache-Control 中某个指令的值
+func directiveValue(h http.Header, directive string) string {
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], directive) {
+				return strings.Trim(kv[1], `"`)
+			}
+		}
+	}
+	return ""
+}
+
+// cloneHeader 复制响应头
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vs := range h {
+		h2[k] = append([]string(nil), vs...)
+	}
+	return h2
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		header         http.Header
+		fresh          time.Duration
+		mustRevalidate bool
+	}{
+		{name: "max-age", header: http.Header{"Cache-Control": {"max-age=60"}}, fresh: time.Minute},
+		{name: "s-maxage wins", header: http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, fresh: 2 * time.Minute},
+		{name: "max-age wins over expires", header: http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Expires":       {now.Add(time.Hour).Format(http.TimeFormat)},
+		}, fresh: time.Minute},
+		{name: "expires relative to date", header: http.Header{
+			"Date":    {now.Add(-time.Hour).Format(http.TimeFormat)},
+			"Expires": {now.Format(http.TimeFormat)},
+		}, fresh: time.Hour},
+		{name: "invalid expires", header: http.Header{"Expires": {"0"}}},
+		{name: "invalid max-age", header: http.Header{"Cache-Control": {"max-age=abc"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}},
+		{name: "no-cache", header: http.Header{"Cache-Control": {"no-cache, max-age=60"}}, mustRevalidate: true},
+		{name: "must-revalidate", header: http.Header{"Cache-Control": {"max-age=60, must-revalidate"}}, fresh: time.Minute, mustRevalidate: true},
+		{name: "proxy-revalidate", header: http.Header{"Cache-Control": {"max-age=60, proxy-revalidate"}}, fresh: time.Minute, mustRevalidate: true},
+		{name: "none", header: http.Header{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fresh, mustRevalidate := freshness(tt.header, now)
+			if fresh != tt.fresh || mustRevalidate != tt.mustRevalidate {
+				t.Errorf("freshness = %s, %v, want %s, %v", fresh, mustRevalidate, tt.fresh, tt.mustRevalidate)
+			}
+		})
+	}
+}
+
+func TestCacheable(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   bool
+		status int
+		header http.Header
+		want   bool
+	}{
+		{name: "ok", status: 200, header: http.Header{"Cache-Control": {"max-age=60"}}, want: true},
+		{name: "404", status: 404, header: http.Header{}, want: true},
+		{name: "500", status: 500, header: http.Header{"Cache-Control": {"max-age=60"}}},
+		{name: "206", status: 206, header: http.Header{"Cache-Control": {"max-age=60"}}},
+		{name: "no-store", status: 200, header: http.Header{"Cache-Control": {"no-store"}}},
+		{name: "private", status: 200, header: http.Header{"Cache-Control": {"private, max-age=60"}}},
+		{name: "set-cookie", status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}},
+		{name: "vary star", status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}},
+		{name: "authorization", auth: true, status: 200, header: http.Header{"Cache-Control": {"max-age=60"}}},
+		{name: "authorization public", auth: true, status: 200, header: http.Header{"Cache-Control": {"public, max-age=60"}}, want: true},
+		{name: "authorization s-maxage", auth: true, status: 200, header: http.Header{"Cache-Control": {"s-maxage=60"}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.auth {
+				r.Header.Set("Authorization", "Bearer token")
+			}
+			if got := cacheable(r, tt.status, tt.header); got != tt.want {
+				t.Errorf("cacheable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// cacheBackend 记录请求次数的上游，handle 决定每次的响应
+type cacheBackend struct {
+	requests int
+	handle   func(w http.ResponseWriter, r *http.Request)
+}
+
+func (b *cacheBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.requests++
+	b.handle(w, r)
+}
+
+// cacheGet 通过缓存发送一个 GET 请求
+func cacheGet(h http.Handler, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "http://example.com/a", nil)
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestCacheHit(t *testing.T) {
+	backend := &cacheBackend{handle: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("hello"))
+	}}
+	h := NewResponseCache(CacheConfig{}).Handler(backend)
+
+	if rec := cacheGet(h, nil); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "hello" {
+		t.Fatalf("first request: X-Cache=%q body=%q, want a MISS", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	rec := cacheGet(h, nil)
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "hello" || backend.requests != 1 {
+		t.Fatalf("second request: X-Cache=%q body=%q upstream requests=%d, want a HIT",
+			rec.Header().Get("X-Cache"), rec.Body.String(), backend.requests)
+	}
+	// 客户端要求验证时不直接使用缓存
+	cacheGet(h, http.Header{"Cache-Control": {"no-cache"}})
+	if backend.requests != 2 {
+		t.Errorf("upstream requests = %d, want no-cache to bypass the cache", backend.requests)
+	}
+}
+
+// 不同的 Vary 请求头值保存为不同的变体
+func TestCacheVary(t *testing.T) {
+	backend := &cacheBackend{handle: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+	}}
+	h := NewResponseCache(CacheConfig{}).Handler(backend)
+
+	for _, lang := range []string{"en", "zh", "en", "zh"} {
+		rec := cacheGet(h, http.Header{"Accept-Language": {lang}})
+		if rec.Body.String() != lang {
+			t.Fatalf("Accept-Language %s: body = %q", lang, rec.Body.String())
+		}
+	}
+	if backend.requests != 2 {
+		t.Errorf("upstream requests = %d, want one per variant", backend.requests)
+	}
+}
+
+// 过期的缓存带上验证器到上游验证，上游返回 304 时继续使用缓存
+func TestCacheRevalidate(t *testing.T) {
+	var ifNoneMatch, ifModifiedSince string
+	backend := &cacheBackend{handle: func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch, ifModifiedSince = r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since")
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Wed, 01 Jan 2020 00:00:00 GMT")
+		if ifNoneMatch == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}}
+	h := NewResponseCache(CacheConfig{}).Handler(backend)
+
+	cacheGet(h, nil)
+	rec := cacheGet(h, nil)
+	if ifNoneMatch != `"v1"` || ifModifiedSince != "Wed, 01 Jan 2020 00:00:00 GMT" {
+		t.Fatalf("conditional request If-None-Match=%q If-Modified-Since=%q", ifNoneMatch, ifModifiedSince)
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "REVALIDATED" || rec.Body.String() != "hello" {
+		t.Fatalf("revalidated response: %d X-Cache=%q body=%q", rec.Code, rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	// 客户端自己的条件请求匹配缓存的 ETag 时返回 304
+	rec = cacheGet(h, http.Header{"If-None-Match": {`W/"v1"`}})
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("client conditional request: status = %d, want 304", rec.Code)
+	}
+}
+
+// 上游出错时在 stale_if_error 范围内返回过期的缓存，must-revalidate 的缓存不能这样使用
+func TestCacheStaleIfError(t *testing.T) {
+	for _, tt := range []struct {
+		cacheControl string
+		status       int
+	}{
+		{cacheControl: "max-age=0", status: http.StatusOK},
+		{cacheControl: "max-age=0, must-revalidate", status: http.StatusBadGateway},
+	} {
+		t.Run(tt.cacheControl, func(t *testing.T) {
+			down := false
+			backend := &cacheBackend{handle: func(w http.ResponseWriter, r *http.Request) {
+				if down {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				w.Header().Set("ETag", `"v1"`)
+				_, _ = w.Write([]byte("hello"))
+			}}
+			h := NewResponseCache(CacheConfig{StaleIfError: time.Minute}).Handler(backend)
+
+			cacheGet(h, nil)
+			down = true
+			if rec := cacheGet(h, nil); rec.Code != tt.status {
+				t.Errorf("status = %d X-Cache=%q, want %d", rec.Code, rec.Header().Get("X-Cache"), tt.status)
+			}
+		})
+	}
+}
+
+// 带认证信息的请求不使用也不保存没有明确允许共享的缓存
+func TestCacheAuthorization(t *testing.T) {
+	backend := &cacheBackend{handle: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}}
+	h := NewResponseCache(CacheConfig{}).Handler(backend)
+
+	for _, token := range []string{"Bearer a", "Bearer b"} {
+		if rec := cacheGet(h, http.Header{"Authorization": {token}}); rec.Body.String() != token {
+			t.Fatalf("Authorization %q: body = %q, a response for another user was served", token, rec.Body.String())
+		}
+	}
+	if backend.requests != 2 {
+		t.Errorf("upstream requests = %d, want 2", backend.requests)
+	}
+}
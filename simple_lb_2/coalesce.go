@@ -0,0 +1,220 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+
+	"loadbalancer"
+)
+
+// CoalesceConfig 请求合并配置，需要在路由上设置 coalesce = true 开启
+type CoalesceConfig struct {
+	// MaxWaiters 一个上游请求最多被多少个请求共享，超过的请求单独转发
+	MaxWaiters int `mapstructure:"max_waiters"`
+	// MaxResponseBytes 可以共享的最大响应体，超过的响应只返回给发起请求的客户端
+	MaxResponseBytes int64 `mapstructure:"max_response_bytes"`
+}
+
+// coalesceVaryHeaders 参与合并 key 计算的请求头，这些请求头不同的请求可能得到不同的响应
+var coalesceVaryHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie"}
+
+// coalescedCall 一个正在进行的上游请求
+type coalescedCall struct {
+	done    chan struct{}
+	waiters int
+
+	// 上游请求结束后填充，shared 为 false 时等待的请求需要单独转发
+	shared bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Coalescer 合并同时到达的相同幂等请求，只向上游发送一次，响应返回给所有等待的客户端
+// 缓存过期的瞬间大量相同的请求同时到达时，可以避免把它们全部转发给后端
+type Coalescer struct {
+	cfg CoalesceConfig
+
+	mux   sync.Mutex
+	calls map[string]*coalescedCall
+
+	leaders   *expvar.Int
+	coalesced *expvar.Int
+	fallbacks *expvar.Int
+}
+
+// coalesceStats 请求合并指标
+var coalesceStats = newStatsMap("coalesce")
+
+// NewCoalescer 创建请求合并器
+func NewCoalescer(cfg CoalesceConfig) *Coalescer {
+	if cfg.MaxWaiters <= 0 {
+		cfg.MaxWaiters = 1000
+	}
+	if cfg.MaxResponseBytes <= 0 {
+		cfg.MaxResponseBytes = 1 << 20
+	}
+	c := &Coalescer{
+		cfg:       cfg,
+		calls:     make(map[string]*coalescedCall),
+		leaders:   new(expvar.Int),
+		coalesced: new(expvar.Int),
+		fallbacks: new(expvar.Int),
+	}
+	coalesceStats.Set("leaders", c.leaders)
+	coalesceStats.Set("coalesced", c.coalesced)
+	coalesceStats.Set("fallbacks", c.fallbacks)
+	coalesceStats.Set("inflight", expvar.Func(func() interface{} {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		return len(c.calls)
+	}))
+	return c
+}
+
+// coalesceKey 在缓存 key 的基础上加上方法和可能影响响应内容的请求头
+func coalesceKey(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteString(" ")
+	b.WriteString(cacheKey(r))
+	b.WriteString("\x00")
+	b.WriteString(loadbalancer.GetUpstreamFromContext(r))
+	for _, h := range coalesceVaryHeaders {
+		b.WriteString("\x00")
+		b.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return b.String()
+}
+
+// Handler 请求合并中间件，需要放在 RouteTable.Handler 之后
+func (c *Coalescer) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !GetRouteFromContext(r).Coalesce || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := coalesceKey(r)
+		c.mux.Lock()
+		if call, ok := c.calls[key]; ok {
+			if call.waiters >= c.cfg.MaxWaiters {
+				c.mux.Unlock()
+				c.fallbacks.Add(1)
+				next.ServeHTTP(w, r)
+				return
+			}
+			call.waiters++
+			c.mux.Unlock()
+			c.wait(w, r, call, next)
+			return
+		}
+		call := &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.mux.Unlock()
+
+		c.leaders.Add(1)
+		tw := &teeWriter{ResponseWriter: w, limit: c.cfg.MaxResponseBytes, pre: cloneHeader(w.Header())}
+		// 发起请求的客户端断开连接或者处理器 panic 时，也要通知等待的请求
+		defer func() {
+			c.mux.Lock()
+			delete(c.calls, key)
+			c.mux.Unlock()
+			// ReverseProxy 转发响应体失败时会 panic(http.ErrAbortHandler)，这时响应不完整
+			p := recover()
+			call.shared = p == nil && r.Context().Err() == nil && tw.shareable()
+			if call.shared {
+				call.status, call.header, call.body = tw.status, tw.header, tw.body
+			}
+			close(call.done)
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(tw, r)
+	})
+}
+
+// wait 等待正在进行的上游请求，并把它的响应返回给客户端
+func (c *Coalescer) wait(w http.ResponseWriter, r *http.Request, call *coalescedCall, next http.Handler) {
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return
+	}
+	if !call.shared {
+		c.fallbacks.Add(1)
+		next.ServeHTTP(w, r)
+		return
+	}
+	c.coalesced.Add(1)
+	h := w.Header()
+	for k, vs := range call.header {
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Set("X-Coalesced", "true")
+	w.WriteHeader(call.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(call.body)
+	}
+}
+
+// teeWriter 把响应写给客户端的同时保存一份，超过上限后不再保存
+type teeWriter struct {
+	http.ResponseWriter
+	limit int64
+	// pre 转发之前已经设置的响应头(例如限流头)，只属于发起请求的客户端，不共享
+	pre http.Header
+
+	status   int
+	header   http.Header
+	body     []byte
+	tooLarge bool
+}
+
+func (w *teeWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = make(http.Header)
+		for k, vs := range w.ResponseWriter.Header() {
+			if pre, ok := w.pre[k]; ok && strings.Join(pre, "\n") == strings.Join(vs, "\n") {
+				continue
+			}
+			w.header[k] = append([]string(nil), vs...)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.tooLarge {
+		if int64(len(w.body)+len(b)) > w.limit {
+			w.tooLarge = true
+			w.body = nil
+		} else {
+			w.body = append(w.body, b...)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *teeWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// shareable 响应是否可以返回给其他客户端
+// 带 Set-Cookie 或者 private 的响应属于特定用户，不能共享
+func (w *teeWriter) shareable() bool {
+	if w.status == 0 || w.tooLarge {
+		return false
+	}
+	return w.header.Get("Set-Cookie") == "" && !hasDirective(w.header, "private") &&
+		!hasDirective(w.header, "no-store")
+}
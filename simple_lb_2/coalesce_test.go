@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withRoute 把请求放到指定的路由上，相当于经过了 RouteTable.Handler
+func withRoute(r *http.Request, route *Route) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), matchedRoute, route))
+}
+
+func TestTeeWriterShareable(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		want   bool
+	}{
+		{name: "plain", header: http.Header{"Content-Type": {"text/plain"}}, body: "hello", want: true},
+		{name: "set-cookie", header: http.Header{"Set-Cookie": {"session=1"}}, body: "hello"},
+		{name: "private", header: http.Header{"Cache-Control": {"private"}}, body: "hello"},
+		{name: "no-store", header: http.Header{"Cache-Control": {"no-store"}}, body: "hello"},
+		{name: "too large", header: http.Header{}, body: "0123456789abcdef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tw := &teeWriter{ResponseWriter: rec, limit: 10, pre: http.Header{}}
+			for k, vs := range tt.header {
+				tw.Header()[k] = vs
+			}
+			_, _ = tw.Write([]byte(tt.body))
+			if got := tw.shareable(); got != tt.want {
+				t.Errorf("shareable = %v, want %v", got, tt.want)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("client body = %q, want the full response", rec.Body.String())
+			}
+		})
+	}
+}
+
+// 影响响应内容的请求头不同的请求不能合并
+func TestCoalesceKey(t *testing.T) {
+	base := httptest.NewRequest("GET", "http://example.com/a?x=1", nil)
+	same := httptest.NewRequest("GET", "http://example.com/a?x=1", nil)
+	same.Header.Set("User-Agent", "curl")
+	if coalesceKey(base) != coalesceKey(same) {
+		t.Error("requests differing only in User-Agent have different keys")
+	}
+	for _, h := range coalesceVaryHeaders {
+		r := httptest.NewRequest("GET", "http://example.com/a?x=1", nil)
+		r.Header.Set(h, "v")
+		if coalesceKey(base) == coalesceKey(r) {
+			t.Errorf("requests differing in %s share a key", h)
+		}
+	}
+	head := httptest.NewRequest("HEAD", "http://example.com/a?x=1", nil)
+	if coalesceKey(base) == coalesceKey(head) {
+		t.Error("GET and HEAD share a key")
+	}
+}
+
+// runCoalesced 发起一个请求，等它到达上游后再发起 waiters 个相同的请求，然后让上游返回
+// 返回上游收到的请求数和每个客户端收到的响应
+func runCoalesced(t *testing.T, waiters int, respond func(w http.ResponseWriter)) (int32, []*httptest.ResponseRecorder) {
+	t.Helper()
+	var upstream int32
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 1)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&upstream, 1) == 1 {
+			arrived <- struct{}{}
+			<-release
+		}
+		respond(w)
+	})
+	c := NewCoalescer(CoalesceConfig{})
+	h := c.Handler(backend)
+	route := &Route{Name: "test", Coalesce: true}
+
+	recs := make([]*httptest.ResponseRecorder, waiters+1)
+	var wg sync.WaitGroup
+	serve := func(i int) {
+		defer wg.Done()
+		defer func() { _ = recover() }()
+		recs[i] = httptest.NewRecorder()
+		h.ServeHTTP(recs[i], withRoute(httptest.NewRequest("GET", "http://example.com/a", nil), route))
+	}
+	wg.Add(1)
+	go serve(0)
+	<-arrived
+	for i := 1; i <= waiters; i++ {
+		wg.Add(1)
+		go serve(i)
+	}
+	// 等所有请求都加入正在进行的上游请求
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mux.Lock()
+		joined := 0
+		for _, call := range c.calls {
+			joined = call.waiters
+		}
+		c.mux.Unlock()
+		if joined == waiters || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	return atomic.LoadInt32(&upstream), recs
+}
+
+func TestCoalescerSharesResponse(t *testing.T) {
+	upstream, recs := runCoalesced(t, 3, func(w http.ResponseWriter) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	if upstream != 1 {
+		t.Errorf("upstream requests = %d, want 1", upstream)
+	}
+	for i, rec := range recs {
+		if rec.Body.String() != "hello" {
+			t.Errorf("client %d body = %q", i, rec.Body.String())
+		}
+		if coalesced := rec.Header().Get("X-Coalesced") == "true"; coalesced != (i > 0) {
+			t.Errorf("client %d X-Coalesced = %v", i, coalesced)
+		}
+	}
+}
+
+// 属于特定用户的响应不共享，等待的请求单独转发
+func TestCoalescerDoesNotShareSetCookie(t *testing.T) {
+	upstream, recs := runCoalesced(t, 3, func(w http.ResponseWriter) {
+		w.Header().Set("Set-Cookie", "session=1")
+		_, _ = w.Write([]byte("hello"))
+	})
+	if upstream != 4 {
+		t.Errorf("upstream requests = %d, want every waiter forwarded separately", upstream)
+	}
+	for i, rec := range recs {
+		if rec.Header().Get("X-Coalesced") != "" {
+			t.Errorf("client %d got a shared response", i)
+		}
+	}
+}
+
+// 发起请求的处理器 panic 时响应不完整，等待的请求单独转发
+func TestCoalescerLeaderPanic(t *testing.T) {
+	var calls int32
+	upstream, recs := runCoalesced(t, 2, func(w http.ResponseWriter) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			_, _ = w.Write([]byte("hel"))
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+	if upstream != 3 {
+		t.Errorf("upstream requests = %d, want waiters forwarded after the panic", upstream)
+	}
+	for i, rec := range recs[1:] {
+		if rec.Body.String() != "hello" {
+			t.Errorf("waiter %d body = %q, want a complete response", i, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// CompressionConfig 响应压缩配置，需要在路由上设置 compress = true 开启
+type CompressionConfig struct {
+	// Types 需要压缩的 Content-Type，以 / 结尾时按前缀匹配，例如 text/
+	Types []string `mapstructure:"types"`
+	// MinSize 小于这个大小的响应不压缩，压缩后反而可能变大
+	MinSize int `mapstructure:"min_size"`
+	// GzipLevel gzip 压缩级别 1-9
+	GzipLevel int `mapstructure:"gzip_level"`
+	// BrotliQuality brotli 压缩质量 0-11
+	BrotliQuality int `mapstructure:"brotli_quality"`
+}
+
+// defaultCompressTypes 默认压缩的 Content-Type
+var defaultCompressTypes = []string{
+	"text/", "application/json", "application/javascript", "application/xml", "image/svg+xml",
+}
+
+// compressStats 响应压缩指标
+var compressStats = newStatsMap("compress")
+
+// Compressor 按客户端的 Accept-Encoding 对上游响应进行 gzip 或 brotli 压缩
+// 压缩是流式的，不会把整个响应体缓存在内存里
+type Compressor struct {
+	cfg CompressionConfig
+
+	gzipPool   sync.Pool
+	brotliPool sync.Pool
+
+	encoded *expvar.Map
+	bytesIn *expvar.Int
+}
+
+// NewCompressor 创建响应压缩器
+func NewCompressor(cfg CompressionConfig) (*Compressor, error) {
+	if len(cfg.Types) == 0 {
+		cfg.Types = defaultCompressTypes
+	}
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = 1024
+	}
+	if cfg.GzipLevel == 0 {
+		cfg.GzipLevel = gzip.DefaultCompression
+	}
+	if cfg.GzipLevel < gzip.HuffmanOnly || cfg.GzipLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("compression: invalid gzip_level %d", cfg.GzipLevel)
+	}
+	if cfg.BrotliQuality == 0 {
+		cfg.BrotliQuality = 4
+	}
+	if cfg.BrotliQuality < brotli.BestSpeed || cfg.BrotliQuality > brotli.BestCompression {
+		return nil, fmt.Errorf("compression: invalid brotli_quality %d", cfg.BrotliQuality)
+	}
+
+	c := &Compressor{
+		cfg:     cfg,
+		encoded: new(expvar.Map).Init(),
+		bytesIn: new(expvar.Int),
+	}
+	c.gzipPool.New = func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, cfg.GzipLevel)
+		return w
+	}
+	c.brotliPool.New = func() interface{} {
+		return brotli.NewWriterLevel(nil, cfg.BrotliQuality)
+	}
+	compressStats.Set("responses", c.encoded)
+	compressStats.Set("bytes_in", c.bytesIn)
+	return c, nil
+}
+
+// negotiate 根据 Accept-Encoding 选择压缩算法，优先使用 brotli
+func negotiate(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(strings.TrimSpace(part), ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 || (coding != "br" && coding != "gzip") {
+			continue
+		}
+		// 权重相同时 br 优先
+		if q > bestQ || (q == bestQ && coding == "br") {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressible 判断 Content-Type 是否需要压缩
+func (c *Compressor) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.cfg.Types {
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) || mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler 响应压缩中间件，需要放在 RouteTable.Handler 之后
+func (c *Compressor) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 协议升级(例如 WebSocket)的连接由 ReverseProxy 接管，不能压缩
+		if !GetRouteFromContext(r).Compress || r.Method == http.MethodHead || isUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			compressor:     c,
+			encoding:       negotiate(r.Header.Get("Accept-Encoding")),
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// isUpgrade 请求是否要求协议升级，Connection 请求头可能有多个值
+func isUpgrade(r *http.Request) bool {
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressWriter 流式压缩响应体
+// 不知道响应大小时先缓存 MinSize 字节再决定是否压缩
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *Compressor
+	encoding   string
+
+	status      int
+	wroteHeader bool
+	// decided 是否已经决定压缩与否，决定之后响应头已经发送给客户端
+	decided bool
+	encoder io.WriteCloser
+	buf     bytes.Buffer
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	// 响应大小已知时可以马上决定
+	if cl := w.Header().Get("Content-Length"); cl != "" || !w.candidate() {
+		size, err := strconv.Atoi(cl)
+		w.decide(err == nil && size >= w.compressor.cfg.MinSize)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf.Write(b)
+		if w.buf.Len() < w.compressor.cfg.MinSize {
+			return len(b), nil
+		}
+		w.decide(true)
+		return len(b), w.flushBuffer()
+	}
+	if w.encoder != nil {
+		w.compressor.bytesIn.Add(int64(len(b)))
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush 流式响应需要及时发送，还没有决定时按需要压缩处理
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader {
+		return
+	}
+	if !w.decided {
+		w.decide(true)
+		_ = w.flushBuffer()
+	}
+	if f, ok := w.encoder.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap 让 http.ResponseController 可以访问底层的 ResponseWriter，例如 Hijack
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close 响应结束，写出缓存的数据并关闭压缩器
+func (w *compressWriter) Close() {
+	if !w.wroteHeader {
+		return
+	}
+	if !w.decided {
+		w.decide(w.buf.Len() >= w.compressor.cfg.MinSize)
+		_ = w.flushBuffer()
+	}
+	if w.encoder == nil {
+		return
+	}
+	_ = w.encoder.Close()
+	switch e := w.encoder.(type) {
+	case *gzip.Writer:
+		w.compressor.gzipPool.Put(e)
+	case *brotli.Writer:
+		w.compressor.brotliPool.Put(e)
+	}
+	w.encoder = nil
+}
+
+// candidate 根据状态码和响应头判断响应是否可以压缩
+func (w *compressWriter) candidate() bool {
+	h := w.Header()
+	switch {
+	case w.status < http.StatusOK, w.status == http.StatusNoContent,
+		w.status == http.StatusPartialContent, w.status == http.StatusNotModified:
+		return false
+	case h.Get("Content-Encoding") != "" && h.Get("Content-Encoding") != "identity":
+		// 上游已经压缩过
+		return false
+	case hasDirective(h, "no-transform"):
+		return false
+	}
+	return w.compressor.compressible(h.Get("Content-Type"))
+}
+
+// decide 决定是否压缩并发送响应头
+func (w *compressWriter) decide(largeEnough bool) {
+	w.decided = true
+	h := w.Header()
+	if w.candidate() {
+		// 响应内容会随 Accept-Encoding 变化，即使这次没有压缩，缓存也需要区分
+		addVary(h, "Accept-Encoding")
+		if largeEnough && w.encoding != "" {
+			h.Set("Content-Encoding", w.encoding)
+			h.Del("Content-Length")
+			// 压缩后的内容和原始内容不同，强 ETag 需要改为弱 ETag
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+			w.encoder = w.compressor.newEncoder(w.encoding, w.ResponseWriter)
+			w.compressor.encoded.Add(w.encoding, 1)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// flushBuffer 把决定之前缓存的数据写出去
+func (w *compressWriter) flushBuffer() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	b := w.buf.Bytes()
+	w.buf.Reset()
+	var err error
+	if w.encoder != nil {
+		w.compressor.bytesIn.Add(int64(len(b)))
+		_, err = w.encoder.Write(b)
+	} else {
+		_, err = w.ResponseWriter.Write(b)
+	}
+	return err
+}
+
+// newEncoder 从对象池中取出压缩器
+func (c *Compressor) newEncoder(encoding string, w io.Writer) io.WriteCloser {
+	if encoding == "br" {
+		bw := c.brotliPool.Get().(*brotli.Writer)
+		bw.Reset(w)
+		return bw
+	}
+	gw := c.gzipPool.Get().(*gzip.Writer)
+	gw.Reset(w)
+	return gw
+}
+
+// addVary 在 Vary 响应头中加上一个请求头，已经存在时不重复添加
+func addVary(h http.Header, name string) {
+	for _, v := range varyHeaders(h) {
+		if v == name {
+			return
+		}
+	}
+	h.Add("Vary", name)
+}
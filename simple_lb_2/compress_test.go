@@ -0,0 +1,154 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"deflate, identity", ""},
+		{"GZIP;q=0.8, deflate", "gzip"},
+	}
+	for _, tt := range tests {
+		if got := negotiate(tt.acceptEncoding); got != tt.want {
+			t.Errorf("negotiate(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+// compressRequest 通过开启了压缩的路由发送请求，upstream 生成上游响应
+func compressRequest(t *testing.T, req *http.Request, upstream http.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+	c, err := NewCompressor(CompressionConfig{MinSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	rec := httptest.NewRecorder()
+	c.Handler(upstream).ServeHTTP(rec, withRoute(req, &Route{Name: "test", Compress: true}))
+	return rec
+}
+
+var compressBody = strings.Repeat("hello world ", 10)
+
+func TestCompressorSkip(t *testing.T) {
+	text := func(status int, header http.Header, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for k, vs := range header {
+				w.Header()[k] = vs
+			}
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		}
+	}
+	// 跳过压缩时 Content-Encoding 保持上游的值
+	tests := []struct {
+		name     string
+		method   string
+		header   http.Header
+		upstream http.HandlerFunc
+		encoding string
+	}{
+		{name: "small body", upstream: text(200, nil, "tiny")},
+		{name: "small content-length", upstream: text(200, http.Header{"Content-Length": {"4"}}, "tiny")},
+		{name: "image", upstream: text(200, http.Header{"Content-Type": {"image/png"}}, compressBody)},
+		{name: "already encoded", upstream: text(200, http.Header{"Content-Encoding": {"br"}}, compressBody), encoding: "br"},
+		{name: "no-transform", upstream: text(200, http.Header{"Cache-Control": {"no-transform"}}, compressBody)},
+		{name: "partial content", upstream: text(206, nil, compressBody)},
+		{name: "head", method: "HEAD", upstream: text(200, nil, "")},
+		{name: "upgrade", header: http.Header{"Connection": {"keep-alive, Upgrade"}}, upstream: text(200, nil, compressBody)},
+		{name: "identity only", header: http.Header{"Accept-Encoding": {"identity"}}, upstream: text(200, nil, compressBody)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			req := httptest.NewRequest(method, "/", nil)
+			for k, vs := range tt.header {
+				req.Header[k] = vs
+			}
+			rec := compressRequest(t, req, tt.upstream)
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", enc, tt.encoding)
+			}
+		})
+	}
+}
+
+func TestCompressorGzip(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := compressRequest(t, req, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(compressBody)))
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(compressBody))
+	})
+	h := rec.Header()
+	if h.Get("Content-Encoding") != "gzip" || h.Get("Content-Length") != "" || h.Get("ETag") != `W/"v1"` ||
+		h.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("headers = %v", h)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(zr)
+	if string(body) != compressBody {
+		t.Errorf("decompressed body = %q", body)
+	}
+}
+
+// 没有 Content-Length 的响应先缓存 min_size 字节，分多次写入的数据完整压缩
+func TestCompressorBrotliStreaming(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	rec := compressRequest(t, req, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		for i := 0; i < len(compressBody); i += 5 {
+			end := i + 5
+			if end > len(compressBody) {
+				end = len(compressBody)
+			}
+			_, _ = w.Write([]byte(compressBody[i:end]))
+		}
+	})
+	if rec.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", rec.Header().Get("Content-Encoding"))
+	}
+	body, _ := ioutil.ReadAll(brotli.NewReader(rec.Body))
+	if string(body) != compressBody {
+		t.Errorf("decompressed body = %q", body)
+	}
+}
+
+// 可以压缩但是太小的响应也要带上 Vary，让缓存区分不同的 Accept-Encoding
+func TestCompressorVaryWhenTooSmall(t *testing.T) {
+	rec := compressRequest(t, httptest.NewRequest("GET", "/", nil), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("tiny"))
+	})
+	if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Vary") != "Accept-Encoding" || rec.Body.String() != "tiny" {
+		t.Errorf("headers = %v body = %q", rec.Header(), rec.Body.String())
+	}
+}
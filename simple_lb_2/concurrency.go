@@ -0,0 +1,268 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"loadbalancer"
+)
+
+// 路由优先级，负载接近上限时先拒绝低优先级的请求
+const (
+	PriorityCritical   = "critical"
+	PriorityNormal     = "normal"
+	PriorityBestEffort = "best_effort"
+)
+
+// ConcurrencyConfig 自适应并发限制配置
+type ConcurrencyConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Algorithm 限制算法：aimd 或 gradient
+	Algorithm    string `mapstructure:"algorithm"`
+	InitialLimit int    `mapstructure:"initial_limit"`
+	MinLimit     int    `mapstructure:"min_limit"`
+	MaxLimit     int    `mapstructure:"max_limit"`
+	// LatencyThreshold aimd 算法中超过这个延迟的请求视为过载信号
+	LatencyThreshold time.Duration `mapstructure:"latency_threshold"`
+	// BackoffRatio 出现过载信号时限制值乘以这个系数
+	BackoffRatio float64 `mapstructure:"backoff_ratio"`
+	// NormalRatio、BestEffortRatio 普通和尽力而为路由可以使用的限制比例，剩余的额度留给关键路由
+	NormalRatio     float64 `mapstructure:"normal_ratio"`
+	BestEffortRatio float64 `mapstructure:"best_effort_ratio"`
+}
+
+// concurrencyStats 自适应并发限制指标，每个后端池一组
+var concurrencyStats = newStatsMap("concurrency")
+
+// ConcurrencyLimiter 根据观察到的延迟和错误动态计算后端池可以承受的并发数
+// 超过限制的请求直接返回 503，不排队，避免过载时请求堆积导致延迟进一步恶化
+type ConcurrencyLimiter struct {
+	cfg ConcurrencyConfig
+
+	mux      sync.Mutex
+	limit    float64
+	inflight int
+	// gradient 算法使用：长期平均延迟(基线)
+	longRTT float64
+
+	shed *expvar.Map
+}
+
+// NewConcurrencyLimiter 创建自适应并发限制器
+func NewConcurrencyLimiter(name string, cfg ConcurrencyConfig) (*ConcurrencyLimiter, error) {
+	switch cfg.Algorithm {
+	case "":
+		cfg.Algorithm = "aimd"
+	case "aimd", "gradient":
+	default:
+		return nil, fmt.Errorf("concurrency: unknown algorithm %q", cfg.Algorithm)
+	}
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = 1000
+	}
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = 20
+	}
+	if cfg.MinLimit > cfg.MaxLimit || cfg.InitialLimit < cfg.MinLimit || cfg.InitialLimit > cfg.MaxLimit {
+		return nil, fmt.Errorf("concurrency: initial_limit must be between min_limit and max_limit")
+	}
+	if cfg.LatencyThreshold <= 0 {
+		cfg.LatencyThreshold = time.Second
+	}
+	if cfg.BackoffRatio <= 0 || cfg.BackoffRatio >= 1 {
+		cfg.BackoffRatio = 0.9
+	}
+	if cfg.NormalRatio <= 0 || cfg.NormalRatio > 1 {
+		cfg.NormalRatio = 0.9
+	}
+	if cfg.BestEffortRatio <= 0 || cfg.BestEffortRatio > 1 {
+		cfg.BestEffortRatio = 0.7
+	}
+
+	l := &ConcurrencyLimiter{
+		cfg:   cfg,
+		limit: float64(cfg.InitialLimit),
+		shed:  new(expvar.Map).Init(),
+	}
+	m := new(expvar.Map).Init()
+	m.Set("limit", expvar.Func(func() interface{} { return l.Limit() }))
+	m.Set("inflight", expvar.Func(func() interface{} { return l.Inflight() }))
+	m.Set("shed", l.shed)
+	concurrencyStats.Set(name, m)
+	return l, nil
+}
+
+// Limit 返回当前的并发限制
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return int(l.limit)
+}
+
+// Inflight 返回当前正在处理的请求数
+func (l *ConcurrencyLimiter) Inflight() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.inflight
+}
+
+// Acquire 按优先级判断是否接收请求，接收后需要调用 Release
+func (l *ConcurrencyLimiter) Acquire(priority string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	allowed := l.limit
+	switch priority {
+	case PriorityCritical:
+	case PriorityBestEffort:
+		allowed *= l.cfg.BestEffortRatio
+	default:
+		allowed *= l.cfg.NormalRatio
+	}
+	if float64(l.inflight) >= math.Max(1, allowed) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// Release 请求结束，根据延迟和是否失败调整并发限制
+func (l *ConcurrencyLimiter) Release(rtt time.Duration, failed bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	inflight := l.inflight
+	l.inflight--
+
+	switch l.cfg.Algorithm {
+	case "gradient":
+		l.gradient(rtt, failed, inflight)
+	default:
+		l.aimd(rtt, failed, inflight)
+	}
+	l.limit = math.Max(float64(l.cfg.MinLimit), math.Min(float64(l.cfg.MaxLimit), l.limit))
+}
+
+// Drop 请求没有到达后端，只归还额度，不调整并发限制
+func (l *ConcurrencyLimiter) Drop() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.inflight--
+}
+
+// aimd 加性增、乘性减：请求失败或者延迟超过阈值时按比例降低限制，
+// 否则每处理完 limit 个请求把限制加 1
+func (l *ConcurrencyLimiter) aimd(rtt time.Duration, failed bool, inflight int) {
+	if failed || rtt > l.cfg.LatencyThreshold {
+		l.limit *= l.cfg.BackoffRatio
+		return
+	}
+	// 并发远低于限制时说明限制没有被用到，不需要继续增加
+	if float64(inflight)*2 >= l.limit {
+		l.limit += 1 / l.limit
+	}
+}
+
+// gradient 比较本次延迟和长期平均延迟，延迟升高说明后端开始排队，按比例降低限制
+func (l *ConcurrencyLimiter) gradient(rtt time.Duration, failed bool, inflight int) {
+	if failed {
+		l.limit *= l.cfg.BackoffRatio
+		return
+	}
+	sample := float64(rtt)
+	if l.longRTT == 0 {
+		l.longRTT = sample
+	}
+	// 长期平均延迟缓慢跟随样本变化
+	l.longRTT = l.longRTT*0.95 + sample*0.05
+
+	// 延迟高于基线时 gradient 小于 1，最多一次减半
+	gradient := math.Max(0.5, math.Min(1, l.longRTT/sample))
+	// 允许排队的余量，保证限制可以增长
+	headroom := math.Sqrt(l.limit)
+	if float64(inflight)*2 < l.limit {
+		// 限制没有被用到时不增长
+		headroom = 0
+	}
+	newLimit := l.limit*gradient + headroom
+	// 平滑变化，避免单个慢请求导致限制剧烈抖动
+	l.limit = l.limit*0.8 + newLimit*0.2
+}
+
+// Handler 自适应并发限制中间件，超过限制的请求直接返回 503，需要放在 RouteTable.Handler 之后
+func (l *ConcurrencyLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := GetRouteFromContext(r)
+		priority := route.Priority
+		if priority == "" {
+			priority = PriorityNormal
+		}
+		if !l.Acquire(priority) {
+			l.shed.Add(priority, 1)
+			log.Printf("%s(%s) load shed, concurrency limit reached\n", r.RemoteAddr, r.URL.Path)
+			http.Error(w, "Service overloaded", http.StatusServiceUnavailable)
+			return
+		}
+
+		trace := &loadbalancer.RequestTrace{}
+		rec := newStatusRecorder(w)
+		completed := false
+		// 转发时可能 panic(例如 ReverseProxy 的 http.ErrAbortHandler)，在 defer 中归还额度
+		defer func() {
+			if trace.Shed {
+				// 负载均衡器自己排队失败返回的 503 不反映后端的延迟和错误
+				l.Drop()
+				return
+			}
+			// 延迟从拿到后端名额开始计算，不包括在负载均衡器中排队的时间
+			rtt := time.Duration(0)
+			if !trace.Acquired.IsZero() {
+				rtt = time.Since(trace.Acquired)
+			}
+			// 5xx 说明后端出错或者已经过载，4xx 是客户端的问题，不计入失败；
+			// 响应发送到一半 panic 时状态码已经是 200，同样是失败
+			l.Release(rtt, !completed || rec.Status() >= http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rec, r.WithContext(loadbalancer.WithTrace(r.Context(), trace)))
+		completed = true
+	})
+}
+
+// ConcurrencyLimiters 每个后端池一个自适应并发限制器，一个后端池过载不影响其他后端池的请求
+type ConcurrencyLimiters map[string]*ConcurrencyLimiter
+
+// NewConcurrencyLimiters 为 pools 中的每个后端池创建限制器，指标按后端池名称分组
+func NewConcurrencyLimiters(cfg ConcurrencyConfig, pools []string) (ConcurrencyLimiters, error) {
+	ls := make(ConcurrencyLimiters, len(pools))
+	for _, name := range pools {
+		l, err := NewConcurrencyLimiter(name, cfg)
+		if err != nil {
+			return nil, err
+		}
+		ls[name] = l
+	}
+	return ls, nil
+}
+
+// Handler 按请求使用的后端池(见 loadbalancer.WithUpstream)选择限制器，需要放在 Splitter.Handler 之后
+func (ls ConcurrencyLimiters) Handler(next http.Handler) http.Handler {
+	handlers := make(map[string]http.Handler, len(ls))
+	for name, l := range ls {
+		handlers[name] = l.Handler(next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := handlers[loadbalancer.GetUpstreamFromContext(r)]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"loadbalancer"
+)
+
+func newTestConcurrencyLimiter(t *testing.T, cfg ConcurrencyConfig) *ConcurrencyLimiter {
+	t.Helper()
+	l, err := NewConcurrencyLimiter("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// release 模拟 inflight 个请求中的一个以 rtt 结束
+func release(l *ConcurrencyLimiter, inflight int, rtt time.Duration, failed bool) {
+	l.mux.Lock()
+	l.inflight = inflight
+	l.mux.Unlock()
+	l.Release(rtt, failed)
+}
+
+func TestAIMD(t *testing.T) {
+	l := newTestConcurrencyLimiter(t, ConcurrencyConfig{
+		InitialLimit: 10, MinLimit: 5, MaxLimit: 11, LatencyThreshold: 100 * time.Millisecond, BackoffRatio: 0.5,
+	})
+
+	// 并发接近限制并且延迟正常时每个请求加 1/limit
+	release(l, 10, 10*time.Millisecond, false)
+	if got := l.limit; got < 10.09 || got > 10.11 {
+		t.Fatalf("limit = %.3f after a fast request, want 10.1", got)
+	}
+	// 限制没有被用到时不增长
+	release(l, 2, 10*time.Millisecond, false)
+	if got := l.limit; got < 10.09 || got > 10.11 {
+		t.Fatalf("limit = %.3f after a request at low concurrency, want unchanged", got)
+	}
+	// 不超过 max_limit
+	for i := 0; i < 100; i++ {
+		release(l, 20, 10*time.Millisecond, false)
+	}
+	if got := l.Limit(); got != 11 {
+		t.Fatalf("limit = %d, want max_limit 11", got)
+	}
+	// 延迟超过阈值和失败都按比例降低，不低于 min_limit
+	release(l, 10, 200*time.Millisecond, false)
+	if got := l.limit; got != 5.5 {
+		t.Fatalf("limit = %.3f after a slow request, want 5.5", got)
+	}
+	release(l, 10, 10*time.Millisecond, true)
+	if got := l.limit; got != 5 {
+		t.Fatalf("limit = %.3f after a failed request, want min_limit 5", got)
+	}
+}
+
+func TestGradient(t *testing.T) {
+	l := newTestConcurrencyLimiter(t, ConcurrencyConfig{Algorithm: "gradient", InitialLimit: 20, MaxLimit: 100})
+
+	// 延迟稳定时按 sqrt(limit) 的余量增长
+	for i := 0; i < 20; i++ {
+		release(l, 20, 10*time.Millisecond, false)
+	}
+	grown := l.limit
+	if grown <= 20 {
+		t.Fatalf("limit = %.2f with steady latency, want growth above 20", grown)
+	}
+
+	// 延迟升高到基线的 4 倍，gradient 最低为 0.5，限制下降
+	for i := 0; i < 20; i++ {
+		release(l, 1, 40*time.Millisecond, false)
+	}
+	if l.limit >= grown {
+		t.Fatalf("limit = %.2f after latency increased, want below %.2f", l.limit, grown)
+	}
+
+	// 失败直接按 backoff_ratio 降低
+	before := l.limit
+	release(l, 1, 10*time.Millisecond, true)
+	if got, want := l.limit, before*0.9; got < want-0.01 || got > want+0.01 {
+		t.Fatalf("limit = %.2f after a failed request, want %.2f", got, want)
+	}
+}
+
+// 优先级低的请求先被拒绝
+func TestConcurrencyPriority(t *testing.T) {
+	l := newTestConcurrencyLimiter(t, ConcurrencyConfig{InitialLimit: 10, NormalRatio: 0.5, BestEffortRatio: 0.2})
+	for i := 0; i < 2; i++ {
+		if !l.Acquire(PriorityBestEffort) {
+			t.Fatalf("best_effort request %d rejected", i)
+		}
+	}
+	if l.Acquire(PriorityBestEffort) {
+		t.Fatal("best_effort request accepted above 20% of the limit")
+	}
+	for i := 0; i < 3; i++ {
+		if !l.Acquire(PriorityNormal) {
+			t.Fatalf("normal request %d rejected", i)
+		}
+	}
+	if l.Acquire(PriorityNormal) {
+		t.Fatal("normal request accepted above 50% of the limit")
+	}
+	for i := 0; i < 5; i++ {
+		if !l.Acquire(PriorityCritical) {
+			t.Fatalf("critical request %d rejected", i)
+		}
+	}
+	if l.Acquire(PriorityCritical) {
+		t.Fatal("critical request accepted above the limit")
+	}
+}
+
+// 响应发送到一半 panic 的请求计为失败
+func TestConcurrencyHandlerPanicIsFailure(t *testing.T) {
+	l := newTestConcurrencyLimiter(t, ConcurrencyConfig{InitialLimit: 10, BackoffRatio: 0.5})
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic(http.ErrAbortHandler)
+	}))
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Fatalf("recovered %v, want http.ErrAbortHandler", err)
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	if got := l.Limit(); got != 5 {
+		t.Errorf("limit = %d after a panic, want 5", got)
+	}
+	if got := l.Inflight(); got != 0 {
+		t.Errorf("inflight = %d after a panic, want 0", got)
+	}
+}
+
+// newSaturatedBalancer 创建只有一个 max_conns=1 后端的负载均衡器，后端收到请求后等待 hold 再返回
+func newSaturatedBalancer(t *testing.T, hold time.Duration, queueSize int, queueTimeout time.Duration) *loadbalancer.LoadBalancer {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(hold)
+		}
+	}))
+	t.Cleanup(backend.Close)
+	u, _ := url.Parse(backend.URL)
+	return loadbalancer.New(
+		loadbalancer.WithBackends(&loadbalancer.BackendSpec{URL: u, MaxConns: 1}),
+		loadbalancer.WithPoolOptions(loadbalancer.WithQueue(queueSize, queueTimeout)),
+	)
+}
+
+// 负载均衡器排队失败返回的 503 不降低并发限制
+func TestConcurrencyHandlerIgnoresShedRequests(t *testing.T) {
+	lb := newSaturatedBalancer(t, 300*time.Millisecond, 0, 0)
+	l := newTestConcurrencyLimiter(t, ConcurrencyConfig{InitialLimit: 10, BackoffRatio: 0.5})
+	h := l.Handler(lb)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	<-done
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503 from a full queue", rec.Code)
+	}
+	if got := l.Limit(); got != 10 {
+		t.Errorf("limit = %d after a shed request, want unchanged 10", got)
+	}
+	if got := l.Inflight(); got != 0 {
+		t.Errorf("inflight = %d, want 0", got)
+	}
+}
+
+// 延迟不包括在负载均衡器中排队的时间
+func TestConcurrencyHandlerExcludesQueueWait(t *testing.T) {
+	lb := newSaturatedBalancer(t, 300*time.Millisecond, 1, 5*time.Second)
+	l := newTestConcurrencyLimiter(t, ConcurrencyConfig{
+		InitialLimit: 10, LatencyThreshold: 200 * time.Millisecond, BackoffRatio: 0.5,
+	})
+	h := l.Handler(lb)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	<-done
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after queueing", rec.Code)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Fatalf("request finished after %s, want it to wait in the queue", waited)
+	}
+	if got := l.Limit(); got < 10 {
+		t.Errorf("limit = %d, queue wait was counted as backend latency", got)
+	}
+}
@@ -3,27 +3,141 @@ package config
 import (
 	"fmt"
 	"log"
+	"path/filepath"
+	"strings"
+	"sync"
 
-	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 )
 
 //RuntimeViper runtime config
-var RuntimeViper *viper.Viper
-
-func init() {
-	RuntimeViper = viper.New()
-	RuntimeViper.SetConfigType("toml")
-	RuntimeViper.SetConfigName("cfg")                   // name of config file (without extension)
-	RuntimeViper.AddConfigPath("/etc/proxy/simple_lb/") // path to look for the config file in
-	RuntimeViper.AddConfigPath("./config/")             // optionally look for config in the working directory
+var RuntimeViper = viper.New()
+
+// configPaths 没有指定配置文件时查找 cfg.toml、cfg.yaml、cfg.yml 或 cfg.json 的目录
+var configPaths = []string{"/etc/proxy/simple_lb/", "./config/"}
+
+// supportedExts 支持的配置文件格式
+var supportedExts = []string{"toml", "yaml", "yml", "json"}
+
+var (
+	listenersMux sync.Mutex
+	listeners    []func()
+
+	// overrides 环境变量和命令行参数指定的值，每次读取配置文件后重新覆盖
+	overrides map[string]interface{}
+)
+
+// OnChange 注册配置文件改变后的回调，用于在运行时更新可以热加载的配置
+func OnChange(fn func()) {
+	listenersMux.Lock()
+	defer listenersMux.Unlock()
+	listeners = append(listeners, fn)
+}
+
+// Load 读取配置文件，path 为空时在默认目录中查找，格式按扩展名区分
+// values 中的值覆盖配置文件中的值，key 为 server.port 形式的路径，列表的值为 []interface{}
+func Load(path string, values map[string]interface{}) error {
+	if path != "" {
+		ext := strings.TrimPrefix(filepath.Ext(path), ".")
+		if !supported(ext) {
+			return fmt.Errorf("unsupported config format %q, use one of %s", ext, strings.Join(supportedExts, ", "))
+		}
+		RuntimeViper.SetConfigFile(path)
+	} else {
+		RuntimeViper.SetConfigName("cfg") // name of config file (without extension)
+		for _, p := range configPaths {
+			RuntimeViper.AddConfigPath(p)
+		}
+	}
 	if err := RuntimeViper.ReadInConfig(); err != nil {
-		panic(fmt.Errorf("fatal error config file: %s", err))
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			return fmt.Errorf("no cfg.{%s} found in %s, use -config to specify the config file",
+				strings.Join(supportedExts, ","), strings.Join(configPaths, " or "))
+		}
+		return err
 	}
+	overrides = values
+	return applyOverrides()
+}
 
-	// 监听配置文件的改变，实现热部署
-	RuntimeViper.WatchConfig()
-	RuntimeViper.OnConfigChange(func(e fsnotify.Event) {
-		log.Printf("config file changed:%s", e.Name)
+// Watch 监听配置文件的改变，实现热部署
+// 新的配置由 h 校验和记录版本，校验失败时继续使用当前版本，不通知 OnChange 注册的回调。
+// 不使用 viper 的 WatchConfig，它在回调之前不加锁地重新读取配置，和回滚同时修改 RuntimeViper。
+// 这里只通知 h，RuntimeViper 只在 h 的锁内修改
+func Watch(h *History) error {
+	file := RuntimeViper.ConfigFileUsed()
+	return WatchFiles([]string{file}, func() {
+		log.Printf("config file changed:%s", file)
+		h.fileChanged(file)
 	})
 }
+
+// notify 通知 OnChange 注册的回调
+func notify() {
+	listenersMux.Lock()
+	fns := append([]func(){}, listeners...)
+	listenersMux.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// applyOverrides 把 overrides 合并到配置中
+// viper 合并时要求类型和配置文件中的值相同，所以先按配置文件中的值转换类型
+func applyOverrides() error {
+	for key, value := range overrides {
+		v, err := convertLike(RuntimeViper.Get(key), value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		m := map[string]interface{}{}
+		parts := strings.Split(key, ".")
+		cur := m
+		for _, part := range parts[:len(parts)-1] {
+			next := map[string]interface{}{}
+			cur[part] = next
+			cur = next
+		}
+		cur[parts[len(parts)-1]] = v
+		if err := RuntimeViper.MergeConfigMap(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertLike 把 value 转换为和 existing 相同的类型，existing 为 nil 时原样返回
+func convertLike(existing, value interface{}) (interface{}, error) {
+	switch existing.(type) {
+	case nil:
+		return value, nil
+	case int:
+		return cast.ToIntE(value)
+	case int64:
+		return cast.ToInt64E(value)
+	case float64:
+		return cast.ToFloat64E(value)
+	case bool:
+		return cast.ToBoolE(value)
+	case string:
+		return cast.ToStringE(value)
+	case []interface{}:
+		if list, ok := value.([]interface{}); ok {
+			return list, nil
+		}
+		return []interface{}{value}, nil
+	default:
+		return nil, fmt.Errorf("cannot override a %T value", existing)
+	}
+}
+
+// supported 是否支持扩展名为 ext 的配置文件
+func supported(ext string) bool {
+	for _, e := range supportedExts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,387 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryConfig [history] 配置版本历史
+type HistoryConfig struct {
+	// Size 保留最近几个成功应用的版本，默认为 10
+	Size int `mapstructure:"size"`
+	// Probation 新配置的试用期，试用期内错误率升高时自动回滚到上一个版本，0 表示不自动回滚
+	Probation time.Duration `mapstructure:"probation"`
+	// ErrorRate 试用期内 5xx 响应的比例达到这个值并且高于上一个版本时回滚，默认为 0.1
+	ErrorRate float64 `mapstructure:"error_rate"`
+	// MinRequests 试用期内的请求数少于这个值时不判断错误率，默认为 20
+	MinRequests int64 `mapstructure:"min_requests"`
+	// AuditLog 审计日志文件，每次配置变化追加一行 JSON，为空时写到标准日志
+	AuditLog string `mapstructure:"audit_log"`
+}
+
+// 版本状态
+const (
+	StatusProbation  = "probation"
+	StatusConfirmed  = "confirmed"
+	StatusRolledBack = "rolled_back"
+)
+
+// Version 一个成功应用过的配置版本
+type Version struct {
+	ID   int       `json:"id"`
+	Time time.Time `json:"time"`
+	// Hash 配置文件内容的 sha256
+	Hash   string `json:"hash"`
+	Status string `json:"status"`
+
+	content []byte
+	// settings 应用这个版本后 RuntimeViper.AllSettings() 的值，包括覆盖的值
+	settings map[string]interface{}
+}
+
+// ErrorCounter 返回累计的 5xx 响应数和请求数
+type ErrorCounter func() (errors, total int64)
+
+// ConfigDiff 比较两份配置，restart 为改变了的只在启动时读取的配置项，reload 表示可以热加载的配置项是否改变
+type ConfigDiff func(old, new map[string]interface{}) (restart []string, reload bool)
+
+// History 配置版本历史，负责应用配置文件的改变
+// 新配置校验通过后进入试用期，试用期内错误率升高时自动回滚到上一个版本，也可以通过管理接口手动回滚到保留的任意版本。
+// 回滚只修改内存中的配置，不会改写配置文件
+type History struct {
+	cfg      HistoryConfig
+	validate func() error
+	counter  ErrorCounter
+	diff     ConfigDiff
+	audit    *os.File
+	// tick 试用期内检查错误率的间隔
+	tick time.Duration
+	// startup 启动时的配置，只在启动时读取的配置项和它比较
+	startup map[string]interface{}
+
+	mux      sync.Mutex
+	versions []*Version
+	current  *Version
+	nextID   int
+	// 当前版本生效时的计数，用来计算这个版本的错误率
+	errorsAt, totalAt int64
+	// stopProbation 结束正在进行的试用期
+	stopProbation chan struct{}
+	// rejectedHash 最近一次校验失败的内容，同一个内容只记录一次
+	rejectedHash string
+	// restartHash 最近一次记录 restart_required 的内容，同一个内容只记录一次
+	restartHash string
+}
+
+// auditEntry 审计日志中的一条记录
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Action loaded、applied、rejected、restart_required、confirmed、rollback 或 auto_rollback
+	Action  string `json:"action"`
+	Version int    `json:"version,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	From    int    `json:"from,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// NewHistory 创建配置版本历史，validate 校验 RuntimeViper 中的配置，counter 提供试用期内的错误率，
+// diff 区分只在启动时读取的配置项，为 nil 时所有配置项都当作可以热加载
+func NewHistory(cfg HistoryConfig, validate func() error, counter ErrorCounter, diff ConfigDiff) (*History, error) {
+	if cfg.Size <= 0 {
+		cfg.Size = 10
+	}
+	if cfg.ErrorRate <= 0 {
+		cfg.ErrorRate = 0.1
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	h := &History{cfg: cfg, validate: validate, counter: counter, diff: diff, tick: time.Second}
+	if cfg.AuditLog != "" {
+		f, err := os.OpenFile(cfg.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		h.audit = f
+	}
+
+	// 启动时读取的配置作为第一个版本，已经校验过，不需要试用期
+	content, err := ioutil.ReadFile(RuntimeViper.ConfigFileUsed())
+	if err != nil {
+		return nil, err
+	}
+	v := h.add(content)
+	v.Status = StatusConfirmed
+	h.startup = v.settings
+	h.errorsAt, h.totalAt = h.counter()
+	h.log(auditEntry{Action: "loaded", Version: v.ID, Hash: v.Hash})
+	return h, nil
+}
+
+// fileChanged 配置文件改变后校验并应用新的配置，校验失败时恢复当前版本
+func (h *History) fileChanged(name string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	content, err := ioutil.ReadFile(RuntimeViper.ConfigFileUsed())
+	if err != nil {
+		log.Printf("config: %s", err)
+		h.restore()
+		return
+	}
+	hash := contentHash(content)
+	// 保存文件时常常会触发多次事件，内容没有变化时不产生新版本
+	if hash == h.current.Hash {
+		h.restore()
+		return
+	}
+	if err := h.apply(content); err != nil {
+		h.restore()
+		if hash != h.rejectedHash {
+			h.rejectedHash = hash
+			log.Printf("config file %s rejected:\n%s", name, err)
+			h.log(auditEntry{Action: "rejected", Hash: hash, From: h.current.ID, Reason: err.Error()})
+		}
+		return
+	}
+	h.rejectedHash = ""
+
+	// 只在启动时读取的配置项改变后需要重启才能生效，没有可以热加载的改变时不产生新版本，也不进入试用期
+	if h.diff != nil {
+		settings := RuntimeViper.AllSettings()
+		restart, _ := h.diff(h.startup, settings)
+		_, reload := h.diff(h.current.settings, settings)
+		if len(restart) > 0 && hash != h.restartHash {
+			h.restartHash = hash
+			reason := "restart to apply " + strings.Join(restart, ", ")
+			log.Printf("config file %s: %s", name, reason)
+			h.log(auditEntry{Action: "restart_required", Hash: hash, From: h.current.ID, Reason: reason})
+		}
+		if !reload {
+			h.restore()
+			return
+		}
+	}
+
+	previous := h.current
+	v := h.add(content)
+	h.log(auditEntry{Action: "applied", Version: v.ID, Hash: v.Hash, From: previous.ID})
+	notify()
+	h.startProbation(v, previous)
+}
+
+// Rollback 回滚到保留的版本 id，reason 写到审计日志中
+func (h *History) Rollback(id int, reason string) (*Version, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.rollback(id, "rollback", reason)
+}
+
+func (h *History) rollback(id int, action, reason string) (*Version, error) {
+	var target *Version
+	for _, v := range h.versions {
+		if v.ID == id {
+			target = v
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("version %d not found", id)
+	}
+	if target == h.current {
+		return nil, fmt.Errorf("version %d is already in use", id)
+	}
+	if err := h.apply(target.content); err != nil {
+		h.restore()
+		return nil, fmt.Errorf("version %d: %s", id, err)
+	}
+
+	h.endProbation()
+	from := h.current
+	from.Status = StatusRolledBack
+	h.current = target
+	h.errorsAt, h.totalAt = h.counter()
+	h.log(auditEntry{Action: action, Version: target.ID, Hash: target.Hash, From: from.ID, Reason: reason})
+	log.Printf("config: rolled back from version %d to %d: %s", from.ID, target.ID, reason)
+	notify()
+	return target, nil
+}
+
+// apply 把 content 读入 RuntimeViper，覆盖环境变量和命令行参数指定的值后校验
+func (h *History) apply(content []byte) error {
+	if err := RuntimeViper.ReadConfig(bytes.NewReader(content)); err != nil {
+		return err
+	}
+	if err := applyOverrides(); err != nil {
+		return err
+	}
+	if h.validate != nil {
+		return h.validate()
+	}
+	return nil
+}
+
+// restore 恢复当前版本，当前版本已经校验过，不会失败
+func (h *History) restore() {
+	if err := h.apply(h.current.content); err != nil {
+		log.Printf("config: restore version %d: %s", h.current.ID, err)
+	}
+}
+
+// add 添加一个新版本并作为当前版本，超过 Size 时删除最早的版本
+func (h *History) add(content []byte) *Version {
+	h.nextID++
+	v := &Version{
+		ID:       h.nextID,
+		Time:     time.Now(),
+		Hash:     contentHash(content),
+		Status:   StatusProbation,
+		content:  content,
+		settings: RuntimeViper.AllSettings(),
+	}
+	h.versions = append(h.versions, v)
+	if len(h.versions) > h.cfg.Size {
+		h.versions = h.versions[len(h.versions)-h.cfg.Size:]
+	}
+	h.current = v
+	return v
+}
+
+// startProbation 开始新版本的试用期，previous 为回滚的目标
+func (h *History) startProbation(v, previous *Version) {
+	h.endProbation()
+	// 上一个版本生效以来的错误率作为基线
+	errors, total := h.counter()
+	baseline := rate(errors-h.errorsAt, total-h.totalAt)
+	h.errorsAt, h.totalAt = errors, total
+	if h.cfg.Probation <= 0 {
+		v.Status = StatusConfirmed
+		return
+	}
+
+	stop := make(chan struct{})
+	h.stopProbation = stop
+	go h.watchProbation(v, previous, baseline, stop)
+}
+
+// endProbation 结束正在进行的试用期
+func (h *History) endProbation() {
+	if h.stopProbation != nil {
+		close(h.stopProbation)
+		h.stopProbation = nil
+	}
+}
+
+// watchProbation 试用期内每隔 tick 检查一次错误率，错误率达到 ErrorRate 并且高于 baseline 时回滚到 previous
+func (h *History) watchProbation(v, previous *Version, baseline float64, stop chan struct{}) {
+	t := time.NewTicker(h.tick)
+	defer t.Stop()
+	deadline := time.NewTimer(h.cfg.Probation)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-deadline.C:
+			h.mux.Lock()
+			if h.stopProbation == stop {
+				v.Status = StatusConfirmed
+				h.stopProbation = nil
+				h.log(auditEntry{Action: "confirmed", Version: v.ID, Hash: v.Hash})
+			}
+			h.mux.Unlock()
+			return
+		case <-t.C:
+			h.mux.Lock()
+			errors, total := h.counter()
+			errors, total = errors-h.errorsAt, total-h.totalAt
+			r := rate(errors, total)
+			if h.current == v && total >= h.cfg.MinRequests && r >= h.cfg.ErrorRate && r > baseline {
+				reason := fmt.Sprintf("error rate %.1f%% (%d/%d) during probation, %.1f%% before", r*100, errors, total, baseline*100)
+				if _, err := h.rollback(previous.ID, "auto_rollback", reason); err != nil {
+					log.Printf("config: auto rollback: %s", err)
+				}
+				h.mux.Unlock()
+				return
+			}
+			h.mux.Unlock()
+		}
+	}
+}
+
+// log 写审计日志
+func (h *History) log(e auditEntry) {
+	e.Time = time.Now()
+	line, _ := json.Marshal(e)
+	if h.audit == nil {
+		log.Printf("config audit: %s", line)
+		return
+	}
+	if _, err := h.audit.Write(append(line, '\n')); err != nil {
+		log.Printf("config audit: %s", err)
+	}
+}
+
+// VersionsHandler 管理接口：GET /config/versions 返回保留的版本，current 为当前使用的版本
+func (h *History) VersionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.mux.Lock()
+	resp := struct {
+		Current  int        `json:"current"`
+		Versions []*Version `json:"versions"`
+	}{Current: h.current.ID}
+	for i := len(h.versions) - 1; i >= 0; i-- {
+		v := *h.versions[i]
+		resp.Versions = append(resp.Versions, &v)
+	}
+	h.mux.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// RollbackHandler 管理接口：POST /config/rollback?version=3 回滚到指定的版本
+func (h *History) RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+	v, err := h.Rollback(id, "requested by "+r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// contentHash 配置文件内容的 sha256
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// rate 错误率，没有请求时为 0
+func rate(errors, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(errors) / float64(total)
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCounter 可以手动增加的 5xx 响应数和请求数
+type fakeCounter struct {
+	mux           sync.Mutex
+	errors, total int64
+}
+
+func (c *fakeCounter) add(errors, total int64) {
+	c.mux.Lock()
+	c.errors += errors
+	c.total += total
+	c.mux.Unlock()
+}
+
+func (c *fakeCounter) count() (errors, total int64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.errors, c.total
+}
+
+// testDiff [server] 只在启动时读取，其他配置项都可以热加载
+func testDiff(old, new map[string]interface{}) (restart []string, reload bool) {
+	for key := range mergeKeys(old, new) {
+		if reflect.DeepEqual(old[key], new[key]) {
+			continue
+		}
+		if key == "server" {
+			restart = append(restart, key)
+		} else {
+			reload = true
+		}
+	}
+	return restart, reload
+}
+
+func mergeKeys(a, b map[string]interface{}) map[string]bool {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
+
+// testHistory 用 content 作为配置文件创建版本历史，拒绝 access.rules 为 "bad" 的配置
+type testHistory struct {
+	*History
+	t       *testing.T
+	file    string
+	audit   string
+	counter *fakeCounter
+}
+
+func newTestHistory(t *testing.T, cfg HistoryConfig, content string) *testHistory {
+	t.Helper()
+	dir := t.TempDir()
+	th := &testHistory{t: t, file: filepath.Join(dir, "cfg.toml"), audit: filepath.Join(dir, "audit.log"), counter: &fakeCounter{}}
+	if err := ioutil.WriteFile(th.file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(th.file, nil); err != nil {
+		t.Fatal(err)
+	}
+	validate := func() error {
+		if RuntimeViper.GetString("access.rules") == "bad" {
+			return errors.New("access.rules: bad rule")
+		}
+		return nil
+	}
+	cfg.AuditLog = th.audit
+	h, err := NewHistory(cfg, validate, th.counter.count, testDiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.tick = 5 * time.Millisecond
+	t.Cleanup(func() {
+		h.mux.Lock()
+		h.endProbation()
+		h.mux.Unlock()
+		h.audit.Close()
+	})
+	th.History = h
+	return th
+}
+
+// edit 改写配置文件并通知版本历史
+func (th *testHistory) edit(content string) {
+	th.t.Helper()
+	if err := ioutil.WriteFile(th.file, []byte(content), 0644); err != nil {
+		th.t.Fatal(err)
+	}
+	th.fileChanged(th.file)
+}
+
+// actions 审计日志中的 action
+func (th *testHistory) actions() []string {
+	th.t.Helper()
+	data, err := ioutil.ReadFile(th.audit)
+	if err != nil {
+		th.t.Fatal(err)
+	}
+	var actions []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			th.t.Fatal(err)
+		}
+		actions = append(actions, e.Action)
+	}
+	return actions
+}
+
+func (th *testHistory) currentID() int {
+	th.mux.Lock()
+	defer th.mux.Unlock()
+	return th.current.ID
+}
+
+const (
+	configV1 = "[server]\nport = 8080\n[access]\nrules = \"v1\"\n"
+	configV2 = "[server]\nport = 8080\n[access]\nrules = \"v2\"\n"
+	configV3 = "[server]\nport = 8080\n[access]\nrules = \"v3\"\n"
+)
+
+// 试用期内错误率升高时自动回滚到上一个版本
+func TestHistoryAutoRollback(t *testing.T) {
+	th := newTestHistory(t, HistoryConfig{Probation: time.Minute, MinRequests: 10}, configV1)
+	th.counter.add(1, 100)
+	th.edit(configV2)
+	if id := th.currentID(); id != 2 {
+		t.Fatalf("current version = %d, want 2", id)
+	}
+
+	th.counter.add(5, 10)
+	deadline := time.Now().Add(time.Second)
+	for th.currentID() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if id := th.currentID(); id != 1 {
+		t.Fatalf("current version = %d after errors during probation, want rollback to 1", id)
+	}
+	if got := RuntimeViper.GetString("access.rules"); got != "v1" {
+		t.Errorf("access.rules = %q after rollback, want v1", got)
+	}
+	want := []string{"loaded", "applied", "auto_rollback"}
+	if got := th.actions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("audit actions = %v, want %v", got, want)
+	}
+	th.mux.Lock()
+	status := th.versions[1].Status
+	th.mux.Unlock()
+	if status != StatusRolledBack {
+		t.Errorf("version 2 status = %s, want %s", status, StatusRolledBack)
+	}
+}
+
+// 错误率没有升高时试用期结束后确认新版本
+func TestHistoryProbationConfirmed(t *testing.T) {
+	th := newTestHistory(t, HistoryConfig{Probation: 50 * time.Millisecond, MinRequests: 10}, configV1)
+	th.counter.add(10, 100)
+	th.edit(configV2)
+	th.counter.add(1, 100)
+	time.Sleep(200 * time.Millisecond)
+	if id := th.currentID(); id != 2 {
+		t.Fatalf("current version = %d, want 2", id)
+	}
+	want := []string{"loaded", "applied", "confirmed"}
+	if got := th.actions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("audit actions = %v, want %v", got, want)
+	}
+}
+
+// 手动回滚到保留的任意版本
+func TestHistoryRollback(t *testing.T) {
+	th := newTestHistory(t, HistoryConfig{Size: 2}, configV1)
+	th.edit(configV2)
+	th.edit(configV3)
+
+	if _, err := th.Rollback(1, "test"); err == nil {
+		t.Error("rolled back to version 1, which is no longer retained")
+	}
+	if _, err := th.Rollback(3, "test"); err == nil {
+		t.Error("rolled back to the current version")
+	}
+	v, err := th.Rollback(2, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ID != 2 || th.currentID() != 2 {
+		t.Errorf("current version = %d, want 2", th.currentID())
+	}
+	if got := RuntimeViper.GetString("access.rules"); got != "v2" {
+		t.Errorf("access.rules = %q after rollback, want v2", got)
+	}
+	want := []string{"loaded", "applied", "applied", "rollback"}
+	if got := th.actions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("audit actions = %v, want %v", got, want)
+	}
+}
+
+// 校验失败的配置不生效，恢复当前版本，同一个内容只记录一次
+func TestHistoryRejected(t *testing.T) {
+	th := newTestHistory(t, HistoryConfig{}, configV1)
+	bad := "[server]\nport = 8080\n[access]\nrules = \"bad\"\n"
+	th.edit(bad)
+	th.edit(bad)
+	if id := th.currentID(); id != 1 {
+		t.Errorf("current version = %d, want 1", id)
+	}
+	if got := RuntimeViper.GetString("access.rules"); got != "v1" {
+		t.Errorf("access.rules = %q after a rejected edit, want v1", got)
+	}
+	want := []string{"loaded", "rejected"}
+	if got := th.actions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("audit actions = %v, want %v", got, want)
+	}
+}
+
+// 只修改启动时读取的配置项时记录 restart_required，不产生新版本，也不进入试用期
+func TestHistoryRestartRequired(t *testing.T) {
+	th := newTestHistory(t, HistoryConfig{Probation: time.Minute}, configV1)
+	restartOnly := "[server]\nport = 9090\n[access]\nrules = \"v1\"\n"
+	th.edit(restartOnly)
+	th.edit(restartOnly)
+	th.mux.Lock()
+	probation := th.stopProbation != nil
+	th.mux.Unlock()
+	if id := th.currentID(); id != 1 || probation {
+		t.Errorf("current version = %d probation = %v, want version 1 without probation", id, probation)
+	}
+	if got := RuntimeViper.GetInt("server.port"); got != 8080 {
+		t.Errorf("server.port = %d, want the running value 8080", got)
+	}
+
+	// 同时修改了可以热加载的配置项时正常应用
+	th.edit("[server]\nport = 9090\n[access]\nrules = \"v2\"\n")
+	if id := th.currentID(); id != 2 {
+		t.Errorf("current version = %d, want 2", id)
+	}
+	want := []string{"loaded", "restart_required", "restart_required", "applied"}
+	if got := th.actions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("audit actions = %v, want %v", got, want)
+	}
+}
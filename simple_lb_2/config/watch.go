@@ -0,0 +1,66 @@
+package config
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce 一次保存可能产生多个事件，等事件停止这么久之后再回调
+const watchDebounce = 100 * time.Millisecond
+
+// WatchFiles 监听 files 的改变，事件停止 watchDebounce 之后调用 onChange
+// 监听的是文件所在的目录，编辑器先写临时文件再改名、Kubernetes 替换 ..data 符号链接更新 ConfigMap 和 Secret 都能触发。
+// 监听在后台运行，返回的错误表示无法开始监听
+func WatchFiles(files []string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	paths := make(map[string]bool, len(files))
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		path, err := filepath.Abs(f)
+		if err != nil {
+			_ = watcher.Close()
+			return err
+		}
+		paths[path] = true
+		dirs[filepath.Dir(path)] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// Kubernetes 通过替换目录中的符号链接更新文件，事件中的文件名和监听的不同
+				if paths[filepath.Clean(event.Name)] || strings.HasPrefix(filepath.Base(event.Name), "..") {
+					debounce = time.After(watchDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("watch %s: %s", strings.Join(files, ", "), err)
+			case <-debounce:
+				debounce = nil
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"loadbalancer"
+	"simple_lb_2/config"
+)
+
+// CredentialConfig 注入到转发给后端池的请求中的一个请求头，值从文件或者环境变量读取，不写在配置文件中
+type CredentialConfig struct {
+	// Header 请求头名称，默认为 Authorization
+	Header string `mapstructure:"header"`
+	// File 保存值的文件，文件改变后自动重新读取，和 Env 二选一
+	File string `mapstructure:"file"`
+	// Env 保存值的环境变量
+	Env string `mapstructure:"env"`
+	// Scheme bearer 在值前面加上 "Bearer "；basic 的值为 user:password，编码为 Basic 认证；为空时原样使用
+	Scheme string `mapstructure:"scheme"`
+}
+
+// credentials 一个后端池的凭据，文件改变时整体替换
+type credentials struct {
+	pool    string
+	cfgs    []CredentialConfig
+	headers atomic.Value
+}
+
+// newCredentials 读取后端池 pool 的凭据，读取失败时返回错误；有来自文件的凭据时监听文件的改变
+// 返回的 HeaderSource 用于 loadbalancer.WithHeaders，没有配置凭据时返回 nil
+func newCredentials(pool string, cfgs []CredentialConfig) (loadbalancer.HeaderSource, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	c := &credentials{pool: pool, cfgs: cfgs}
+	headers, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.headers.Store(headers)
+	log.Printf("credentials %s: %d headers loaded\n", pool, len(headers))
+
+	var files []string
+	for _, cfg := range cfgs {
+		if cfg.File != "" {
+			files = append(files, cfg.File)
+		}
+	}
+	// 密钥轮换后重新读取，读取失败时继续使用原来的凭据
+	if len(files) > 0 {
+		if err := config.WatchFiles(files, c.reload); err != nil {
+			log.Printf("credentials %s: %s\n", pool, err)
+		}
+	}
+	return func() http.Header {
+		return c.headers.Load().(http.Header)
+	}, nil
+}
+
+// load 读取所有凭据
+func (c *credentials) load() (http.Header, error) {
+	headers := make(http.Header, len(c.cfgs))
+	for _, cfg := range c.cfgs {
+		value, err := credentialValue(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("credentials %s: %s", c.pool, err)
+		}
+		headers.Set(credentialHeader(cfg), value)
+	}
+	return headers, nil
+}
+
+// reload 重新读取凭据，读取失败时继续使用原来的凭据
+func (c *credentials) reload() {
+	headers, err := c.load()
+	if err != nil {
+		log.Printf("%s, keep using the previous credentials\n", err)
+		return
+	}
+	c.headers.Store(headers)
+	log.Printf("credentials %s: %d headers reloaded\n", c.pool, len(headers))
+}
+
+// credentialHeader 凭据注入的请求头名称
+func credentialHeader(cfg CredentialConfig) string {
+	if cfg.Header == "" {
+		return "Authorization"
+	}
+	return http.CanonicalHeaderKey(cfg.Header)
+}
+
+// credentialValue 读取凭据并按 Scheme 格式化
+func credentialValue(cfg CredentialConfig) (string, error) {
+	var value string
+	switch {
+	case cfg.File != "":
+		data, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return "", err
+		}
+		value = strings.TrimSpace(string(data))
+	case cfg.Env != "":
+		v, ok := os.LookupEnv(cfg.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", cfg.Env)
+		}
+		value = strings.TrimSpace(v)
+	default:
+		return "", fmt.Errorf("%s: file or env is required", credentialHeader(cfg))
+	}
+	if value == "" {
+		return "", fmt.Errorf("%s: value is empty", credentialHeader(cfg))
+	}
+
+	switch cfg.Scheme {
+	case "":
+		return value, nil
+	case "bearer":
+		return "Bearer " + value, nil
+	case "basic":
+		if !strings.Contains(value, ":") {
+			return "", fmt.Errorf("%s: basic credentials must be user:password", credentialHeader(cfg))
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(value)), nil
+	default:
+		return "", fmt.Errorf("%s: unknown scheme %q", credentialHeader(cfg), cfg.Scheme)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"loadbalancer"
+	"simple_lb_2/config"
+)
+
+// startDiscovery 按配置开启服务发现，发现的后端和静态配置的后端合并到 pool 中
+func startDiscovery(pool *loadbalancer.ServerPool, defaults loadbalancer.BackendSpec) {
+	var cfgs []loadbalancer.DiscoveryConfig
+	if err := config.RuntimeViper.UnmarshalKey("discovery", &cfgs); err != nil {
+		log.Fatal(err)
+	}
+	for i, cfg := range cfgs {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("%s-%d", cfg.Type, i)
+		}
+		provider, err := loadbalancer.NewDiscoveryProvider(cfg, defaults)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Starting discovery %s\n", provider.Name())
+		go pool.RunDiscovery(context.Background(), provider)
+	}
+}
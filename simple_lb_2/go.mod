@@ -3,6 +3,12 @@ module simple_lb_2
 go 1.14
 
 require (
+	github.com/andybalholm/brotli v1.0.6
 	github.com/fsnotify/fsnotify v1.4.9
+	github.com/mitchellh/mapstructure v1.1.2
+	github.com/spf13/cast v1.3.0
 	github.com/spf13/viper v1.7.0
+	loadbalancer v0.0.0
 )
+
+replace loadbalancer => ../loadbalancer
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"loadbalancer"
+)
+
+// Hedging 按路由配置请求对冲，只对 GET、HEAD 请求生效
+// 第一个后端超过 hedge_delay（或者 hedge_percentile 对应的延迟）还没有响应时，向另一个后端再发送一次，使用先返回的响应
+type Hedging struct {
+	hedgers map[string]*loadbalancer.Hedger
+}
+
+// NewHedging 为设置了 hedge 的路由创建对冲策略，指标在 simple_lb.hedge.<路由名称> 中
+func NewHedging(balancer *loadbalancer.LoadBalancer, routes []*Route) *Hedging {
+	h := &Hedging{hedgers: make(map[string]*loadbalancer.Hedger)}
+	for _, route := range routes {
+		if route == nil || !route.Hedge {
+			continue
+		}
+		h.hedgers[route.Name] = balancer.NewHedger(route.Name, loadbalancer.HedgeConfig{
+			Delay:         route.HedgeDelay,
+			Percentile:    route.HedgePercentile,
+			BudgetPercent: route.HedgeBudget,
+		})
+	}
+	return h
+}
+
+// Handler 把路由的对冲策略放入请求的 context，由 balancer 发送对冲请求
+func (h *Hedging) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hedger, ok := h.hedgers[GetRouteFromContext(r).Name]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(loadbalancer.WithHedger(r.Context(), hedger)))
+	})
+}
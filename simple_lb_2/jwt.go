@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"simple_lb_2/config"
+)
+
+// JWTConfig [jwt] JWT 校验配置，路由设置 jwt = true 时要求请求携带有效的 Bearer token
+type JWTConfig struct {
+	// JWKSFile 验证签名的 JWKS 文件，文件改变后自动重新加载
+	JWKSFile string `mapstructure:"jwks_file"`
+	// Issuers 允许的 iss，为空时不检查
+	Issuers []string `mapstructure:"issuers"`
+	// Audiences 允许的 aud，token 的 aud 中有一个在列表中即可，为空时不检查
+	Audiences []string `mapstructure:"audiences"`
+	// Leeway 检查 exp 和 nbf 时允许的时钟误差，默认为 30 秒
+	Leeway time.Duration `mapstructure:"leeway"`
+	// RequireExp 拒绝没有 exp 的 token，默认为 true。设置为 false 时没有 exp 的 token 永不过期
+	RequireExp *bool `mapstructure:"require_exp"`
+}
+
+// jwtError token 校验失败的原因，reason 用于指标
+type jwtError struct {
+	reason string
+	msg    string
+}
+
+func (e *jwtError) Error() string {
+	return e.msg
+}
+
+func newJWTError(reason, format string, args ...interface{}) *jwtError {
+	return &jwtError{reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
+// jwtClaimHeader 转发给后端的 claim
+type jwtClaimHeader struct {
+	claim  string
+	header string
+}
+
+// jwtRoute 路由的 JWT 要求
+type jwtRoute struct {
+	// required 必须存在的 claim，value 不为空时还要求值相等
+	required []jwtRequiredClaim
+	forward  []jwtClaimHeader
+}
+
+type jwtRequiredClaim struct {
+	claim string
+	value string
+}
+
+// jwtPolicy 编译后的配置，配置文件改变后整体替换
+type jwtPolicy struct {
+	cfg        JWTConfig
+	requireExp bool
+	routes     map[string]*jwtRoute
+}
+
+// Authenticator 在转发之前校验 JWT，没有 token 或者 token 无效的请求返回 401，不会到达后端
+// 校验通过后把配置的 claim 放到请求头中转发给后端，客户端自己带的同名请求头会被删除
+type Authenticator struct {
+	policy atomic.Value
+
+	keysMux sync.RWMutex
+	keys    []*jwtKey
+}
+
+// jwtStats JWT 校验指标，rejected 按原因统计
+var jwtStats = newStatsMap("jwt")
+
+var (
+	jwtVerified = new(expvar.Int)
+	jwtRejected = new(expvar.Map).Init()
+)
+
+func init() {
+	jwtStats.Set("verified", jwtVerified)
+	jwtStats.Set("rejected", jwtRejected)
+}
+
+// NewAuthenticator 读取 JWKS 文件并开始监听文件的改变
+func NewAuthenticator(cfg JWTConfig, routes []*Route) (*Authenticator, error) {
+	policy, err := newJWTPolicy(cfg, routes)
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{}
+	a.policy.Store(policy)
+	if cfg.JWKSFile == "" {
+		if len(policy.routes) > 0 {
+			return nil, errors.New("jwt.jwks_file is required by routes with jwt = true")
+		}
+		return a, nil
+	}
+	if a.keys, err = loadJWKS(cfg.JWKSFile); err != nil {
+		return nil, err
+	}
+	log.Printf("jwt: %d keys loaded from %s\n", len(a.keys), cfg.JWKSFile)
+	// 密钥轮换后重新加载，加载失败时继续使用原来的密钥
+	path := cfg.JWKSFile
+	if err := config.WatchFiles([]string{path}, func() { a.reloadJWKS(path) }); err != nil {
+		log.Printf("jwt: %s\n", err)
+	}
+	return a, nil
+}
+
+func newJWTPolicy(cfg JWTConfig, routes []*Route) (*jwtPolicy, error) {
+	if cfg.Leeway <= 0 {
+		cfg.Leeway = 30 * time.Second
+	}
+	p := &jwtPolicy{cfg: cfg, requireExp: cfg.RequireExp == nil || *cfg.RequireExp, routes: make(map[string]*jwtRoute)}
+	for _, route := range routes {
+		if route == nil || !route.JWT {
+			continue
+		}
+		jr := &jwtRoute{}
+		for _, s := range route.JWTRequiredClaims {
+			var rc jwtRequiredClaim
+			if i := strings.IndexByte(s, '='); i >= 0 {
+				rc = jwtRequiredClaim{claim: s[:i], value: s[i+1:]}
+			} else {
+				rc = jwtRequiredClaim{claim: s}
+			}
+			if rc.claim == "" {
+				return nil, fmt.Errorf("route %q: invalid jwt_required_claims %q", route.Name, s)
+			}
+			jr.required = append(jr.required, rc)
+		}
+		for _, s := range route.JWTForwardClaims {
+			i := strings.IndexByte(s, ':')
+			if i <= 0 || i == len(s)-1 {
+				return nil, fmt.Errorf("route %q: invalid jwt_forward_claims %q, use claim:Header", route.Name, s)
+			}
+			jr.forward = append(jr.forward, jwtClaimHeader{claim: s[:i], header: http.CanonicalHeaderKey(s[i+1:])})
+		}
+		p.routes[route.Name] = jr
+	}
+	return p, nil
+}
+
+// Reload 配置文件改变后重新读取 iss、aud 和路由的要求，修改 jwks_file 的路径需要重启
+func (a *Authenticator) Reload() {
+	var cfg JWTConfig
+	if err := config.RuntimeViper.UnmarshalKey("jwt", &cfg); err != nil {
+		log.Printf("jwt: %s\n", err)
+		return
+	}
+	var routes []*Route
+	if err := config.RuntimeViper.UnmarshalKey("routes", &routes); err != nil {
+		log.Printf("jwt: %s\n", err)
+		return
+	}
+	policy, err := newJWTPolicy(cfg, routes)
+	if err != nil {
+		log.Printf("jwt: %s\n", err)
+		return
+	}
+	if old := a.policy.Load().(*jwtPolicy); old.cfg.JWKSFile != cfg.JWKSFile {
+		log.Printf("jwt: jwks_file changed to %s, restart to take effect\n", cfg.JWKSFile)
+		policy.cfg.JWKSFile = old.cfg.JWKSFile
+	}
+	a.policy.Store(policy)
+}
+
+// reloadJWKS 重新加载 JWKS 文件，加载失败时继续使用原来的密钥
+func (a *Authenticator) reloadJWKS(path string) {
+	keys, err := loadJWKS(path)
+	if err != nil {
+		log.Printf("jwt: %s\n", err)
+		return
+	}
+	a.keysMux.Lock()
+	a.keys = keys
+	a.keysMux.Unlock()
+	log.Printf("jwt: %d keys loaded from %s\n", len(keys), path)
+}
+
+// Handler 校验路由要求的 JWT，需要放在 RouteTable.Handler 之后
+func (a *Authenticator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := a.policy.Load().(*jwtPolicy)
+		jr, ok := p.routes[GetRouteFromContext(r).Name]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := a.verify(p, jr, r.Header.Get("Authorization"), time.Now())
+		if err != nil {
+			jwtRejected.Add(err.reason, 1)
+			log.Printf("%s(%s) jwt rejected: %s\n", r.RemoteAddr, r.URL.Path, err.msg)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.msg))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		jwtVerified.Add(1)
+
+		// 复制请求再修改请求头，外层的处理器看到的仍然是客户端的请求
+		r = r.WithContext(r.Context())
+		r.Header = r.Header.Clone()
+		for _, f := range jr.forward {
+			r.Header.Del(f.header)
+			if v, ok := claims[f.claim]; ok {
+				r.Header.Set(f.header, claimString(v))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// verify 校验 Authorization 请求头中的 token，返回 token 的 claims
+func (a *Authenticator) verify(p *jwtPolicy, jr *jwtRoute, authorization string, now time.Time) (map[string]interface{}, *jwtError) {
+	if authorization == "" {
+		return nil, newJWTError("missing", "missing bearer token")
+	}
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "bearer ") {
+		return nil, newJWTError("malformed", "authorization is not a bearer token")
+	}
+	parts := strings.Split(strings.TrimSpace(authorization[7:]), ".")
+	if len(parts) != 3 {
+		return nil, newJWTError("malformed", "token must have three parts")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, newJWTError("malformed", "header: %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, newJWTError("malformed", "signature: %s", err)
+	}
+	// alg 为 none 的 token 没有签名，任何密钥都不会验证通过
+	signed := []byte(parts[0] + "." + parts[1])
+	if !a.verifySignature(header.Alg, header.Kid, signed, sig) {
+		return nil, newJWTError("signature", "invalid signature (alg %q, kid %q)", header.Alg, header.Kid)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, newJWTError("malformed", "claims: %s", err)
+	}
+	leeway := p.cfg.Leeway
+	exp, ok := numericClaim(claims, "exp")
+	if !ok && p.requireExp {
+		return nil, newJWTError("no_exp", "token has no exp")
+	}
+	if ok && now.After(time.Unix(exp, 0).Add(leeway)) {
+		return nil, newJWTError("expired", "token expired at %s", time.Unix(exp, 0).UTC().Format(time.RFC3339))
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(leeway).Before(time.Unix(nbf, 0)) {
+		return nil, newJWTError("not_yet_valid", "token is not valid before %s", time.Unix(nbf, 0).UTC().Format(time.RFC3339))
+	}
+	if len(p.cfg.Issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !containsString(p.cfg.Issuers, iss) {
+			return nil, newJWTError("issuer", "issuer %q is not allowed", iss)
+		}
+	}
+	if len(p.cfg.Audiences) > 0 && !audienceAllowed(claims["aud"], p.cfg.Audiences) {
+		return nil, newJWTError("audience", "audience is not allowed")
+	}
+	for _, rc := range jr.required {
+		v, ok := claims[rc.claim]
+		if !ok {
+			return nil, newJWTError("claims", "missing claim %q", rc.claim)
+		}
+		if rc.value != "" && !claimHasValue(v, rc.value) {
+			return nil, newJWTError("claims", "claim %q does not contain %q", rc.claim, rc.value)
+		}
+	}
+	return claims, nil
+}
+
+// verifySignature 用 kid 对应的密钥验证签名，token 没有 kid 时依次尝试所有密钥
+func (a *Authenticator) verifySignature(alg, kid string, signed, sig []byte) bool {
+	a.keysMux.RLock()
+	defer a.keysMux.RUnlock()
+	for _, k := range a.keys {
+		if kid != "" && k.kid != kid {
+			continue
+		}
+		if k.verify(alg, signed, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJWTPart 解码 base64url 编码的 JSON
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// numericClaim 返回秒数形式的时间 claim
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// audienceAllowed aud 可以是字符串或者字符串数组，有一个在 allowed 中即可
+func audienceAllowed(aud interface{}, allowed []string) bool {
+	switch v := aud.(type) {
+	case string:
+		return containsString(allowed, v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && containsString(allowed, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimHasValue 值相等，或者数组中包含这个值，或者空格分隔的字符串（例如 scope）中包含这个值
+func claimHasValue(claim interface{}, value string) bool {
+	switch v := claim.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if claimString(item) == value {
+				return true
+			}
+		}
+		return false
+	case string:
+		return v == value || containsString(strings.Fields(v), value)
+	default:
+		return claimString(v) == value
+	}
+}
+
+// claimString 把 claim 转换为请求头的值，数组用逗号连接，对象使用 JSON
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, claimString(item))
+		}
+		return strings.Join(items, ",")
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
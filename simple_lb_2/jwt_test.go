@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jwtTestKeys 测试用的私钥，Authenticator 中是对应的公钥
+type jwtTestKeys struct {
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	ed     ed25519.PrivateKey
+	secret []byte
+}
+
+func newJWTTestKeys(t *testing.T) (*jwtTestKeys, *Authenticator) {
+	t.Helper()
+	k := &jwtTestKeys{secret: []byte("0123456789abcdef0123456789abcdef")}
+	var err error
+	if k.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if k.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, k.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	a := &Authenticator{keys: []*jwtKey{
+		{kid: "rsa", key: &k.rsa.PublicKey},
+		{kid: "ec", key: &k.ec.PublicKey},
+		{kid: "ed", key: k.ed.Public()},
+		{kid: "hs", alg: "HS256", key: k.secret},
+	}}
+	return k, a
+}
+
+// sign 生成 token，kid 为空时 header 中没有 kid，alg 为 none 时没有签名
+func (k *jwtTestKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[len(alg)-3:]]
+	digest := func() []byte {
+		d := hash.New()
+		d.Write([]byte(signed))
+		return d.Sum(nil)
+	}
+	var sig []byte
+	var err error
+	switch alg[:2] {
+	case "no":
+	case "RS":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, hash, digest())
+	case "PS":
+		sig, err = rsa.SignPSS(rand.Reader, k.rsa, hash, digest(), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		r, s, e := ecdsa.Sign(rand.Reader, k.ec, digest())
+		sig, err = make([]byte, 64), e
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case "Ed":
+		sig = ed25519.Sign(k.ed, []byte(signed))
+	case "HS":
+		mac := hmac.New(hash.New, k.secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys, a := newJWTTestKeys(t)
+	now := time.Unix(1700000000, 0)
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix()}
+	}
+	with := func(extra map[string]interface{}) map[string]interface{} {
+		claims := valid()
+		for k, v := range extra {
+			if v == nil {
+				delete(claims, k)
+				continue
+			}
+			claims[k] = v
+		}
+		return claims
+	}
+	// hsWithRSAPublicKey 把 RSA 公钥当作 HMAC 密钥签名，alg 混淆攻击
+	hsWithRSAPublicKey := func() string {
+		pub, _ := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+		attacker := &jwtTestKeys{secret: pub}
+		return attacker.sign(t, "HS256", "rsa", valid())
+	}
+	// tamper 替换 token 的 claims，保留原来的签名
+	tamper := func(token string, claims map[string]interface{}) string {
+		parts := strings.Split(token, ".")
+		c, _ := json.Marshal(claims)
+		return parts[0] + "." + base64.RawURLEncoding.EncodeToString(c) + "." + parts[2]
+	}
+	noExp := false
+
+	tests := []struct {
+		name     string
+		token    string
+		cfg      JWTConfig
+		required []string
+		reason   string
+	}{
+		{name: "RS256", token: keys.sign(t, "RS256", "rsa", valid())},
+		{name: "RS512", token: keys.sign(t, "RS512", "rsa", valid())},
+		{name: "PS256", token: keys.sign(t, "PS256", "rsa", valid())},
+		{name: "ES256", token: keys.sign(t, "ES256", "ec", valid())},
+		{name: "EdDSA", token: keys.sign(t, "EdDSA", "ed", valid())},
+		{name: "HS256", token: keys.sign(t, "HS256", "hs", valid())},
+		{name: "no kid tries every key", token: keys.sign(t, "ES256", "", valid())},
+		{name: "ES384 with a P-256 key", token: keys.sign(t, "ES384", "ec", valid()), reason: "signature"},
+		{name: "HS512 with an HS256 key", token: keys.sign(t, "HS512", "hs", valid()), reason: "signature"},
+		{name: "alg none", token: keys.sign(t, "none", "", valid()), reason: "signature"},
+		{name: "HS256 with the RSA public key", token: hsWithRSAPublicKey(), reason: "signature"},
+		{name: "kid mismatch", token: keys.sign(t, "RS256", "ec", valid()), reason: "signature"},
+		{name: "unknown kid", token: keys.sign(t, "RS256", "other", valid()), reason: "signature"},
+		{name: "tampered claims", token: tamper(keys.sign(t, "RS256", "rsa", valid()), with(map[string]interface{}{"sub": "bob"})), reason: "signature"},
+		{name: "not a bearer token", token: "Basic YWxpY2U6c2VjcmV0", reason: "malformed"},
+		{name: "two parts", token: "a.b", reason: "malformed"},
+
+		{name: "expired within leeway", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"exp": now.Add(-20 * time.Second).Unix()}))},
+		{name: "expired", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), reason: "expired"},
+		{name: "expired with a longer leeway", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})),
+			cfg: JWTConfig{Leeway: 2 * time.Minute}},
+		{name: "nbf within leeway", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"nbf": now.Add(20 * time.Second).Unix()}))},
+		{name: "not yet valid", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), reason: "not_yet_valid"},
+		{name: "no exp", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"exp": nil})), reason: "no_exp"},
+		{name: "no exp allowed", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"exp": nil})), cfg: JWTConfig{RequireExp: &noExp}},
+
+		{name: "issuer", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"iss": "https://idp"})), cfg: JWTConfig{Issuers: []string{"https://idp"}}},
+		{name: "issuer not allowed", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"iss": "https://evil"})),
+			cfg: JWTConfig{Issuers: []string{"https://idp"}}, reason: "issuer"},
+		{name: "missing issuer", token: keys.sign(t, "HS256", "hs", valid()), cfg: JWTConfig{Issuers: []string{"https://idp"}}, reason: "issuer"},
+		{name: "audience", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"aud": "api"})), cfg: JWTConfig{Audiences: []string{"api"}}},
+		{name: "audience array", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"aud": []string{"web", "api"}})),
+			cfg: JWTConfig{Audiences: []string{"api"}}},
+		{name: "audience not allowed", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"aud": []string{"web"}})),
+			cfg: JWTConfig{Audiences: []string{"api"}}, reason: "audience"},
+
+		{name: "required claim", token: keys.sign(t, "HS256", "hs", valid()), required: []string{"sub"}},
+		{name: "missing required claim", token: keys.sign(t, "HS256", "hs", valid()), required: []string{"tenant"}, reason: "claims"},
+		{name: "claim value", token: keys.sign(t, "HS256", "hs", valid()), required: []string{"sub=alice"}},
+		{name: "claim value mismatch", token: keys.sign(t, "HS256", "hs", valid()), required: []string{"sub=bob"}, reason: "claims"},
+		{name: "claim array", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"roles": []string{"user", "admin"}})), required: []string{"roles=admin"}},
+		{name: "scope string", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"scope": "read write"})), required: []string{"scope=write"}},
+		{name: "scope string prefix", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"scope": "read write"})), required: []string{"scope=writ"},
+			reason: "claims"},
+		{name: "numeric claim", token: keys.sign(t, "HS256", "hs", with(map[string]interface{}{"level": 3})), required: []string{"level=3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newJWTPolicy(tt.cfg, []*Route{{Name: "api", JWT: true, JWTRequiredClaims: tt.required}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			authorization := tt.token
+			if tt.reason != "malformed" {
+				authorization = "Bearer " + tt.token
+			}
+			_, jwtErr := a.verify(p, p.routes["api"], authorization, now)
+			reason := ""
+			if jwtErr != nil {
+				reason = jwtErr.reason
+			}
+			if reason != tt.reason {
+				t.Errorf("verify rejected with %q (%v), want %q", reason, jwtErr, tt.reason)
+			}
+		})
+	}
+}
@@ -2,249 +2,381 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
-	"sync"
-	"sync/atomic"
+	"os"
 	"time"
 
+	"loadbalancer"
 	"simple_lb_2/config"
 )
 
-/*
-轮询（Round Robin）——均匀地分发流量负载，假设所有后端服务都具有同样的处理能力
-*/
-const (
-	Attempts int = iota
-	Retry
-)
-
-// Backend 定义一个结构体保存后端服务器状态信息
-type Backend struct {
-	URL          *url.URL
-	Alive        bool
-	mux          sync.RWMutex
-	ReverseProxy *httputil.ReverseProxy
-}
+// newHandler 按配置组装处理器，请求依次经过 URL 改写、路由匹配、访问控制、JWT 校验、请求体大小限制、限流、流量拆分、响应压缩、响应缓存、请求合并、自适应并发限制、
+// 流量镜像、请求对冲，最后由 balancer 转发
+func newHandler(balancer *loadbalancer.LoadBalancer, concurrency ConcurrencyLimiters) http.Handler {
+	var routes []*Route
+	if err := config.RuntimeViper.UnmarshalKey("routes", &routes); err != nil {
+		log.Fatal(err)
+	}
+	routeTable, err := NewRouteTable(routes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var rules []RateLimitRule
+	if err := config.RuntimeViper.UnmarshalKey("rate_limit", &rules); err != nil {
+		log.Fatal(err)
+	}
+	limiter, err := NewRateLimiter(rules)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-// SetAlive 设置服务可用
-func (b *Backend) SetAlive(alive bool) {
-	// 不同的 goroutine 会同时访问 Backend,使用 RWMutex 来串行化对 Alive 的访问操作
-	b.mux.Lock()
-	b.Alive = alive
-	b.mux.Unlock()
-}
+	var accessCfg AccessConfig
+	if err := config.RuntimeViper.UnmarshalKey("access", &accessCfg); err != nil {
+		log.Fatal(err)
+	}
+	access, err := NewAccessControl(accessCfg, routes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.OnChange(access.Reload)
 
-// IsAlive 服务可用返回true
-func (b *Backend) IsAlive() (alive bool) {
-	b.mux.RLock()
-	alive = b.Alive
-	b.mux.RUnlock()
-	return
-}
+	var jwtCfg JWTConfig
+	if err := config.RuntimeViper.UnmarshalKey("jwt", &jwtCfg); err != nil {
+		log.Fatal(err)
+	}
+	authenticator, err := NewAuthenticator(jwtCfg, routes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.OnChange(authenticator.Reload)
 
-// ServerPool 要一种方式来跟踪所有后端，以及一个计算器变量
-type ServerPool struct {
-	backends []*Backend
-	current  uint64
-}
+	var rewriteRules []RewriteRule
+	if err := config.RuntimeViper.UnmarshalKey("rewrite", &rewriteRules); err != nil {
+		log.Fatal(err)
+	}
+	rewriter, err := NewRewriter(rewriteRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.OnChange(rewriter.Reload)
 
+	var cacheCfg CacheConfig
+	if err := config.RuntimeViper.UnmarshalKey("cache", &cacheCfg); err != nil {
+		log.Fatal(err)
+	}
 
-// NextIndex 因为有很多客户端连接到负载均衡器，所以发生竟态条件是不可避免的。
-// 为了防止这种情况，我们需要使用 mutex 给 ServerPool 加锁。但这样做对性能会有影响，更何况我们并不是真想要给 ServerPool 加锁，我们只是想要更新计数器。
-// 最理想的解决方案是使用原子操作，Go 语言的 atomic 包为此提供了很好的支持
-func (s *ServerPool) NextIndex() int {
-	// 通过原子操作递增 current 的值，并通过对 slice 的长度取模来获得当前索引值。所以，返回值总是介于 0 和 slice 的长度之间，毕竟我们想要的是索引值，而不是总的计数值
-	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.backends)))
+	var coalesceCfg CoalesceConfig
+	if err := config.RuntimeViper.UnmarshalKey("coalesce", &coalesceCfg); err != nil {
+		log.Fatal(err)
+	}
+	var compressionCfg CompressionConfig
+	if err := config.RuntimeViper.UnmarshalKey("compression", &compressionCfg); err != nil {
+		log.Fatal(err)
+	}
+	compressor, err := NewCompressor(compressionCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var mirrorCfg MirrorConfig
+	if err := config.RuntimeViper.UnmarshalKey("mirror", &mirrorCfg); err != nil {
+		log.Fatal(err)
+	}
+	mirror, err := NewMirror(mirrorCfg, routes, balancer.Pools())
+	if err != nil {
+		log.Fatal(err)
+	}
+	splitter, err := NewSplitter(routes, balancer.Pools())
+	if err != nil {
+		log.Fatal(err)
+	}
+	adminMux.HandleFunc("/split", splitter.WeightsHandler)
+	config.OnChange(splitter.Reload)
+
+	var handler http.Handler = balancer
+	// 对冲请求由 balancer 发送，镜像和并发限制只计算一次
+	handler = NewHedging(balancer, routes).Handler(handler)
+	// 只镜像真正转发给后端的请求，主请求的状态码和延迟用来和影子请求比较
+	handler = mirror.Handler(handler)
+	if concurrency != nil {
+		handler = concurrency.Handler(handler)
+	}
+	// 合并后的请求只占用一个并发额度
+	handler = NewCoalescer(coalesceCfg).Handler(handler)
+	// 缓存命中的请求不占用后端的并发额度
+	if cacheCfg.Enabled {
+		cache := NewResponseCache(cacheCfg)
+		adminMux.HandleFunc("/cache/stats", cache.StatsHandler)
+		adminMux.HandleFunc("/cache/purge", cache.PurgeHandler)
+		handler = cache.Handler(handler)
+	}
+	// 缓存保存的是未压缩的响应，每次返回时按客户端支持的算法压缩
+	handler = compressor.Handler(handler)
+	// 缓存和请求合并按版本区分，选择版本要在它们之前
+	handler = splitter.Handler(handler)
+	handler = limiter.Handler(handler)
+	// 请求体的大小在读取请求体的处理器之前限制
+	handler = NewBodyLimiter(config.RuntimeViper.GetInt64("server.max_body_bytes"), routes).Handler(handler)
+	// 没有通过认证的请求不占用限流额度
+	handler = authenticator.Handler(handler)
+	// 被拒绝的请求不占用限流额度
+	handler = access.Handler(handler)
+	handler = routeTable.Handler(handler)
+	// 路由按改写后的路径匹配，重定向的请求不会到达后端
+	handler = rewriter.Handler(handler)
+	return countRequests(handler)
 }
 
-// GetNextPeer 获取下一个可用服务器
-func (s *ServerPool) GetNextPeer() *Backend {
-	// 遍历后端列表，找到可用服务器
-	next := s.NextIndex()
-	// log.Println("next ", next)
-	// 从next开始遍历
-	l := len(s.backends) + next
-	// log.Println("l ", l)
-	for i := next; i < l; i++ {
-		// 通过取模运算获取索引
-		idx := i % len(s.backends)
-		// log.Println("idx ", idx)
-		//如果找到一个可用服务器
-		if s.backends[idx].IsAlive() {
-			if i != next {
-				// 标记当前可用服务器
-				atomic.StoreUint64(&s.current, uint64(idx))
-			}
-
-			return s.backends[idx]
+// loadL4Pool 从配置文件读取四层负载均衡的后端列表，section 为 udp 或 tcp
+func loadL4Pool(section string) *loadbalancer.ServerPool {
+	pool := loadbalancer.NewServerPool(section)
+	for _, tok := range config.RuntimeViper.GetStringSlice(section + ".proxy_pass") {
+		// 和七层后端的格式相同，max_conns 限制的是会话数或者连接数
+		spec, err := loadbalancer.ParseBackendSpec(tok, loadbalancer.BackendSpec{})
+		if err != nil {
+			log.Fatal(err)
 		}
-
+		pool.AddBackend(loadbalancer.NewBackend(spec))
+		log.Printf("Configured %s server: %s\n", section, spec.URL)
 	}
-	return nil
+	if len(pool.Backends()) == 0 {
+		log.Fatalf("Please provide one or more %s backends to load balance", section)
+	}
+	return pool
 }
 
-// HealthCheck 被动模式，遍历所有服务并并标记可用状态
-func (s *ServerPool) HealthCheck() {
-	for _, b := range s.backends {
-		status := "up"
-
-		alive := isBackendalive(b.URL)
+// startUDPProxy 从配置文件读取 UDP 后端并开启 UDP 负载均衡
+func startUDPProxy(addr string) {
+	udpPool := loadL4Pool("udp")
 
-		b.SetAlive(alive)
-		if !alive {
-			status = "down"
-		}
-
-		log.Printf("%s[%s]\n", b.URL, status)
+	idleTimeout := config.RuntimeViper.GetDuration("udp.idle_timeout")
+	if idleTimeout <= 0 {
+		idleTimeout = 60 * time.Second
 	}
+	proxy := NewUDPProxy(udpPool, idleTimeout, config.RuntimeViper.GetInt("udp.max_sessions"))
+	go udpPool.RunHealthCheck(context.Background(), 20*time.Second)
+	go func() {
+		log.Printf("UDP Load Balancer started at %s\n", addr)
+		if err := proxy.ListenAndServe(addr); err != nil {
+			log.Fatal(err)
+		}
+	}()
 }
 
-// AddBackend 添加服务到ServerPool
-func (s *ServerPool) AddBackend(backend *Backend) {
-	s.backends = append(s.backends, backend)
+// startTCPProxy 从配置文件读取 TCP 后端并开启 TCP 负载均衡
+func startTCPProxy(addr string) {
+	tcpPool := loadL4Pool("tcp")
+
+	l, err := listen(addr, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxy := NewTCPProxy(tcpPool, config.RuntimeViper.GetBool("tcp.send_proxy_v2"), config.RuntimeViper.GetDuration("tcp.idle_timeout"))
+	go tcpPool.RunHealthCheck(context.Background(), 20*time.Second)
+	go func() {
+		log.Printf("TCP Load Balancer started at %s\n", addr)
+		if err := proxy.Serve(l); err != nil {
+			log.Fatal(err)
+		}
+	}()
 }
 
-// MarkBackendStatus 标记服务状态
-func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
-	for _, b := range s.backends {
-		if b.URL.String() == backendUrl.String() {
-			b.SetAlive(alive)
-			break
+// listen 监听 TCP 地址，开启 proxy_protocol 时接收受信任来源发送的 PROXY protocol 协议头
+// limits 不为 nil 时限制连接总数和每个 IP 的连接数，开启 proxy_protocol 时按协议头中的客户端地址限制每个 IP 的连接数
+func listen(addr string, limits *loadbalancer.ListenerConfig) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !config.RuntimeViper.GetBool("proxy_protocol.enabled") {
+		if limits != nil {
+			l = loadbalancer.NewConnLimitListener(l, *limits, newStatsMap("listener"))
 		}
+		return l, nil
 	}
-}
 
-// GetRetryFromContext 返回重试次数
-func GetRetryFromContext(r *http.Request) int {
-	if retry, ok := r.Context().Value(Retry).(int); ok {
-		return retry
+	var stats *expvar.Map
+	if limits != nil {
+		// 连接总数按直接连接计数，解析协议头之前检查
+		stats = newStatsMap("listener")
+		l = loadbalancer.NewConnLimitListener(l, loadbalancer.ListenerConfig{MaxConns: limits.MaxConns}, stats)
+	}
+	pl, err := NewProxyProtoListener(l, config.RuntimeViper.GetStringSlice("proxy_protocol.trusted_cidrs"))
+	if err != nil {
+		_ = l.Close()
+		return nil, err
 	}
-	return 0
+	if limits == nil || limits.MaxConnsPerIP <= 0 {
+		return pl, nil
+	}
+	cl := loadbalancer.NewConnLimitListener(pl, loadbalancer.ListenerConfig{MaxConnsPerIP: limits.MaxConnsPerIP}, stats)
+	// 上游负载均衡没有发送协议头的连接（例如健康检查）来自它自己的地址，不按 IP 限制
+	cl.Exempt = pl.trusted
+	return cl, nil
 }
 
-// GetAttemptsFromContext 返回尝试次数
-func GetAttemptsFromContext(r *http.Request) int {
-	if attempts, ok := r.Context().Value(Attempts).(int); ok {
-		return attempts
+// 测试simplelb.exe
+func main() {
+	// simple_lb_2 validate <file> 只检查配置文件，用于部署前确认配置是否正确
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
 	}
-	return 1
-}
 
-// lb对接收到的请求 进行负载均衡
-func lb(w http.ResponseWriter, r *http.Request) {
+	var configPath string
+	var sets setFlags
+	flag.StringVar(&configPath, "config", "", "Config file (toml, yaml or json), default is cfg.* in /etc/proxy/simple_lb/ or ./config/")
+	flag.Var(&sets, "set", "Override a config value, e.g. -set server.port=8080, can be repeated")
+	flag.Parse()
 
-	// 限制重试次数最大为3
-	attempts := GetAttemptsFromContext(r)
-	if attempts > 3 {
-		log.Printf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
-		http.Error(w, "Service not available", http.StatusServiceUnavailable)
-		return
+	// 环境变量和 -set 覆盖配置文件中的值，校验失败时列出所有错误并退出
+	if err := loadConfig(configPath, sets); err != nil {
+		if _, ok := err.(ConfigErrors); ok {
+			log.Fatalf("invalid config %s:\n%s", config.RuntimeViper.ConfigFileUsed(), err)
+		}
+		log.Fatal(err)
 	}
-
-	peer := serverPool.GetNextPeer()
-	log.Println("下一个peer ", peer)
-	if peer != nil {
-		peer.ReverseProxy.ServeHTTP(w, r)
-		return
+	// 配置文件改变后先校验，校验失败的配置不会生效。生效的配置保留在版本历史中，试用期内错误率升高时自动回滚
+	var historyCfg config.HistoryConfig
+	if err := config.RuntimeViper.UnmarshalKey("history", &historyCfg); err != nil {
+		log.Fatal(err)
 	}
-	http.Error(w, "服务不可用", http.StatusServiceUnavailable)
-}
-
-// isBackendalive 被动模式 检测服务可用性，建立tcp连接判断后台服务是否可用
-func isBackendalive(u *url.URL) bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+	// 路由表只在启动时创建，改变路由名称和前缀的配置不会生效
+	var startupRoutes []*Route
+	if err := config.RuntimeViper.UnmarshalKey("routes", &startupRoutes); err != nil {
+		log.Fatal(err)
+	}
+	history, err := config.NewHistory(historyCfg, func() error { return validateReload(config.RuntimeViper, startupRoutes) }, requestErrors, configDiff)
 	if err != nil {
-		log.Println("Site unreachable, error: ", err)
-		return false
+		log.Fatal(err)
 	}
-	// 执行完操作后要关闭连接，避免给服务器造成额外的负担，否则服务器会一直维护连接
-	_ = conn.Close()
-	return true
-}
-
-// 每20秒检测一次执行一次健康检测，额外开启一个goroutine去执行此方法
-func healthCheck() {
-	t := time.NewTicker(time.Second * 20)
-	for {
-		select {
-		// <-t.C 每 20 秒返回一个值，select 会检测到这个事件。在没有 default case 的情况下，select 会一直等待，直到有满足条件的 case 被执行
-		case <-t.C:
-			log.Println("Starting health check...")
-			serverPool.HealthCheck()
-			log.Println("Health check completed")
-		}
+	adminMux.HandleFunc("/config/versions", history.VersionsHandler)
+	adminMux.HandleFunc("/config/rollback", history.RollbackHandler)
+	if err := config.Watch(history); err != nil {
+		log.Fatal(err)
 	}
-}
 
-var serverPool ServerPool
-
-// 测试simplelb.exe
-func main() {
 	// 从配置文件读取端口
 	port := config.RuntimeViper.GetInt("server.port")
 
 	// 从配置文件读取代理服务
 	servers := config.RuntimeViper.GetStringSlice("server.proxy_pass")
 
+	defaults := loadbalancer.BackendSpec{
+		MaxConns:  config.RuntimeViper.GetInt("server.max_conns"),
+		SlowStart: config.RuntimeViper.GetDuration("server.slow_start"),
+	}
+
+	// 负载均衡器所在的可用区和地域，所有后端池都按它选择就近的后端
+	var locality loadbalancer.Locality
+	if err := config.RuntimeViper.UnmarshalKey("locality", &locality); err != nil {
+		log.Fatal(err)
+	}
+	if err := locality.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	// 转发请求的连接配置，upstreams 没有设置的字段使用这里的值
+	var transport loadbalancer.TransportConfig
+	if err := config.RuntimeViper.UnmarshalKey("server.transport", &transport); err != nil {
+		log.Fatal(err)
+	}
+	specs := make([]*loadbalancer.BackendSpec, 0, len(servers))
 	for _, tok := range servers {
-		serverURL, err := url.Parse(tok)
+		spec, err := loadbalancer.ParseBackendSpec(tok, defaults)
 		if err != nil {
 			log.Fatal(err)
 		}
+		specs = append(specs, spec)
+	}
+	// 注入到转发给后端的请求中的凭据，健康检测使用相同的凭据
+	var credentialCfgs []CredentialConfig
+	if err := config.RuntimeViper.UnmarshalKey("server.credentials", &credentialCfgs); err != nil {
+		log.Fatal(err)
+	}
+	headers, err := newCredentials(loadbalancer.DefaultPool, credentialCfgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	balancer := loadbalancer.New(
+		loadbalancer.WithStats(stats),
+		loadbalancer.WithBackends(specs...),
+		loadbalancer.WithPoolOptions(
+			// 所有后端都达到连接上限时请求排队等待，queue_size 为 0 时直接返回 503
+			loadbalancer.WithQueue(config.RuntimeViper.GetInt("server.queue_size"), config.RuntimeViper.GetDuration("server.queue_timeout")),
+			loadbalancer.WithBackupThreshold(config.RuntimeViper.GetFloat64("server.backup_threshold")),
+			loadbalancer.WithLocality(locality),
+			loadbalancer.WithTransport(transport),
+			loadbalancer.WithHeaders(headers),
+			loadbalancer.WithHealthCheckPath(config.RuntimeViper.GetString("server.health_check_path")),
+		),
+	)
+
+	// 从服务发现获取后端，和静态配置的后端合并
+	startDiscovery(balancer.Pool(loadbalancer.DefaultPool), defaults)
+
+	// 路由通过名称引用的其他后端池
+	if err := loadUpstreams(balancer, defaults, locality, transport); err != nil {
+		log.Fatal(err)
+	}
 
-		proxy := httputil.NewSingleHostReverseProxy(serverURL)
-		//在处理当前请求时，如果发现当前的后端没有响应，就把它标记为已宕机,
-		//在发生错误时，ReverseProxy 会触发 ErrorHandler 回调函数，我们可以利用它来检查故障
-		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
-			log.Printf("[%s] %s\n", serverURL.Host, e.Error())
-			// 从context中获取重试次数
-			retries := GetRetryFromContext(request)
-			if retries < 3 {
-				select {
-				case <-time.After(10 * time.Millisecond):
-					ctx := context.WithValue(request.Context(), Retry, retries+1)
-					proxy.ServeHTTP(writer, request.WithContext(ctx))
-				}
-				return
-			}
-
-			// 3次重试后该服务设置为宕机
-			serverPool.MarkBackendStatus(serverURL, false)
-
-			// 同一个请求在尝试了几次后仍然失败，增加计数
-			attempts := GetAttemptsFromContext(request)
-			log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
-			ctx := context.WithValue(request.Context(), Attempts, attempts+1)
-			// 通过lb选择一个新的后端来处理请求
-			lb(writer, request.WithContext(ctx))
+	// 根据延迟和错误动态计算每个后端池可以承受的并发数，超过后直接返回 503
+	var concurrency ConcurrencyConfig
+	if err := config.RuntimeViper.UnmarshalKey("concurrency", &concurrency); err != nil {
+		log.Fatal(err)
+	}
+	var limiters ConcurrencyLimiters
+	if concurrency.Enabled {
+		var pools []string
+		for name := range balancer.Pools() {
+			pools = append(pools, name)
+		}
+		if limiters, err = NewConcurrencyLimiters(concurrency, pools); err != nil {
+			log.Fatal(err)
 		}
-
-		serverPool.AddBackend(&Backend{
-			URL:          serverURL,
-			Alive:        true,
-			ReverseProxy: proxy,
-		})
-		log.Printf("Configured server: %s\n", serverURL)
 	}
 
 	//创建一个http server，初始化服务器，并添加处理器
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
-		Handler: http.HandlerFunc(lb), // HandlerFunc 传给 http 服务器
+		Handler: newHandler(balancer, limiters), // 处理器传给 http 服务器
+	}
+	// 读取请求的超时时间和连接数限制，防止慢速客户端长时间占用连接
+	var listenerCfg loadbalancer.ListenerConfig
+	if err := config.RuntimeViper.UnmarshalKey("server.listener", &listenerCfg); err != nil {
+		log.Fatal(err)
+	}
+	listenerCfg.Apply(&server)
+
+	// 配置了 admin.listen 时开启管理端口，导出运行指标
+	if addr := config.RuntimeViper.GetString("admin.listen"); addr != "" {
+		startAdminServer(addr, listenerCfg)
 	}
 
+	stats.Set("backends", expvar.Func(balancer.Pool(loadbalancer.DefaultPool).Stats))
+
 	// 开启健康检测
-	go healthCheck()
+	go balancer.RunHealthCheck(context.Background())
+
+	// 配置了 udp.listen 时开启四层 UDP 负载均衡
+	if addr := config.RuntimeViper.GetString("udp.listen"); addr != "" {
+		startUDPProxy(addr)
+	}
+	// 配置了 tcp.listen 时开启四层 TCP 负载均衡
+	if addr := config.RuntimeViper.GetString("tcp.listen"); addr != "" {
+		startTCPProxy(addr)
+	}
+
+	l, err := listen(server.Addr, &listenerCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	log.Printf("Load Balancer started at :%d\n", port)
 	// 监听服务
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.Serve(l); err != nil {
 		log.Fatal(err)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+
+	"loadbalancer"
+)
+
+// stats 负载均衡器的运行指标，通过 expvar 在管理端口的 /debug/vars 上以 JSON 格式导出
+var stats = expvar.NewMap("simple_lb")
+
+// newStatsMap 创建一组指标，挂在 stats 下面
+func newStatsMap(name string) *expvar.Map {
+	m := new(expvar.Map).Init()
+	stats.Set(name, m)
+	return m
+}
+
+// requestStats 所有请求的数量和按状态码分类的响应数
+var requestStats = newStatsMap("requests")
+
+var (
+	requestsTotal   = new(expvar.Int)
+	responsesByCode = new(expvar.Map).Init()
+	// serverErrors 5xx 响应数，配置试用期内用来判断新配置是否导致错误增加
+	serverErrors = new(expvar.Int)
+)
+
+func init() {
+	requestStats.Set("total", requestsTotal)
+	requestStats.Set("responses", responsesByCode)
+}
+
+// countRequests 统计请求数和响应状态码，需要放在最外层
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := newStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+		status := rec.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestsTotal.Add(1)
+		responsesByCode.Add(fmt.Sprintf("%dxx", status/100), 1)
+		if status >= 500 {
+			serverErrors.Add(1)
+		}
+	})
+}
+
+// requestErrors 返回累计的 5xx 响应数和请求数
+func requestErrors() (errors, total int64) {
+	return serverErrors.Value(), requestsTotal.Value()
+}
+
+// adminMux 管理端口的路由，指标、缓存清理等管理接口都注册在这里，不对外暴露
+var adminMux = http.NewServeMux()
+
+func init() {
+	adminMux.Handle("/debug/vars", expvar.Handler())
+}
+
+// startAdminServer 开启管理端口，使用和代理端口相同的超时时间和请求头大小限制
+func startAdminServer(addr string, limits loadbalancer.ListenerConfig) {
+	server := http.Server{Addr: addr, Handler: adminMux}
+	limits.Apply(&server)
+	go func() {
+		log.Printf("Admin server started at %s\n", addr)
+		if err := server.ListenAndServe(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer"
+)
+
+// MirrorConfig 流量镜像配置，需要在路由上设置 mirror 指定影子池
+type MirrorConfig struct {
+	// Timeout 影子请求的超时时间
+	Timeout time.Duration `mapstructure:"timeout"`
+	// MaxInflight 同时进行的影子请求上限，超过时丢弃镜像，不影响客户端
+	MaxInflight int64 `mapstructure:"max_inflight"`
+	// MaxBodyBytes 请求体超过这个大小时不镜像，避免占用过多内存
+	MaxBodyBytes int64 `mapstructure:"max_body_bytes"`
+}
+
+// mirrorHopHeaders 逐跳请求头，不转发给影子池
+var mirrorHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// Mirror 把路由上的请求按比例复制一份，异步发送给影子池，用真实流量验证新服务
+// 影子请求在客户端的响应完成之后才发出，响应被丢弃，客户端不会因为影子池变慢或者出错
+type Mirror struct {
+	cfg   MirrorConfig
+	pools map[string]*loadbalancer.ServerPool
+
+	inflight int64
+
+	mirrored       *expvar.Int
+	dropped        *expvar.Int
+	skipped        *expvar.Int
+	errors         *expvar.Int
+	statusMatch    *expvar.Int
+	statusMismatch *expvar.Int
+	shadowLatency  *expvar.Int
+	primaryLatency *expvar.Int
+	shadowSlower   *expvar.Int
+	statusDiff     *expvar.Map
+}
+
+// mirrorStats 流量镜像指标
+var mirrorStats = newStatsMap("mirror")
+
+// NewMirror 创建流量镜像，检查路由引用的影子池是否存在
+func NewMirror(cfg MirrorConfig, routes []*Route, pools map[string]*loadbalancer.ServerPool) (*Mirror, error) {
+	for _, route := range routes {
+		if route.Mirror == "" {
+			continue
+		}
+		if _, ok := pools[route.Mirror]; !ok {
+			return nil, fmt.Errorf("route %q: unknown mirror upstream %q", route.Name, route.Mirror)
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.MaxInflight <= 0 {
+		cfg.MaxInflight = 100
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 1 << 20
+	}
+
+	m := &Mirror{
+		cfg:            cfg,
+		pools:          pools,
+		mirrored:       new(expvar.Int),
+		dropped:        new(expvar.Int),
+		skipped:        new(expvar.Int),
+		errors:         new(expvar.Int),
+		statusMatch:    new(expvar.Int),
+		statusMismatch: new(expvar.Int),
+		shadowLatency:  new(expvar.Int),
+		primaryLatency: new(expvar.Int),
+		shadowSlower:   new(expvar.Int),
+		statusDiff:     new(expvar.Map).Init(),
+	}
+	mirrorStats.Set("mirrored", m.mirrored)
+	mirrorStats.Set("dropped", m.dropped)
+	mirrorStats.Set("skipped", m.skipped)
+	mirrorStats.Set("errors", m.errors)
+	mirrorStats.Set("status_match", m.statusMatch)
+	mirrorStats.Set("status_mismatch", m.statusMismatch)
+	mirrorStats.Set("shadow_latency_ms_total", m.shadowLatency)
+	mirrorStats.Set("primary_latency_ms_total", m.primaryLatency)
+	mirrorStats.Set("shadow_slower", m.shadowSlower)
+	// 按 "主响应状态码->影子响应状态码" 统计不一致的次数
+	mirrorStats.Set("status_diff", m.statusDiff)
+	mirrorStats.Set("inflight", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&m.inflight)
+	}))
+	return m, nil
+}
+
+// Handler 在请求转发的同时记录请求体和响应状态码，响应完成后发出影子请求
+func (m *Mirror) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := GetRouteFromContext(r)
+		if route.Mirror == "" || !sampled(route.MirrorPercent) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// 协议升级的连接无法复制
+		if r.Header.Get("Upgrade") != "" {
+			m.skipped.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// 后续的处理器可能修改请求头，先保存一份
+		header := cloneHeader(r.Header)
+		var body *mirrorBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &mirrorBody{ReadCloser: r.Body, max: m.cfg.MaxBodyBytes}
+			r = r.WithContext(r.Context())
+			r.Body = body
+		}
+
+		rec := newStatusRecorder(w)
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		primary := time.Since(start)
+
+		// 请求体没有读完或者超过大小限制时，无法得到完整的请求
+		var payload []byte
+		if body != nil {
+			if !body.eof || body.truncated {
+				m.skipped.Add(1)
+				return
+			}
+			payload = body.buf.Bytes()
+		}
+		if atomic.AddInt64(&m.inflight, 1) > m.cfg.MaxInflight {
+			atomic.AddInt64(&m.inflight, -1)
+			m.dropped.Add(1)
+			return
+		}
+		status := rec.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		go func() {
+			defer atomic.AddInt64(&m.inflight, -1)
+			m.shadow(m.pools[route.Mirror], r, header, payload, status, primary)
+		}()
+	})
+}
+
+// shadow 发送影子请求并和主请求的结果比较
+func (m *Mirror) shadow(pool *loadbalancer.ServerPool, r *http.Request, header http.Header, payload []byte, primaryStatus int, primary time.Duration) {
+	// 客户端的请求已经结束，使用独立的 context
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.Timeout)
+	defer cancel()
+
+	peer, err := pool.AcquirePeer(ctx)
+	if err != nil {
+		m.dropped.Add(1)
+		return
+	}
+	defer pool.ReleasePeer(peer)
+
+	target := *peer.URL
+	target.Path = strings.TrimRight(peer.URL.Path, "/") + r.URL.Path
+	target.RawPath = ""
+	target.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequest(r.Method, target.String(), bytes.NewReader(payload))
+	if err != nil {
+		m.errors.Add(1)
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Host = r.Host
+	req.Header = header
+	for _, h := range mirrorHopHeaders {
+		req.Header.Del(h)
+	}
+	// 直接连接的是受信任的代理时，真实 IP 已经在代理传来的链中，像主请求一样追加对端地址；
+	// 否则请求头是客户端自己带的，可以伪造，只发送解析出的客户端 IP
+	if prior := req.Header.Get("X-Forwarded-For"); prior != "" && clientIP(r) != peerIP(r) {
+		req.Header.Set("X-Forwarded-For", prior+", "+peerIP(r))
+	} else {
+		req.Header.Set("X-Forwarded-For", clientIP(r))
+	}
+
+	m.mirrored.Add(1)
+	start := time.Now()
+	// 使用影子池的连接池，直接 RoundTrip 不跟随重定向，重定向的响应直接用于比较
+	resp, err := pool.Transport().RoundTrip(req)
+	if err != nil {
+		log.Printf("mirror %s(%s) %s\n", peer.URL.Host, r.URL.Path, err)
+		m.errors.Add(1)
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+
+	m.primaryLatency.Add(primary.Milliseconds())
+	m.shadowLatency.Add(latency.Milliseconds())
+	if latency > primary {
+		m.shadowSlower.Add(1)
+	}
+	if resp.StatusCode == primaryStatus {
+		m.statusMatch.Add(1)
+	} else {
+		m.statusMismatch.Add(1)
+		m.statusDiff.Add(fmt.Sprintf("%d->%d", primaryStatus, resp.StatusCode), 1)
+	}
+}
+
+// mirrorBody 在后端读取请求体的同时保存一份，用于影子请求
+type mirrorBody struct {
+	io.ReadCloser
+	max       int64
+	buf       bytes.Buffer
+	eof       bool
+	truncated bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.truncated {
+		if int64(b.buf.Len()+n) > b.max {
+			b.truncated = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// sampled 按百分比抽样，percent 为 0 时表示全部
+func sampled(percent float64) bool {
+	if percent <= 0 || percent >= 100 {
+		return true
+	}
+	return rand.Float64()*100 < percent
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer"
+)
+
+// PROXY protocol 用于在多级四层负载均衡之间传递真实的客户端地址
+// 规范见 https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+// proxyV2Signature v2 协议头固定的 12 字节签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1Prefix v1 协议头以 "PROXY " 开头
+var proxyV1Prefix = []byte("PROXY ")
+
+const (
+	// proxyV1MaxLength v1 协议头最大长度(包含 CRLF)
+	proxyV1MaxLength = 107
+	// proxyHeaderTimeout 读取协议头的超时时间，防止客户端连接后不发送数据
+	proxyHeaderTimeout = 5 * time.Second
+)
+
+// ProxyProtoListener 接收 PROXY protocol v1/v2 协议头的监听器
+// 只有来源地址属于受信任网段的连接才会解析协议头，其他连接原样返回
+type ProxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewProxyProtoListener 包装监听器，trustedCIDRs 为受信任的上游负载均衡网段
+func NewProxyProtoListener(l net.Listener, trustedCIDRs []string) (*ProxyProtoListener, error) {
+	trusted, err := parseCIDRs(trustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyProtoListener{Listener: l, trusted: trusted}, nil
+}
+
+// Accept 接收连接，受信任来源的连接包装成 proxyProtoConn
+func (l *ProxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !loadbalancer.IPInNets(loadbalancer.AddrIP(conn.RemoteAddr()), l.trusted) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn 在第一次读取或者获取地址时解析协议头
+// 解析放在连接自己的 goroutine 里进行，避免阻塞 Accept
+type proxyProtoConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr 返回协议头中的客户端地址，没有协议头时返回真实的对端地址
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr 返回协议头中的目标地址
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite 关闭底层连接的写端，TCP 转发依靠它实现半关闭
+func (c *proxyProtoConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readHeader 读取并解析协议头，受信任的来源也可以不发送协议头
+func (c *proxyProtoConn) readHeader() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	// 先读取一个字节，让 Peek 不会因为数据还没到达而提前返回
+	if _, err := c.reader.Peek(1); err != nil {
+		// 连接上没有任何数据，交给后续的 Read 处理
+		return
+	}
+	switch {
+	case c.hasPrefix(proxyV2Signature):
+		c.remoteAddr, c.localAddr, c.err = readProxyV2(c.reader)
+	case c.hasPrefix(proxyV1Prefix):
+		c.remoteAddr, c.localAddr, c.err = readProxyV1(c.reader)
+	}
+	if c.err != nil {
+		c.err = fmt.Errorf("proxy protocol: %s", c.err)
+	}
+}
+
+// hasPrefix 判断缓冲区是否以指定内容开头
+// 数据可能分多个 TCP 报文到达，前缀匹配的部分需要继续等待
+func (c *proxyProtoConn) hasPrefix(prefix []byte) bool {
+	for n := 1; n <= len(prefix); n++ {
+		buf, err := c.reader.Peek(n)
+		if err != nil || !bytes.Equal(buf, prefix[:n]) {
+			return false
+		}
+	}
+	return true
+}
+
+// readProxyV1 解析 v1 文本协议头，例如 "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// 上游无法获取客户端地址，使用真实的对端地址
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyV2 解析 v2 二进制协议头
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	// LOCAL 命令是上游负载均衡器自己的健康检查连接，使用真实的对端地址
+	if command == 0x0 {
+		return nil, nil, nil
+	}
+	if command != 0x1 {
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+
+	switch family {
+	case 0x11, 0x12: // TCP/UDP over IPv4
+		if len(payload) < 12 {
+			return nil, nil, errors.New("v2 header too short for IPv4")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}, nil
+	case 0x21, 0x22: // TCP/UDP over IPv6
+		if len(payload) < 36 {
+			return nil, nil, errors.New("v2 header too short for IPv6")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}, nil
+	default:
+		// UNSPEC 或者 unix socket，没有可用的客户端地址
+		return nil, nil, nil
+	}
+}
+
+// writeProxyV2 向上游写入 v2 协议头，告知后端真实的客户端地址
+func writeProxyV2(w io.Writer, src, dst net.Addr) error {
+	srcAddr, ok1 := src.(*net.TCPAddr)
+	dstAddr, ok2 := dst.(*net.TCPAddr)
+
+	header := make([]byte, 16, 16+36)
+	copy(header, proxyV2Signature)
+	// 版本 2，PROXY 命令
+	header[12] = 0x21
+
+	switch {
+	case ok1 && ok2 && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil:
+		header[13] = 0x11
+		binary.BigEndian.PutUint16(header[14:16], 12)
+		header = append(header, srcAddr.IP.To4()...)
+		header = append(header, dstAddr.IP.To4()...)
+		header = appendPort(header, srcAddr.Port)
+		header = appendPort(header, dstAddr.Port)
+	case ok1 && ok2:
+		header[13] = 0x21
+		binary.BigEndian.PutUint16(header[14:16], 36)
+		header = append(header, srcAddr.IP.To16()...)
+		header = append(header, dstAddr.IP.To16()...)
+		header = appendPort(header, srcAddr.Port)
+		header = appendPort(header, dstAddr.Port)
+	default:
+		// 地址类型未知时发送 LOCAL 命令，后端使用连接本身的地址
+		header[12] = 0x20
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+func appendPort(b []byte, port int) []byte {
+	return append(b, byte(port>>8), byte(port))
+}
+
+// parseCIDRs 解析网段列表，单个 IP 按 /32 或 /128 处理
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR %q", c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
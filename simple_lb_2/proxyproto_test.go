@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"loadbalancer"
+	"simple_lb_2/config"
+)
+
+// proxyV2Header 构造 v2 协议头，length 为协议头中声明的长度，可以和 payload 的实际长度不同
+func proxyV2Header(command, family byte, length int, payload []byte) []byte {
+	header := make([]byte, 16, 16+len(payload))
+	copy(header, proxyV2Signature)
+	header[12] = 0x20 | command
+	header[13] = family
+	binary.BigEndian.PutUint16(header[14:16], uint16(length))
+	return append(header, payload...)
+}
+
+// ipv4Payload 192.168.0.1:56324 -> 192.168.0.11:443
+var ipv4Payload = []byte{192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x01, 0xbb}
+
+func TestReadProxyV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		src     string
+		wantErr bool
+	}{
+		{name: "tcp4", input: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET /", src: "192.168.0.1:56324"},
+		{name: "tcp6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", src: "[2001:db8::1]:56324"},
+		{name: "unknown", input: "PROXY UNKNOWN\r\n"},
+		{name: "too long", input: "PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", wantErr: true},
+		{name: "no crlf", input: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n", wantErr: true},
+		{name: "bad port", input: "PROXY TCP4 192.168.0.1 192.168.0.11 70000 443\r\n", wantErr: true},
+		{name: "missing fields", input: "PROXY TCP4 192.168.0.1\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, _, err := readProxyV1(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readProxyV1(%q) succeeded, want an error", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := addrString(src); got != tt.src {
+				t.Errorf("src = %q, want %q", got, tt.src)
+			}
+		})
+	}
+}
+
+// v1 协议头最多读取 107 个字节，超过后不再继续读取
+func TestReadProxyV1StopsAtMaxLength(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 " + strings.Repeat("1", 200)))
+	if _, _, err := readProxyV1(r); err == nil {
+		t.Fatal("readProxyV1 succeeded, want an error")
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if consumed := len("PROXY TCP4 ") + 200 - len(rest); consumed != proxyV1MaxLength {
+		t.Errorf("consumed %d bytes, want %d", consumed, proxyV1MaxLength)
+	}
+}
+
+func TestReadProxyV2(t *testing.T) {
+	// 地址后面的 TLV 不解析，但是需要和地址一起跳过
+	tlv := []byte{0x04, 0x00, 0x02, 'o', 'k'}
+	tests := []struct {
+		name    string
+		input   []byte
+		src     string
+		wantErr bool
+	}{
+		{name: "ipv4", input: proxyV2Header(0x1, 0x11, 12, ipv4Payload), src: "192.168.0.1:56324"},
+		{name: "ipv4 with tlv", input: proxyV2Header(0x1, 0x11, 12+len(tlv), append(append([]byte{}, ipv4Payload...), tlv...)), src: "192.168.0.1:56324"},
+		{name: "local", input: proxyV2Header(0x0, 0x11, 12, ipv4Payload)},
+		{name: "unspec", input: proxyV2Header(0x1, 0x00, 0, nil)},
+		{name: "truncated header", input: proxyV2Header(0x1, 0x11, 12, nil)[:14], wantErr: true},
+		{name: "length overrun", input: proxyV2Header(0x1, 0x11, 12+len(tlv)+8, append(append([]byte{}, ipv4Payload...), tlv...)), wantErr: true},
+		{name: "short ipv4 address", input: proxyV2Header(0x1, 0x11, 8, ipv4Payload[:8]), wantErr: true},
+		{name: "unknown command", input: proxyV2Header(0x2, 0x11, 12, ipv4Payload), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append(append([]byte{}, tt.input...), "GET /"...)
+			r := bufio.NewReader(bytes.NewReader(data))
+			src, _, err := readProxyV2(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("readProxyV2 succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := addrString(src); got != tt.src {
+				t.Errorf("src = %q, want %q", got, tt.src)
+			}
+			// 协议头之后的数据原样交给应用层
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != "GET /" {
+				t.Errorf("remaining data = %q, want %q", rest, "GET /")
+			}
+		})
+	}
+}
+
+// 受信任的来源发送的协议头被解析，不受信任的来源发送的协议头原样交给应用层
+func TestProxyProtoListener(t *testing.T) {
+	header := "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+	tests := []struct {
+		name    string
+		trusted []string
+		remote  string
+		data    string
+	}{
+		{name: "trusted", trusted: []string{"127.0.0.1"}, remote: "192.168.0.1", data: "GET /"},
+		{name: "untrusted", trusted: []string{"10.0.0.0/8"}, remote: "127.0.0.1", data: header + "GET /"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			pl, err := NewProxyProtoListener(ln, tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = client.Write([]byte(header + "GET /"))
+			_ = client.Close()
+
+			conn, err := pl.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := loadbalancer.AddrIP(conn.RemoteAddr()).String(); got != tt.remote {
+				t.Errorf("RemoteAddr = %s, want %s", got, tt.remote)
+			}
+			data, _ := ioutil.ReadAll(conn)
+			if string(data) != tt.data {
+				t.Errorf("data = %q, want %q", data, tt.data)
+			}
+		})
+	}
+}
+
+// addrString 返回地址的字符串形式，nil 返回空字符串
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// 开启 PROXY protocol 时每个 IP 的连接数按协议头中的客户端地址计算，同一个上游负载均衡转发的不同客户端互不影响
+func TestListenPerIPAfterProxyProtocol(t *testing.T) {
+	config.RuntimeViper.Set("proxy_protocol.enabled", true)
+	config.RuntimeViper.Set("proxy_protocol.trusted_cidrs", []string{"127.0.0.1/32"})
+	t.Cleanup(func() {
+		config.RuntimeViper.Set("proxy_protocol.enabled", false)
+		config.RuntimeViper.Set("proxy_protocol.trusted_cidrs", []string{})
+	})
+	l, err := listen("127.0.0.1:0", &loadbalancer.ListenerConfig{MaxConns: 10, MaxConnsPerIP: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// connect 发送 src 的协议头，返回服务端读取第一个字节的错误
+	connect := func(src string) error {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = client.Close() })
+		_, _ = client.Write([]byte("PROXY TCP4 " + src + " 192.168.0.11 56324 443\r\nx"))
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+	if err := connect("192.168.0.1"); err != nil {
+		t.Fatalf("first client: %s", err)
+	}
+	if err := connect("192.168.0.2"); err != nil {
+		t.Errorf("second client through the same proxy: %s", err)
+	}
+	if err := connect("192.168.0.1"); err == nil {
+		t.Error("second connection from 192.168.0.1 was accepted")
+	}
+}
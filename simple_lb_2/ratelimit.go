@@ -0,0 +1,252 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitRule 限流规则
+type RateLimitRule struct {
+	// Name 规则名称，用于指标，默认为 <Key>#<规则序号>
+	Name string `mapstructure:"name"`
+	// Key 限流维度：ip 按客户端 IP，header:<Name> 按请求头(例如 API Key)，route 按路由
+	Key string `mapstructure:"key"`
+	// Route 只对指定路由生效，为空时对所有请求生效
+	Route string `mapstructure:"route"`
+	// Rate 每秒生成的令牌数
+	Rate float64 `mapstructure:"rate"`
+	// Burst 令牌桶容量，即允许的突发请求数
+	Burst int `mapstructure:"burst"`
+	// MaxKeys 最多保存多少个令牌桶，超过后淘汰最久没有访问的
+	MaxKeys int `mapstructure:"max_keys"`
+}
+
+// tokenBucket 令牌桶，按时间流逝补充令牌
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// limitResult 一次限流判断的结果
+type limitResult struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// reset 令牌桶恢复满的时间
+	reset time.Duration
+	// retryAfter 下一个令牌可用的时间
+	retryAfter time.Duration
+}
+
+// rateLimiter 一条规则对应的限流器
+// 令牌桶按 LRU 保存，数量有上限，防止大量不同的客户端耗尽内存
+type rateLimiter struct {
+	rule   RateLimitRule
+	header string
+
+	mux     sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+
+	allowed  *expvar.Int
+	rejected *expvar.Int
+	evicted  *expvar.Int
+}
+
+// newRateLimiter 创建第 index 条规则的限流器
+func newRateLimiter(index int, rule RateLimitRule) (*rateLimiter, error) {
+	if rule.Rate <= 0 || rule.Burst <= 0 {
+		return nil, fmt.Errorf("rate_limit %q: rate and burst must be positive", rule.Key)
+	}
+	l := &rateLimiter{
+		rule:    rule,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	switch {
+	case rule.Key == "ip" || rule.Key == "route":
+	case strings.HasPrefix(rule.Key, "header:") && len(rule.Key) > len("header:"):
+		l.header = http.CanonicalHeaderKey(strings.TrimPrefix(rule.Key, "header:"))
+	default:
+		return nil, fmt.Errorf("rate_limit: unknown key %q", rule.Key)
+	}
+	if l.rule.MaxKeys <= 0 {
+		l.rule.MaxKeys = 10000
+	}
+	if l.rule.Name == "" {
+		// 多条规则可能使用相同的 key，加上序号避免指标互相覆盖
+		l.rule.Name = fmt.Sprintf("%s#%d", rule.Key, index)
+	}
+
+	m := new(expvar.Map).Init()
+	l.allowed, l.rejected, l.evicted = new(expvar.Int), new(expvar.Int), new(expvar.Int)
+	m.Set("allowed", l.allowed)
+	m.Set("rejected", l.rejected)
+	m.Set("evicted", l.evicted)
+	m.Set("keys", expvar.Func(func() interface{} {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+		return l.lru.Len()
+	}))
+	rateLimitStats.Set(l.rule.Name, m)
+	return l, nil
+}
+
+// key 返回请求在这条规则下的限流 key，规则不适用时返回空字符串
+func (l *rateLimiter) key(r *http.Request) string {
+	route := GetRouteFromContext(r)
+	if l.rule.Route != "" && l.rule.Route != route.Name {
+		return ""
+	}
+	switch {
+	case l.header != "":
+		if v := r.Header.Get(l.header); v != "" {
+			return "header:" + v
+		}
+		// 没有携带请求头的客户端按 IP 限流，避免不带 API Key 就能绕过限制
+		return "ip:" + clientIP(r)
+	case l.rule.Key == "route":
+		return "route:" + route.Name
+	default:
+		return "ip:" + clientIP(r)
+	}
+}
+
+// take 从 key 对应的令牌桶中取一个令牌
+func (l *rateLimiter) take(key string, now time.Time) limitResult {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var b *tokenBucket
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*tokenBucket)
+		b.tokens = math.Min(float64(l.rule.Burst), b.tokens+now.Sub(b.last).Seconds()*l.rule.Rate)
+		b.last = now
+	} else {
+		if l.lru.Len() >= l.rule.MaxKeys {
+			// 淘汰最久没有访问的令牌桶，被淘汰的客户端下次访问时拿到一个满的令牌桶
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+			l.evicted.Add(1)
+		}
+		b = &tokenBucket{key: key, tokens: float64(l.rule.Burst), last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	res := limitResult{limit: l.rule.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.allowed = true
+	} else {
+		res.retryAfter = time.Duration((1 - b.tokens) / l.rule.Rate * float64(time.Second))
+	}
+	res.remaining = int(b.tokens)
+	res.reset = time.Duration((float64(l.rule.Burst) - b.tokens) / l.rule.Rate * float64(time.Second))
+	return res
+}
+
+// refund 归还 take 取走的一个令牌，用于后面的规则拒绝了请求的情况
+func (l *rateLimiter) refund(key string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if e, ok := l.buckets[key]; ok {
+		b := e.Value.(*tokenBucket)
+		b.tokens = math.Min(float64(l.rule.Burst), b.tokens+1)
+	}
+}
+
+// rateLimitStats 限流指标，每条规则一组
+var rateLimitStats = newStatsMap("ratelimit")
+
+// RateLimiter 按规则对请求限流，超过限制的请求返回 429
+type RateLimiter struct {
+	limiters []*rateLimiter
+}
+
+// NewRateLimiter 创建限流器
+func NewRateLimiter(rules []RateLimitRule) (*RateLimiter, error) {
+	rl := &RateLimiter{}
+	for i, rule := range rules {
+		l, err := newRateLimiter(i, rule)
+		if err != nil {
+			return nil, err
+		}
+		rl.limiters = append(rl.limiters, l)
+	}
+	return rl, nil
+}
+
+// Handler 限流中间件，需要放在 RouteTable.Handler 之后
+func (rl *RateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		// 响应头返回剩余额度最少的那条规则
+		var current *limitResult
+		// taken 已经取走令牌的规则，请求被后面的规则拒绝时归还，被拒绝的请求不消耗其他规则的额度
+		var taken []*rateLimiter
+		var takenKeys []string
+		for _, l := range rl.limiters {
+			key := l.key(r)
+			if key == "" {
+				continue
+			}
+			res := l.take(key, now)
+			if !res.allowed {
+				for i, t := range taken {
+					t.refund(takenKeys[i])
+				}
+				l.rejected.Add(1)
+				setRateLimitHeaders(w, res)
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.retryAfter)))
+				log.Printf("%s(%s) rate limited by %s\n", r.RemoteAddr, r.URL.Path, l.rule.Name)
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			taken = append(taken, l)
+			takenKeys = append(takenKeys, key)
+			if current == nil || res.remaining < current.remaining {
+				current = &res
+			}
+		}
+		for _, l := range taken {
+			l.allowed.Add(1)
+		}
+		if current != nil {
+			setRateLimitHeaders(w, *current)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setRateLimitHeaders 设置 RateLimit-* 响应头 (draft-ietf-httpapi-ratelimit-headers)
+func setRateLimitHeaders(w http.ResponseWriter, res limitResult) {
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(res.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.reset)))
+}
+
+// ceilSeconds 把时间向上取整到秒
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIP 返回客户端 IP，经过 AccessControl.Handler 的请求为按受信任的代理解析出的真实 IP，
+// 否则在上游代理后面所有客户端会共用代理地址的令牌桶
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(realClientIP).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 令牌按速率补充，最多补充到 burst，令牌不足时返回下一个令牌可用的时间
+func TestRateLimiterRefill(t *testing.T) {
+	l, err := newRateLimiter(0, RateLimitRule{Key: "ip", Rate: 2, Burst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	steps := []struct {
+		after     time.Duration
+		allowed   bool
+		remaining int
+		retry     time.Duration
+	}{
+		{after: 0, allowed: true, remaining: 1},
+		{after: 0, allowed: true, remaining: 0},
+		{after: 0, allowed: false, remaining: 0, retry: 500 * time.Millisecond},
+		{after: 250 * time.Millisecond, allowed: false, remaining: 0, retry: 250 * time.Millisecond},
+		{after: 500 * time.Millisecond, allowed: true, remaining: 0},
+		// 空闲很久之后令牌数不超过 burst
+		{after: time.Hour, allowed: true, remaining: 1},
+	}
+	for i, s := range steps {
+		res := l.take("ip:10.0.0.1", now.Add(s.after))
+		if res.allowed != s.allowed || res.remaining != s.remaining || res.retryAfter != s.retry {
+			t.Errorf("step %d: allowed=%v remaining=%d retryAfter=%s, want allowed=%v remaining=%d retryAfter=%s",
+				i, res.allowed, res.remaining, res.retryAfter, s.allowed, s.remaining, s.retry)
+		}
+	}
+	// 不同的 key 使用各自的令牌桶
+	if res := l.take("ip:10.0.0.2", now); !res.allowed || res.remaining != 1 {
+		t.Errorf("new key: allowed=%v remaining=%d, want a full bucket", res.allowed, res.remaining)
+	}
+}
+
+// 令牌桶数量达到 max_keys 时淘汰最久没有访问的
+func TestRateLimiterEvictsOldestKey(t *testing.T) {
+	l, err := newRateLimiter(0, RateLimitRule{Key: "ip", Rate: 1, Burst: 1, MaxKeys: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	l.take("a", now)
+	l.take("b", now)
+	l.take("a", now)
+	l.take("c", now)
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("least recently used key b was not evicted")
+	}
+	if _, ok := l.buckets["a"]; !ok {
+		t.Error("recently used key a was evicted")
+	}
+}
+
+// 被后面的规则拒绝的请求归还前面规则的令牌
+func TestRateLimiterRefundsEarlierRules(t *testing.T) {
+	rl, err := NewRateLimiter([]RateLimitRule{
+		{Name: "route", Key: "route", Rate: 0.001, Burst: 5},
+		{Name: "ip", Key: "ip", Rate: 0.001, Burst: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := rl.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), realClientIP, "10.0.0.1"))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusTooManyRequests {
+		t.Fatalf("status codes = %v, want [200 429 429]", codes)
+	}
+
+	route := rl.limiters[0]
+	b := route.buckets["route:"+defaultRoute.Name].Value.(*tokenBucket)
+	if b.tokens < 3.99 || b.tokens > 4.01 {
+		t.Errorf("route bucket has %.2f tokens, want 4 (rejected requests refunded)", b.tokens)
+	}
+	if route.allowed.Value() != 1 || rl.limiters[1].rejected.Value() != 2 {
+		t.Errorf("allowed=%d rejected=%d, want 1 and 2", route.allowed.Value(), rl.limiters[1].rejected.Value())
+	}
+}
+
+// 经过访问控制解析出的真实客户端 IP 优先于连接的对端地址
+func TestRateLimiterKeysOnRealClientIP(t *testing.T) {
+	l, err := newRateLimiter(0, RateLimitRule{Key: "ip", Rate: 1, Burst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:4000"
+	if key := l.key(req); key != "ip:127.0.0.1" {
+		t.Errorf("key = %q, want the peer address", key)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), realClientIP, "203.0.113.7"))
+	if key := l.key(req); key != "ip:203.0.113.7" {
+		t.Errorf("key = %q, want the real client IP", key)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// validateReload 校验改变后的配置，除了 validateConfig 的检查，路由的名称和前缀不能改变
+// 路由表只在启动时创建，访问控制和 JWT 的规则按路由名称热加载，改名、删除或者新增路由会让路由的规则不再生效
+func validateReload(v *viper.Viper, startup []*Route) error {
+	err := validateConfig(v)
+	errs, _ := err.(ConfigErrors)
+	if err != nil && errs == nil {
+		return err
+	}
+	var routes []*Route
+	if err := v.UnmarshalKey("routes", &routes); err != nil {
+		return err
+	}
+
+	type routeKey struct{ name, prefix string }
+	running := make(map[routeKey]bool, len(startup))
+	for _, route := range startup {
+		running[routeKey{route.Name, route.Prefix}] = true
+	}
+	kept := make(map[routeKey]bool, len(routes))
+	for i, route := range routes {
+		if route == nil {
+			continue
+		}
+		k := routeKey{route.Name, route.Prefix}
+		if !running[k] {
+			errs = append(errs, ConfigError{Key: fmt.Sprintf("routes[%d]", i),
+				Msg: fmt.Sprintf("route %q with prefix %q is not in the running route table, restart to add or rename routes", route.Name, route.Prefix)})
+		}
+		kept[k] = true
+	}
+	for _, route := range startup {
+		if !kept[routeKey{route.Name, route.Prefix}] {
+			errs = append(errs, ConfigError{Key: "routes",
+				Msg: fmt.Sprintf("route %q with prefix %q is missing, restart to remove routes", route.Name, route.Prefix)})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Key < errs[j].Key })
+	return errs
+}
+
+// configDiff 比较两份配置，实现 config.ConfigDiff
+// 可以热加载的只有 [access]、[jwt]（jwks_file 除外）、[[rewrite]] 和路由的 access、jwt、jwt_required_claims、jwt_forward_claims、split 的权重，
+// 其他配置项只在启动时读取，restart 返回其中改变了的配置项
+func configDiff(old, new map[string]interface{}) (restart []string, reload bool) {
+	oldCfg, oldReload, err := decodeSettings(old)
+	if err != nil {
+		return []string{err.Error()}, false
+	}
+	newCfg, newReload, err := decodeSettings(new)
+	if err != nil {
+		return []string{err.Error()}, false
+	}
+	return diffKeys("", reflect.ValueOf(oldCfg), reflect.ValueOf(newCfg), nil), !reflect.DeepEqual(oldReload, newReload)
+}
+
+// decodeSettings 解码 viper.AllSettings() 的值，把可以热加载的配置项移到 reload 中
+func decodeSettings(settings map[string]interface{}) (cfg, reload fileConfig, err error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return cfg, reload, err
+	}
+	if err := v.Unmarshal(&cfg); err != nil {
+		return cfg, reload, err
+	}
+
+	reload.Access, cfg.Access = cfg.Access, AccessConfig{}
+	reload.JWT, cfg.JWT = cfg.JWT, JWTConfig{JWKSFile: cfg.JWT.JWKSFile}
+	reload.JWT.JWKSFile = ""
+	reload.Rewrite, cfg.Rewrite = cfg.Rewrite, nil
+	for _, route := range cfg.Routes {
+		if route == nil {
+			continue
+		}
+		r := &Route{
+			Access:            route.Access,
+			JWT:               route.JWT,
+			JWTRequiredClaims: route.JWTRequiredClaims,
+			JWTForwardClaims:  route.JWTForwardClaims,
+		}
+		route.Access, route.JWT, route.JWTRequiredClaims, route.JWTForwardClaims = nil, false, nil, nil
+		split := route.Split
+		route.Split = make([]SplitVariant, len(split))
+		for i, v := range split {
+			r.Split = append(r.Split, SplitVariant{Weight: v.Weight})
+			route.Split[i] = SplitVariant{Upstream: v.Upstream}
+		}
+		reload.Routes = append(reload.Routes, r)
+	}
+	return cfg, reload, nil
+}
+
+// diffKeys 返回 a 和 b 中不同的配置项路径，结构体按 mapstructure 的名称展开，map 按 key 展开，长度相同的列表按下标展开
+func diffKeys(key string, a, b reflect.Value, keys []string) []string {
+	if !a.CanInterface() || reflect.DeepEqual(a.Interface(), b.Interface()) {
+		return keys
+	}
+	switch a.Kind() {
+	case reflect.Ptr:
+		if !a.IsNil() && !b.IsNil() {
+			return diffKeys(key, a.Elem(), b.Elem(), keys)
+		}
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			name := strings.Split(a.Type().Field(i).Tag.Get("mapstructure"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(a.Type().Field(i).Name)
+			}
+			keys = diffKeys(joinKey(key, name), a.Field(i), b.Field(i), keys)
+		}
+		return keys
+	case reflect.Map:
+		names := make(map[string]bool)
+		for _, k := range append(a.MapKeys(), b.MapKeys()...) {
+			names[k.String()] = true
+		}
+		var sorted []string
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			k := reflect.ValueOf(name)
+			av, bv := a.MapIndex(k), b.MapIndex(k)
+			if !av.IsValid() || !bv.IsValid() {
+				keys = append(keys, joinKey(key, name))
+				continue
+			}
+			keys = diffKeys(joinKey(key, name), av, bv, keys)
+		}
+		return keys
+	case reflect.Slice:
+		if a.Len() == b.Len() && a.Type().Elem().Kind() != reflect.String {
+			for i := 0; i < a.Len(); i++ {
+				keys = diffKeys(fmt.Sprintf("%s[%d]", key, i), a.Index(i), b.Index(i), keys)
+			}
+			return keys
+		}
+	}
+	return append(keys, key)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"simple_lb_2/config"
+)
+
+func TestConfigDiff(t *testing.T) {
+	base := minimalConfig + `
+[access]
+rules = ["allow all"]
+
+[jwt]
+jwks_file = "/etc/jwks.json"
+
+[upstreams.canary]
+proxy_pass = ["http://127.0.0.1:7000"]
+
+[[routes]]
+name = "api"
+prefix = "/api/"
+access = ["allow 10.0.0.0/8"]
+split = [{upstream = "default", weight = 90}, {upstream = "canary", weight = 10}]
+`
+	tests := []struct {
+		name    string
+		config  string
+		restart []string
+		reload  bool
+	}{
+		{name: "unchanged", config: base},
+		{name: "global access", config: replace(base, `rules = ["allow all"]`, `rules = ["deny all"]`), reload: true},
+		{name: "route access", config: replace(base, `access = ["allow 10.0.0.0/8"]`, `access = []`), reload: true},
+		{name: "split weights", config: replace(base, `weight = 90}, {upstream = "canary", weight = 10}`, `weight = 50}, {upstream = "canary", weight = 50}`), reload: true},
+		{name: "port", config: replace(base, "port = 8080", "port = 8081"), restart: []string{"server.port"}},
+		{name: "jwks file", config: replace(base, "/etc/jwks.json", "/etc/other.json"), restart: []string{"jwt.jwks_file"}},
+		{name: "backends", config: replace(base, `"http://127.0.0.1:7000"`, `"http://127.0.0.1:7001"`), restart: []string{"upstreams.canary.proxy_pass"}},
+		{name: "route prefix and access", config: replace(replace(base, `prefix = "/api/"`, `prefix = "/v2/"`), `access = ["allow 10.0.0.0/8"]`, `access = []`),
+			restart: []string{"routes[0].prefix"}, reload: true},
+		{name: "split upstream", config: replace(base, `upstream = "canary"`, `upstream = "default"`), restart: []string{"routes[0].split[1].upstream"}},
+		{name: "new section", config: base + "\n[cache]\nenabled = true\n", restart: []string{"cache.enabled"}},
+	}
+	old := readTestConfig(t, base).AllSettings()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restart, reload := configDiff(old, readTestConfig(t, tt.config).AllSettings())
+			if !reflect.DeepEqual(restart, tt.restart) || reload != tt.reload {
+				t.Errorf("configDiff = %v, %v, want %v, %v", restart, reload, tt.restart, tt.reload)
+			}
+		})
+	}
+}
+
+// replace 替换配置中的一段，找不到时 panic，避免测试用例悄悄失效
+func replace(s, old, new string) string {
+	if !strings.Contains(s, old) {
+		panic("config does not contain " + old)
+	}
+	return strings.Replace(s, old, new, 1)
+}
+
+// 改名的路由不在运行中的路由表里，按新名称加载的访问规则不会生效，这样的配置必须被拒绝
+func TestReloadRejectsRouteRename(t *testing.T) {
+	const routes = `
+[[routes]]
+name = "admin"
+prefix = "/admin/"
+access = ["deny 0.0.0.0/0"]
+`
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cfg.toml")
+	audit := filepath.Join(dir, "audit.log")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(minimalConfig + routes)
+	if err := config.Load(file, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var startup []*Route
+	if err := config.RuntimeViper.UnmarshalKey("routes", &startup); err != nil {
+		t.Fatal(err)
+	}
+	routeTable, err := NewRouteTable(startup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := NewAccessControl(AccessConfig{}, startup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.OnChange(access.Reload)
+	handler := routeTable.Handler(access.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	status := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/users", nil))
+		return rec.Code
+	}
+
+	history, err := config.NewHistory(config.HistoryConfig{AuditLog: audit},
+		func() error { return validateReload(config.RuntimeViper, startup) }, func() (int64, int64) { return 0, 0 }, configDiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Watch(history); err != nil {
+		t.Fatal(err)
+	}
+	waitAudit := func(action string) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for time.Now().Before(deadline) {
+			data, _ := ioutil.ReadFile(audit)
+			if strings.Contains(string(data), `"action":"`+action+`"`) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("no %s entry in the audit log", action)
+	}
+
+	write(minimalConfig + strings.Replace(routes, `name = "admin"`, `name = "admin-v2"`, 1))
+	waitAudit("rejected")
+	if code := status(); code != http.StatusForbidden {
+		t.Errorf("status = %d after renaming the route, want %d", code, http.StatusForbidden)
+	}
+
+	// 只修改路由的访问规则时正常热加载
+	write(minimalConfig + strings.Replace(routes, "deny", "allow", 1))
+	waitAudit("applied")
+	if code := status(); code != http.StatusOK {
+		t.Errorf("status = %d after allowing the route, want %d", code, http.StatusOK)
+	}
+}
+
+// 路由的 JWT 要求同样按路由名称热加载，改名、删除和新增路由都要拒绝，只修改 JWT 要求时可以热加载
+func TestValidateReloadRoutes(t *testing.T) {
+	const routes = `
+[jwt]
+jwks_file = "/etc/jwks.json"
+
+[[routes]]
+name = "api"
+prefix = "/api/"
+jwt = true
+jwt_required_claims = ["scope=read"]
+
+[[routes]]
+name = "static"
+prefix = "/static/"
+`
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(jwks, []byte(`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withJWKS := func(config string) string {
+		return minimalConfig + strings.Replace(config, "/etc/jwks.json", jwks, 1)
+	}
+	startup := func() []*Route {
+		var r []*Route
+		if err := readTestConfig(t, withJWKS(routes)).UnmarshalKey("routes", &r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}()
+	tests := []struct {
+		name   string
+		config string
+		keys   []string
+	}{
+		{name: "required claims", config: replace(routes, `["scope=read"]`, `["scope=write"]`)},
+		{name: "jwt turned off", config: replace(routes, "jwt = true", "jwt = false")},
+		{name: "reordered", config: `
+[jwt]
+jwks_file = "/etc/jwks.json"
+
+[[routes]]
+name = "static"
+prefix = "/static/"
+
+[[routes]]
+name = "api"
+prefix = "/api/"
+jwt = true
+`},
+		{name: "renamed", config: replace(routes, `name = "api"`, `name = "api-v2"`), keys: []string{"routes", "routes[0]"}},
+		{name: "new prefix", config: replace(routes, `prefix = "/api/"`, `prefix = "/"`), keys: []string{"routes", "routes[0]"}},
+		{name: "removed", config: strings.SplitAfter(routes, `jwt_required_claims = ["scope=read"]`)[0], keys: []string{"routes"}},
+		{name: "added", config: routes + "\n[[routes]]\nname = \"admin\"\nprefix = \"/admin/\"\njwt = true\n", keys: []string{"routes[2]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateReload(readTestConfig(t, withJWKS(tt.config)), startup)
+			if got := errorKeys(err); !reflect.DeepEqual(got, tt.keys) {
+				t.Errorf("error keys = %v, want %v\n%v", got, tt.keys, err)
+			}
+		})
+	}
+}
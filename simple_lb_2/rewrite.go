@@ -0,0 +1,299 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"simple_lb_2/config"
+)
+
+// RewriteRule 改写规则，按配置顺序依次检查，匹配的规则都会生效，直到遇到 last 或者重定向
+type RewriteRule struct {
+	// Name 规则名称，用于指标和日志，默认为 rewrite[序号]
+	Name string `mapstructure:"name"`
+	// Match 匹配路径的正则表达式，Replace 中可以用 $1、${name} 引用捕获组
+	Match string `mapstructure:"match"`
+	// Prefix 匹配路径前缀，Replace 替换匹配到的前缀，Match 和 Prefix 都为空时匹配所有请求
+	Prefix string `mapstructure:"prefix"`
+	// Replace 改写后的路径，为空时不改路径；可以带 ?k=v 添加查询参数，重定向时可以是完整的 URL
+	Replace string `mapstructure:"replace"`
+	// QueryAdd 添加或覆盖的查询参数，格式为 k=v，值中可以引用 Match 的捕获组
+	QueryAdd []string `mapstructure:"query_add"`
+	// QueryRemove 删除的查询参数
+	QueryRemove []string `mapstructure:"query_remove"`
+	// Redirect 301、302、307 或 308，返回重定向到改写后的地址，不转发给后端
+	Redirect int `mapstructure:"redirect"`
+	// Last 匹配后不再检查后面的规则
+	Last bool `mapstructure:"last"`
+}
+
+// rewriteRule 编译后的改写规则
+type rewriteRule struct {
+	RewriteRule
+	re *regexp.Regexp
+}
+
+// redirectCodes 支持的重定向状态码
+var redirectCodes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// rewriteStats 改写规则指标，matched 按规则名称统计匹配次数
+var rewriteStats = newStatsMap("rewrite")
+
+var (
+	rewriteMatched   = new(expvar.Map).Init()
+	rewriteRedirects = new(expvar.Int)
+)
+
+func init() {
+	rewriteStats.Set("matched", rewriteMatched)
+	rewriteStats.Set("redirects", rewriteRedirects)
+}
+
+// Rewriter URL 改写和重定向，在路由匹配之前执行，路由按改写后的路径匹配
+type Rewriter struct {
+	// rules []*rewriteRule，配置文件改变后整体替换
+	rules atomic.Value
+}
+
+// NewRewriter 编译改写规则
+func NewRewriter(rules []RewriteRule) (*Rewriter, error) {
+	compiled, err := compileRewriteRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	rw := &Rewriter{}
+	rw.rules.Store(compiled)
+	return rw, nil
+}
+
+func compileRewriteRules(rules []RewriteRule) ([]*rewriteRule, error) {
+	compiled := make([]*rewriteRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rewrite[%d]", i)
+		}
+		c := &rewriteRule{RewriteRule: rule}
+		if rule.Match != "" && rule.Prefix != "" {
+			return nil, fmt.Errorf("rewrite %q: match and prefix cannot be used together", rule.Name)
+		}
+		if rule.Match != "" {
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite %q: %s", rule.Name, err)
+			}
+			c.re = re
+		}
+		if rule.Redirect != 0 && !redirectCodes[rule.Redirect] {
+			return nil, fmt.Errorf("rewrite %q: redirect must be 301, 302, 307 or 308", rule.Name)
+		}
+		if rule.Redirect == 0 && strings.Contains(rule.Replace, "://") {
+			return nil, fmt.Errorf("rewrite %q: replace with a full URL requires redirect", rule.Name)
+		}
+		for _, kv := range rule.QueryAdd {
+			if strings.IndexByte(kv, '=') <= 0 {
+				return nil, fmt.Errorf("rewrite %q: query_add %q must be k=v", rule.Name, kv)
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// Reload 配置文件改变后重新读取改写规则，规则有误时继续使用原来的规则
+func (rw *Rewriter) Reload() {
+	var rules []RewriteRule
+	if err := config.RuntimeViper.UnmarshalKey("rewrite", &rules); err != nil {
+		log.Printf("rewrite: %s\n", err)
+		return
+	}
+	compiled, err := compileRewriteRules(rules)
+	if err != nil {
+		log.Printf("rewrite: %s\n", err)
+		return
+	}
+	rw.rules.Store(compiled)
+	log.Printf("rewrite: %d rules loaded\n", len(compiled))
+}
+
+// Handler 按顺序执行改写规则，重定向规则直接返回响应
+func (rw *Rewriter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := rw.rules.Load().([]*rewriteRule)
+		if len(rules) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u := *r.URL
+		// rawPath 改写后转义的路径，和 u.Path 同步改写，保留 %2F 这样不能从 Path 还原的转义
+		rawPath := u.EscapedPath()
+		var query url.Values
+		// queryChanged 规则是否修改了查询参数，没有修改时保留原始的 RawQuery，不重新编码
+		rewritten, queryChanged := false, false
+		for _, rule := range rules {
+			captures, ok := rule.match(u.Path)
+			if !ok {
+				continue
+			}
+			rewriteMatched.Add(rule.Name, 1)
+			rewritten = true
+			if query == nil {
+				query = u.Query()
+			}
+			target, changed := rule.apply(&u, query, captures)
+			queryChanged = queryChanged || changed
+			if target == "" {
+				rawPath = rule.rawPath(rawPath)
+			}
+
+			if rule.Redirect != 0 {
+				rewriteRedirects.Add(1)
+				if target == "" {
+					setRawPath(&u, r.URL, rawPath)
+					target = u.EscapedPath()
+				}
+				if encoded := rawQuery(&u, query, queryChanged); encoded != "" {
+					target += "?" + encoded
+				}
+				log.Printf("%s(%s) redirected to %s by %s\n", r.RemoteAddr, r.URL.Path, target, rule.Name)
+				http.Redirect(w, r, target, rule.Redirect)
+				return
+			}
+			if rule.Last {
+				break
+			}
+		}
+		if !rewritten {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setRawPath(&u, r.URL, rawPath)
+		u.RawQuery = rawQuery(&u, query, queryChanged)
+		r2 := r.WithContext(r.Context())
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// setRawPath 路径改写后设置 u.RawPath，rawPath 不是 u.Path 的有效转义时清空，由 EscapedPath 按 Path 重新转义
+// 路径没有改变时保留原始的 RawPath
+func setRawPath(u, orig *url.URL, rawPath string) {
+	if u.Path == orig.Path {
+		u.RawPath = orig.RawPath
+		return
+	}
+	u.RawPath = rawPath
+	if u.EscapedPath() != rawPath {
+		u.RawPath = ""
+	}
+}
+
+// match 检查路径是否匹配规则，返回 Match 的捕获组位置
+func (rule *rewriteRule) match(path string) ([]int, bool) {
+	switch {
+	case rule.re != nil:
+		captures := rule.re.FindStringSubmatchIndex(path)
+		return captures, captures != nil
+	case rule.Prefix != "":
+		return nil, strings.HasPrefix(path, rule.Prefix)
+	default:
+		return nil, true
+	}
+}
+
+// rawQuery 返回改写后的查询字符串，查询参数没有改变时原样返回 u.RawQuery，
+// 重新编码会改变参数的顺序和转义方式，后端的签名校验和缓存 key 依赖原始的查询字符串
+func rawQuery(u *url.URL, query url.Values, changed bool) string {
+	if !changed {
+		return u.RawQuery
+	}
+	return query.Encode()
+}
+
+// apply 改写 u.Path 和 query，Replace 是完整的 URL 时返回它（只用于重定向），否则返回空字符串
+// changed 表示 query 是否被修改
+func (rule *rewriteRule) apply(u *url.URL, query url.Values, captures []int) (target string, changed bool) {
+	// 捕获组的位置对应改写前的路径
+	src := u.Path
+	expand := func(s string) string {
+		if rule.re == nil {
+			return s
+		}
+		return string(rule.re.ExpandString(nil, s, src, captures))
+	}
+
+	if rule.Replace != "" {
+		replaced := expand(rule.Replace)
+		if rule.re == nil && rule.Prefix != "" {
+			replaced = rule.Replace + strings.TrimPrefix(src, rule.Prefix)
+		}
+		// Replace 中的查询参数添加到请求的查询参数中
+		if i := strings.IndexByte(replaced, '?'); i >= 0 {
+			extra, _ := url.ParseQuery(replaced[i+1:])
+			for k, v := range extra {
+				query[k] = v
+				changed = true
+			}
+			replaced = replaced[:i]
+		}
+		if strings.Contains(replaced, "://") {
+			target = replaced
+		} else {
+			u.Path = replaced
+		}
+	}
+	for _, kv := range rule.QueryAdd {
+		i := strings.IndexByte(kv, '=')
+		k, v := kv[:i], expand(kv[i+1:])
+		if old, ok := query[k]; !ok || len(old) != 1 || old[0] != v {
+			query.Set(k, v)
+			changed = true
+		}
+	}
+	for _, k := range rule.QueryRemove {
+		if _, ok := query[k]; ok {
+			query.Del(k)
+			changed = true
+		}
+	}
+	return target, changed
+}
+
+// rawPath 对转义后的路径执行和 apply 相同的路径改写，转义后的路径不匹配规则时返回空字符串
+func (rule *rewriteRule) rawPath(raw string) string {
+	if rule.Replace == "" {
+		return raw
+	}
+	var replaced string
+	switch {
+	case rule.re != nil:
+		captures := rule.re.FindStringSubmatchIndex(raw)
+		if captures == nil {
+			return ""
+		}
+		replaced = string(rule.re.ExpandString(nil, rule.Replace, raw, captures))
+	case rule.Prefix != "":
+		if !strings.HasPrefix(raw, rule.Prefix) {
+			return ""
+		}
+		replaced = rule.Replace + raw[len(rule.Prefix):]
+	default:
+		replaced = rule.Replace
+	}
+	if i := strings.IndexByte(replaced, '?'); i >= 0 {
+		replaced = replaced[:i]
+	}
+	return replaced
+}
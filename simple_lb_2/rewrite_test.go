@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// rewriteRequest 用 rules 改写请求，返回后端收到的 URL，重定向时返回响应
+func rewriteRequest(t *testing.T, rules []RewriteRule, target string) (string, *httptest.ResponseRecorder) {
+	t.Helper()
+	rw, err := NewRewriter(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	rec := httptest.NewRecorder()
+	rw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	})).ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	return got, rec
+}
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []RewriteRule
+		target string
+		want   string
+	}{
+		{name: "no match", rules: []RewriteRule{{Prefix: "/old/", Replace: "/new/"}}, target: "/other/a?x=1", want: "/other/a?x=1"},
+		{name: "capture", rules: []RewriteRule{{Match: `^/users/(\d+)/(?P<tab>\w+)$`, Replace: "/api/user/$1?tab=${tab}"}},
+			target: "/users/42/posts", want: "/api/user/42?tab=posts"},
+		{name: "prefix", rules: []RewriteRule{{Prefix: "/old/", Replace: "/new/v2/"}}, target: "/old/a/b", want: "/new/v2/a/b"},
+		{name: "chained", rules: []RewriteRule{{Prefix: "/a/", Replace: "/b/"}, {Prefix: "/b/", Replace: "/c/"}},
+			target: "/a/x", want: "/c/x"},
+		{name: "last", rules: []RewriteRule{{Prefix: "/a/", Replace: "/b/", Last: true}, {Prefix: "/b/", Replace: "/c/"}},
+			target: "/a/x", want: "/b/x"},
+		{name: "query add and remove", rules: []RewriteRule{{Match: `^/p/(\w+)$`, QueryAdd: []string{"id=$1", "v=2"}, QueryRemove: []string{"debug"}}},
+			target: "/p/abc?v=1&debug=true", want: "/p/abc?id=abc&v=2"},
+		{name: "raw query preserved", rules: []RewriteRule{{Prefix: "/old/", Replace: "/new/"}},
+			target: "/old/a?z=1&a=%2f&sig=A+b", want: "/new/a?z=1&a=%2f&sig=A+b"},
+		{name: "raw query preserved when query_add is a no-op", rules: []RewriteRule{{Prefix: "/", QueryAdd: []string{"z=1"}}},
+			target: "/a?z=1&a=%2f", want: "/a?z=1&a=%2f"},
+		{name: "encoded slash in unchanged path", rules: []RewriteRule{{Prefix: "/files/", QueryAdd: []string{"v=1"}}},
+			target: "/files/a%2Fb", want: "/files/a%2Fb?v=1"},
+		{name: "encoded slash after prefix", rules: []RewriteRule{{Prefix: "/files/", Replace: "/v2/files/"}},
+			target: "/files/a%2Fb%20c", want: "/v2/files/a%2Fb%20c"},
+		{name: "encoded slash after capture", rules: []RewriteRule{{Match: `^/files/(.*)$`, Replace: "/store/$1"}},
+			target: "/files/a%2Fb", want: "/store/a%2Fb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := rewriteRequest(t, tt.rules, tt.target); got != tt.want {
+				t.Errorf("rewritten to %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteRedirect(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     RewriteRule
+		target   string
+		location string
+	}{
+		{name: "path", rule: RewriteRule{Prefix: "/old/", Replace: "/new/", Redirect: 301}, target: "/old/a%2Fb?x=1", location: "/new/a%2Fb?x=1"},
+		{name: "full url", rule: RewriteRule{Match: `^/docs/(.*)$`, Replace: "https://docs.example.com/$1", Redirect: 302},
+			target: "/docs/intro?lang=en", location: "https://docs.example.com/intro?lang=en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rec := rewriteRequest(t, []RewriteRule{tt.rule}, tt.target)
+			if got != "" {
+				t.Fatalf("redirected request forwarded to %s", got)
+			}
+			if rec.Code != tt.rule.Redirect || rec.Header().Get("Location") != tt.location {
+				t.Errorf("got %d Location %q, want %d %q", rec.Code, rec.Header().Get("Location"), tt.rule.Redirect, tt.location)
+			}
+		})
+	}
+}
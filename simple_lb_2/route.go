@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Route 路由规则，按路径前缀匹配请求，用于给不同的请求配置不同的策略
+type Route struct {
+	Name   string `mapstructure:"name"`
+	Prefix string `mapstructure:"prefix"`
+	// Priority 优先级：critical、normal 或 best_effort，过载时先拒绝低优先级的请求
+	Priority string `mapstructure:"priority"`
+	// Coalesce 合并同时到达的相同 GET/HEAD 请求
+	Coalesce bool `mapstructure:"coalesce"`
+	// Compress 按客户端的 Accept-Encoding 压缩响应
+	Compress bool `mapstructure:"compress"`
+	// Mirror 接收镜像流量的后端池名称，影子池的响应会被丢弃
+	Mirror string `mapstructure:"mirror"`
+	// MirrorPercent 镜像的请求比例，0 到 100，默认为 100
+	MirrorPercent float64 `mapstructure:"mirror_percent"`
+	// Split 按权重把流量分到多个后端池，为空时使用 default 后端池
+	Split []SplitVariant `mapstructure:"split"`
+	// SplitKey 粘性 key：ip、header:<Name> 或 cookie:<Name>，相同 key 总是使用同一个版本，
+	// 为空或请求中没有 key 时使用 lb_split_id cookie 中的随机 ID，没有该 cookie 时生成一个
+	SplitKey string `mapstructure:"split_key"`
+	// SplitHeader 请求头的值为版本的后端池名称时，强制使用该版本
+	SplitHeader string `mapstructure:"split_header"`
+	// SplitCookie cookie 的值为版本的后端池名称时，强制使用该版本
+	SplitCookie string `mapstructure:"split_cookie"`
+	// Access 路由的访问规则，例如 ["allow 10.0.0.0/8", "deny all"]，在 [access] 的全局规则之后检查
+	Access []string `mapstructure:"access"`
+	// MaxBodyBytes 请求体的最大字节数，超过时返回 413，0 表示使用 server.max_body_bytes，负数表示不限制
+	MaxBodyBytes int64 `mapstructure:"max_body_bytes"`
+	// JWT 要求请求携带有效的 JWT Bearer token，密钥和 iss、aud 在 [jwt] 中配置
+	JWT bool `mapstructure:"jwt"`
+	// JWTRequiredClaims 必须存在的 claim，claim=value 形式还要求值相等，数组或者空格分隔的字符串包含这个值即可
+	JWTRequiredClaims []string `mapstructure:"jwt_required_claims"`
+	// JWTForwardClaims 转发给后端的 claim，格式为 claim:Header，例如 sub:X-User-Id
+	JWTForwardClaims []string `mapstructure:"jwt_forward_claims"`
+	// Hedge 对 GET、HEAD 请求进行对冲，第一个后端响应慢时向另一个后端再发送一次
+	Hedge bool `mapstructure:"hedge"`
+	// HedgeDelay 发送对冲请求前等待的时间，设置了 HedgePercentile 时作为下限
+	HedgeDelay time.Duration `mapstructure:"hedge_delay"`
+	// HedgePercentile 按最近请求延迟的百分位决定等待时间，例如 95
+	HedgePercentile float64 `mapstructure:"hedge_percentile"`
+	// HedgeBudget 对冲请求最多占请求数的百分比，默认为 10
+	HedgeBudget float64 `mapstructure:"hedge_budget"`
+}
+
+// defaultRoute 没有匹配到任何路由规则时使用的默认路由
+var defaultRoute = &Route{Name: "default", Prefix: "/"}
+
+// RouteTable 路由表，按最长前缀匹配
+type RouteTable struct {
+	routes []*Route
+}
+
+// NewRouteTable 创建路由表
+func NewRouteTable(routes []*Route) (*RouteTable, error) {
+	for _, route := range routes {
+		if route.Name == "" || route.Prefix == "" {
+			return nil, fmt.Errorf("route: name and prefix are required")
+		}
+		switch route.Priority {
+		case "", PriorityCritical, PriorityNormal, PriorityBestEffort:
+		default:
+			return nil, fmt.Errorf("route %q: unknown priority %q", route.Name, route.Priority)
+		}
+		if route.MirrorPercent < 0 || route.MirrorPercent > 100 {
+			return nil, fmt.Errorf("route %q: mirror_percent must be between 0 and 100", route.Name)
+		}
+	}
+
+	sorted := make([]*Route, len(routes))
+	copy(sorted, routes)
+	// 前缀越长越优先匹配
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+	return &RouteTable{routes: sorted}, nil
+}
+
+// Match 返回请求路径匹配的路由
+func (t *RouteTable) Match(path string) *Route {
+	for _, route := range t.routes {
+		if strings.HasPrefix(path, route.Prefix) {
+			return route
+		}
+	}
+	return defaultRoute
+}
+
+// contextKey 保存在请求 context 中的值的 key
+type contextKey int
+
+const (
+	// matchedRoute 请求匹配的路由
+	matchedRoute contextKey = iota
+	// realClientIP 按受信任的代理解析出的客户端 IP，见 clientIP
+	realClientIP
+)
+
+// Handler 匹配路由并把结果保存到 context，后续的处理器通过 GetRouteFromContext 获取
+func (t *RouteTable) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), matchedRoute, t.Match(r.URL.Path))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetRouteFromContext 返回请求匹配的路由
+func GetRouteFromContext(r *http.Request) *Route {
+	if route, ok := r.Context().Value(matchedRoute).(*Route); ok {
+		return route
+	}
+	return defaultRoute
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer"
+	"simple_lb_2/config"
+)
+
+// SplitVariant 流量拆分中的一个版本，Upstream 为后端池名称
+type SplitVariant struct {
+	Upstream string `mapstructure:"upstream"`
+	// Weight 流量占比，按所有版本的权重之和计算比例，例如 95 和 5
+	Weight float64 `mapstructure:"weight"`
+}
+
+// splitVariant 运行时的版本状态和指标
+type splitVariant struct {
+	upstream string
+	weight   float64
+
+	requests  *expvar.Int
+	overrides *expvar.Int
+	responses *expvar.Map
+	latency   *expvar.Int
+}
+
+// splitRoute 一个路由的流量拆分
+type splitRoute struct {
+	route *Route
+	// keyFunc 返回粘性 key，为空时使用 splitIDCookie
+	keyFunc func(r *http.Request) string
+
+	mux      sync.RWMutex
+	variants []*splitVariant
+}
+
+// Splitter 按权重把路由的流量分到多个后端池，用于金丝雀发布
+// 相同 split_key 的用户总是落到同一个版本，没有 key 时按 splitIDCookie 保持粘性，请求头或 cookie 可以强制指定版本
+type Splitter struct {
+	routes map[string]*splitRoute
+}
+
+// splitIDCookie 没有配置 split_key 或请求中没有 key 时，给客户端分配的随机 ID，用作粘性 key
+const splitIDCookie = "lb_split_id"
+
+// splitIDMaxAge splitIDCookie 的有效期
+const splitIDMaxAge = 30 * 24 * time.Hour
+
+// splitStats 流量拆分指标，按路由和版本统计
+var splitStats = newStatsMap("split")
+
+// NewSplitter 创建流量拆分，检查路由引用的后端池是否存在
+func NewSplitter(routes []*Route, pools map[string]*loadbalancer.ServerPool) (*Splitter, error) {
+	s := &Splitter{routes: make(map[string]*splitRoute)}
+	for _, route := range routes {
+		if len(route.Split) == 0 {
+			continue
+		}
+		if err := validateSplit(route, pools); err != nil {
+			return nil, err
+		}
+		keyFunc, err := splitKeyFunc(route.SplitKey)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", route.Name, err)
+		}
+
+		sr := &splitRoute{route: route, keyFunc: keyFunc}
+		routeStats := new(expvar.Map).Init()
+		for _, v := range route.Split {
+			variant := &splitVariant{
+				upstream:  v.Upstream,
+				weight:    v.Weight,
+				requests:  new(expvar.Int),
+				overrides: new(expvar.Int),
+				responses: new(expvar.Map).Init(),
+				latency:   new(expvar.Int),
+			}
+			m := new(expvar.Map).Init()
+			m.Set("requests", variant.requests)
+			m.Set("overrides", variant.overrides)
+			m.Set("responses", variant.responses)
+			m.Set("latency_ms_total", variant.latency)
+			m.Set("weight", expvar.Func(func() interface{} {
+				sr.mux.RLock()
+				defer sr.mux.RUnlock()
+				return variant.weight
+			}))
+			routeStats.Set(v.Upstream, m)
+			sr.variants = append(sr.variants, variant)
+		}
+		splitStats.Set(route.Name, routeStats)
+		s.routes[route.Name] = sr
+	}
+	return s, nil
+}
+
+// validateSplit 检查版本配置：后端池存在、没有重复、权重不为负并且总和大于 0
+func validateSplit(route *Route, pools map[string]*loadbalancer.ServerPool) error {
+	seen := make(map[string]bool, len(route.Split))
+	total := 0.0
+	for _, v := range route.Split {
+		if _, ok := pools[v.Upstream]; !ok {
+			return fmt.Errorf("route %q: unknown split upstream %q", route.Name, v.Upstream)
+		}
+		if seen[v.Upstream] {
+			return fmt.Errorf("route %q: duplicate split upstream %q", route.Name, v.Upstream)
+		}
+		seen[v.Upstream] = true
+		if v.Weight < 0 {
+			return fmt.Errorf("route %q: split weight must not be negative", route.Name)
+		}
+		total += v.Weight
+	}
+	if total <= 0 {
+		return fmt.Errorf("route %q: total split weight must be positive", route.Name)
+	}
+	return nil
+}
+
+// splitKeyFunc 解析 split_key：ip、header:<Name> 或 cookie:<Name>
+func splitKeyFunc(key string) (func(r *http.Request) string, error) {
+	switch {
+	case key == "":
+		return nil, nil
+	case key == "ip":
+		return clientIP, nil
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		name := http.CanonicalHeaderKey(strings.TrimPrefix(key, "header:"))
+		return func(r *http.Request) string { return r.Header.Get(name) }, nil
+	case strings.HasPrefix(key, "cookie:") && len(key) > len("cookie:"):
+		name := strings.TrimPrefix(key, "cookie:")
+		return func(r *http.Request) string {
+			if c, err := r.Cookie(name); err == nil {
+				return c.Value
+			}
+			return ""
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown split_key %q", key)
+	}
+}
+
+// Handler 为请求选择版本，把后端池名称保存到 context，balancer 从对应的后端池中选择后端
+func (s *Splitter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr, ok := s.routes[GetRouteFromContext(r).Name]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		variant, override := sr.choose(w, r)
+		variant.requests.Add(1)
+		if override {
+			variant.overrides.Add(1)
+		}
+
+		ctx := loadbalancer.WithUpstream(r.Context(), variant.upstream)
+		rec := newStatusRecorder(w)
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		variant.latency.Add(time.Since(start).Milliseconds())
+		status := rec.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		variant.responses.Add(fmt.Sprintf("%dxx", status/100), 1)
+	})
+}
+
+// choose 选择版本，返回的 override 表示版本是由请求头或 cookie 强制指定的
+func (sr *splitRoute) choose(w http.ResponseWriter, r *http.Request) (*splitVariant, bool) {
+	if v := sr.variant(sr.overrideName(r)); v != nil {
+		return v, true
+	}
+
+	key := ""
+	if sr.keyFunc != nil {
+		key = sr.keyFunc(r)
+	}
+	if key == "" {
+		key = splitID(w, r)
+	}
+	// 粘性 key 哈希到 [0, 1) 上的固定位置，权重调整时只有落在变化区间内的用户会切换版本
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	point := float64(h.Sum32()%10000) / 10000
+
+	sr.mux.RLock()
+	defer sr.mux.RUnlock()
+	total := 0.0
+	for _, v := range sr.variants {
+		total += v.weight
+	}
+	point *= total
+	for _, v := range sr.variants {
+		if point < v.weight {
+			return v, false
+		}
+		point -= v.weight
+	}
+	// 浮点误差，落到最后一个权重不为 0 的版本
+	for i := len(sr.variants) - 1; i > 0; i-- {
+		if sr.variants[i].weight > 0 {
+			return sr.variants[i], false
+		}
+	}
+	return sr.variants[0], false
+}
+
+// splitID 返回请求携带的 splitIDCookie，没有时生成一个新的 ID 并通过 Set-Cookie 下发，
+// 客户端之后的请求都带着这个 ID，保持在同一个版本上
+func splitID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(splitIDCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// 生成失败时退回到客户端 IP，同一个客户端仍然落到同一个版本
+		log.Printf("generate split id: %s\n", err)
+		return clientIP(r)
+	}
+	id := hex.EncodeToString(b[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     splitIDCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(splitIDMaxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// overrideName 返回请求头或 cookie 指定的版本
+func (sr *splitRoute) overrideName(r *http.Request) string {
+	if sr.route.SplitHeader != "" {
+		if name := r.Header.Get(sr.route.SplitHeader); name != "" {
+			return name
+		}
+	}
+	if sr.route.SplitCookie != "" {
+		if c, err := r.Cookie(sr.route.SplitCookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// setWeights 修改版本的权重，weights 中没有的版本保持不变
+func (sr *splitRoute) setWeights(weights map[string]float64) error {
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+	total := 0.0
+	for _, v := range sr.variants {
+		w, ok := weights[v.upstream]
+		if !ok {
+			w = v.weight
+		}
+		if w < 0 {
+			return fmt.Errorf("route %q: split weight must not be negative", sr.route.Name)
+		}
+		total += w
+	}
+	for name := range weights {
+		if sr.variant(name) == nil {
+			return fmt.Errorf("route %q: unknown split upstream %q", sr.route.Name, name)
+		}
+	}
+	if total <= 0 {
+		return fmt.Errorf("route %q: total split weight must be positive", sr.route.Name)
+	}
+	for _, v := range sr.variants {
+		if w, ok := weights[v.upstream]; ok {
+			v.weight = w
+		}
+	}
+	return nil
+}
+
+// variant 按后端池名称查找版本
+func (sr *splitRoute) variant(name string) *splitVariant {
+	for _, v := range sr.variants {
+		if v.upstream == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// weights 返回所有版本的当前权重
+func (sr *splitRoute) weights() map[string]float64 {
+	sr.mux.RLock()
+	defer sr.mux.RUnlock()
+	weights := make(map[string]float64, len(sr.variants))
+	for _, v := range sr.variants {
+		weights[v.upstream] = v.weight
+	}
+	return weights
+}
+
+// Reload 配置文件改变后重新读取权重，新增或删除版本需要重启
+func (s *Splitter) Reload() {
+	var routes []*Route
+	if err := config.RuntimeViper.UnmarshalKey("routes", &routes); err != nil {
+		log.Printf("split: %s\n", err)
+		return
+	}
+	for _, route := range routes {
+		sr, ok := s.routes[route.Name]
+		if !ok {
+			continue
+		}
+		weights := make(map[string]float64, len(route.Split))
+		for _, v := range route.Split {
+			weights[v.Upstream] = v.Weight
+		}
+		if err := sr.setWeights(weights); err != nil {
+			log.Printf("split: %s\n", err)
+			continue
+		}
+		log.Printf("split: route %s weights %v\n", route.Name, sr.weights())
+	}
+}
+
+// WeightsHandler 管理接口：查看和修改权重
+// GET /split 返回所有路由的权重，POST /split?route=api&stable=90&canary=10 修改一个路由的权重
+func (s *Splitter) WeightsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		query := r.URL.Query()
+		sr, ok := s.routes[query.Get("route")]
+		if !ok {
+			http.Error(w, "unknown route", http.StatusNotFound)
+			return
+		}
+		weights := make(map[string]float64)
+		for name, values := range query {
+			if name == "route" {
+				continue
+			}
+			weight, err := strconv.ParseFloat(values[0], 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid weight for %q", name), http.StatusBadRequest)
+				return
+			}
+			weights[name] = weight
+		}
+		if err := sr.setWeights(weights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("split: route %s weights %v\n", sr.route.Name, sr.weights())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	all := make(map[string]map[string]float64, len(s.routes))
+	for name, sr := range s.routes {
+		all[name] = sr.weights()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(all)
+}
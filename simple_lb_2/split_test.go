@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"loadbalancer"
+)
+
+// newTestSplitter 创建一个 stable/canary 两个版本的路由
+func newTestSplitter(t *testing.T, route *Route) *splitRoute {
+	t.Helper()
+	pools := map[string]*loadbalancer.ServerPool{
+		"stable": loadbalancer.NewServerPool("stable"),
+		"canary": loadbalancer.NewServerPool("canary"),
+	}
+	if route.Split == nil {
+		route.Split = []SplitVariant{{Upstream: "stable", Weight: 90}, {Upstream: "canary", Weight: 10}}
+	}
+	s, err := NewSplitter([]*Route{route}, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.routes[route.Name]
+}
+
+// chooseFor 按 X-User 请求头选择版本
+func chooseFor(sr *splitRoute, user string) string {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", user)
+	v, _ := sr.choose(httptest.NewRecorder(), r)
+	return v.upstream
+}
+
+// 相同的 key 总是落到同一个版本，整体比例接近权重
+func TestSplitStickyByKey(t *testing.T) {
+	sr := newTestSplitter(t, &Route{Name: "split-key", SplitKey: "header:X-User"})
+	canary := 0
+	for i := 0; i < 2000; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		first := chooseFor(sr, user)
+		if again := chooseFor(sr, user); again != first {
+			t.Fatalf("%s moved from %s to %s", user, first, again)
+		}
+		if first == "canary" {
+			canary++
+		}
+	}
+	if canary < 140 || canary > 260 {
+		t.Errorf("%d of 2000 users on canary, want about 10%%", canary)
+	}
+}
+
+// 提高 canary 的权重时，已经在 canary 上的用户不会回到 stable
+func TestSplitWeightIncreaseKeepsCanaryUsers(t *testing.T) {
+	sr := newTestSplitter(t, &Route{Name: "split-ramp", SplitKey: "header:X-User"})
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		before[user] = chooseFor(sr, user)
+	}
+	if err := sr.setWeights(map[string]float64{"stable": 50, "canary": 50}); err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for user, upstream := range before {
+		after := chooseFor(sr, user)
+		if upstream == "canary" && after != "canary" {
+			t.Fatalf("%s moved from canary back to %s", user, after)
+		}
+		if upstream != after {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("no user moved to canary after increasing its weight")
+	}
+}
+
+// 没有 key 时下发 lb_split_id cookie，带着 cookie 的后续请求落到同一个版本
+func TestSplitStickyByCookie(t *testing.T) {
+	sr := newTestSplitter(t, &Route{Name: "split-cookie"})
+	for i := 0; i < 50; i++ {
+		rec := httptest.NewRecorder()
+		first, _ := sr.choose(rec, httptest.NewRequest("GET", "/", nil))
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != splitIDCookie || cookies[0].Value == "" {
+			t.Fatalf("Set-Cookie = %v, want a %s cookie", cookies, splitIDCookie)
+		}
+
+		for j := 0; j < 3; j++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(cookies[0])
+			rec := httptest.NewRecorder()
+			v, _ := sr.choose(rec, r)
+			if v != first {
+				t.Fatalf("client with cookie %s moved from %s to %s", cookies[0].Value, first.upstream, v.upstream)
+			}
+			if rec.Header().Get("Set-Cookie") != "" {
+				t.Fatal("cookie re-issued to a client that already has one")
+			}
+		}
+	}
+}
+
+// 请求头和 cookie 可以强制指定版本，指定不存在的版本时按权重选择
+func TestSplitOverride(t *testing.T) {
+	sr := newTestSplitter(t, &Route{
+		Name: "split-override", SplitKey: "header:X-User", SplitHeader: "X-Version", SplitCookie: "version",
+		Split: []SplitVariant{{Upstream: "stable", Weight: 100}, {Upstream: "canary", Weight: 0}},
+	})
+	tests := []struct {
+		header, cookie string
+		want           string
+		override       bool
+	}{
+		{header: "canary", want: "canary", override: true},
+		{cookie: "canary", want: "canary", override: true},
+		{header: "stable", cookie: "canary", want: "stable", override: true},
+		{header: "unknown", want: "stable"},
+		{want: "stable"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", "user-1")
+		if tt.header != "" {
+			r.Header.Set("X-Version", tt.header)
+		}
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "version", Value: tt.cookie})
+		}
+		v, override := sr.choose(httptest.NewRecorder(), r)
+		if v.upstream != tt.want || override != tt.override {
+			t.Errorf("header=%q cookie=%q: got %s override=%v, want %s override=%v",
+				tt.header, tt.cookie, v.upstream, override, tt.want, tt.override)
+		}
+	}
+}
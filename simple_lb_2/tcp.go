@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer"
+)
+
+// TCPProxy 四层 TCP 负载均衡器，每个客户端连接转发到一个后端
+type TCPProxy struct {
+	pool *loadbalancer.ServerPool
+	// 是否向后端发送 PROXY protocol v2 协议头
+	sendProxyV2 bool
+	dialTimeout time.Duration
+	// idleTimeout 两个方向都没有数据的时间超过它时关闭连接
+	idleTimeout time.Duration
+}
+
+// NewTCPProxy 创建 TCP 负载均衡器，idleTimeout 为 0 时使用 5 分钟
+func NewTCPProxy(pool *loadbalancer.ServerPool, sendProxyV2 bool, idleTimeout time.Duration) *TCPProxy {
+	if idleTimeout <= 0 {
+		idleTimeout = 5 * time.Minute
+	}
+	return &TCPProxy{
+		pool:        pool,
+		sendProxyV2: sendProxyV2,
+		dialTimeout: 2 * time.Second,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Serve 在监听器上接收连接并转发
+func (p *TCPProxy) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go p.handle(conn)
+	}
+}
+
+// handle 为客户端连接选择后端，后端连接失败时标记宕机并换一个后端，最多尝试3次
+func (p *TCPProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		peer     *loadbalancer.Backend
+		upstream net.Conn
+	)
+	for attempts := 1; upstream == nil; attempts++ {
+		if attempts > 3 {
+			log.Printf("%s Max attempts reached, terminating\n", conn.RemoteAddr())
+			return
+		}
+		// 每个连接占用后端的一个 max_conns 名额，连接关闭时释放
+		var err error
+		peer, err = p.pool.AcquirePeer(context.Background())
+		if err != nil {
+			log.Printf("%s tcp connection dropped, %s\n", conn.RemoteAddr(), err.Error())
+			return
+		}
+		c, err := net.DialTimeout("tcp", peer.URL.Host, p.dialTimeout)
+		if err != nil {
+			log.Printf("[%s] %s\n", peer.URL.Host, err.Error())
+			p.pool.MarkBackendStatus(peer.URL, false)
+			p.pool.ReleasePeer(peer)
+			continue
+		}
+		upstream = c
+	}
+	defer p.pool.ReleasePeer(peer)
+	defer upstream.Close()
+
+	if p.sendProxyV2 {
+		// 客户端地址经过 ProxyProtoListener 解析后已经是真实地址
+		if err := writeProxyV2(upstream, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			log.Printf("[%s] %s\n", upstream.RemoteAddr(), err.Error())
+			return
+		}
+	}
+
+	// 双向拷贝数据，任意一个方向结束后关闭写端，通知对端数据已经发送完毕
+	// lastSeen 为任意方向最后一次收到数据的时间(UnixNano)，两个方向共用
+	lastSeen := time.Now().UnixNano()
+	done := make(chan struct{}, 2)
+	go p.pipe(upstream, conn, &lastSeen, done)
+	go p.pipe(conn, upstream, &lastSeen, done)
+	<-done
+	<-done
+}
+
+// pipe 把 src 的数据拷贝到 dst，连接空闲超时后关闭两端
+func (p *TCPProxy) pipe(dst, src net.Conn, lastSeen *int64, done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+	buffer := make([]byte, 32*1024)
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		n, err := src.Read(buffer)
+		if n > 0 {
+			atomic.StoreInt64(lastSeen, time.Now().UnixNano())
+			if _, werr := dst.Write(buffer[:n]); werr != nil {
+				_ = src.Close()
+				return
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// 读超时不代表连接空闲，数据可能只在另一个方向上传输
+			if time.Since(time.Unix(0, atomic.LoadInt64(lastSeen))) < p.idleTimeout {
+				continue
+			}
+			log.Printf("%s tcp connection idle for %s, closing\n", src.RemoteAddr(), p.idleTimeout)
+			_ = src.Close()
+			_ = dst.Close()
+			return
+		}
+		break
+	}
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer"
+)
+
+// maxDatagramSize UDP 报文最大长度
+const maxDatagramSize = 64 * 1024
+
+// defaultMaxUDPSessions 没有配置 udp.max_sessions 时的会话数上限
+const defaultMaxUDPSessions = 10000
+
+// udpStats UDP 会话指标，sessions 为当前会话数，rejected 为会话数达到上限时丢弃的新客户端报文数
+var udpStats = newStatsMap("udp")
+
+var (
+	udpSessions = new(expvar.Int)
+	udpRejected = new(expvar.Int)
+)
+
+func init() {
+	udpStats.Set("sessions", udpSessions)
+	udpStats.Set("rejected", udpRejected)
+}
+
+// UDPProxy 四层 UDP 负载均衡器
+// UDP 没有连接的概念，这里用客户端地址作为会话标识，同一个客户端的报文始终转发到同一个后端，
+// 直到会话空闲超时或者后端宕机。每个会话占用后端的一个 max_conns 名额，会话关闭时释放；
+// 所有后端都满时直接丢弃新客户端的报文，不进入等待队列，否则一个客户端排队会阻塞所有客户端的报文
+type UDPProxy struct {
+	pool        *loadbalancer.ServerPool
+	idleTimeout time.Duration
+	// maxSessions 会话数上限，每个会话占用一个后端 socket 和一个 goroutine，
+	// 伪造源地址的报文也会建立会话，达到上限后丢弃新客户端的报文，已有会话不受影响
+	maxSessions int
+	conn        *net.UDPConn
+
+	mux      sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// udpSession 一个客户端与其绑定的后端之间的会话
+type udpSession struct {
+	client   *net.UDPAddr
+	backend  *loadbalancer.Backend
+	upstream *net.UDPConn
+	// 最后一次收发报文的时间(UnixNano)，使用原子操作读写
+	lastSeen int64
+	// release 保证后端名额只释放一次，写入失败和会话超时都会关闭会话
+	release sync.Once
+}
+
+// NewUDPProxy 创建 UDP 负载均衡器，idleTimeout 为会话空闲超时时间，maxSessions 为会话数上限
+func NewUDPProxy(pool *loadbalancer.ServerPool, idleTimeout time.Duration, maxSessions int) *UDPProxy {
+	if maxSessions <= 0 {
+		maxSessions = defaultMaxUDPSessions
+	}
+	return &UDPProxy{
+		pool:        pool,
+		idleTimeout: idleTimeout,
+		maxSessions: maxSessions,
+		sessions:    make(map[string]*udpSession),
+	}
+}
+
+// ListenAndServe 监听 UDP 地址并转发报文
+func (p *UDPProxy) ListenAndServe(addr string) error {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	p.conn, err = net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	defer p.conn.Close()
+
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := p.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return err
+		}
+		// buffer 会被下一次读取覆盖，转发前复制一份
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+		p.forward(client, data)
+	}
+}
+
+// forward 把客户端报文转发到会话绑定的后端，后端不可用时迁移到其他可用后端
+func (p *UDPProxy) forward(client *net.UDPAddr, data []byte) {
+	// 最多尝试两次：第一次写入失败说明后端已经不可达，换一个后端再试一次
+	for i := 0; i < 2; i++ {
+		s := p.session(client)
+		if s == nil {
+			log.Printf("%s udp datagram dropped, no backend available or too many sessions\n", client)
+			return
+		}
+		atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+		if _, err := s.upstream.Write(data); err != nil {
+			log.Printf("[%s] %s\n", s.backend.URL.Host, err.Error())
+			p.pool.MarkBackendStatus(s.backend.URL, false)
+			p.closeSession(s)
+			continue
+		}
+		return
+	}
+}
+
+// session 返回客户端当前的会话，如果会话不存在或者绑定的后端已宕机则重新选择后端
+func (p *UDPProxy) session(client *net.UDPAddr) *udpSession {
+	key := client.String()
+
+	p.mux.Lock()
+	s, ok := p.sessions[key]
+	p.mux.Unlock()
+	if ok {
+		if s.backend.IsAlive() {
+			return s
+		}
+		// 后端已经被标记为宕机，关闭旧会话后迁移到其他后端
+		log.Printf("%s udp backend %s is down, moving session\n", client, s.backend.URL.Host)
+		p.closeSession(s)
+	}
+	if p.full() {
+		udpRejected.Add(1)
+		return nil
+	}
+
+	peer := p.pool.TryAcquirePeerExcluding(nil)
+	if peer == nil {
+		return nil
+	}
+	raddr, err := net.ResolveUDPAddr("udp", peer.URL.Host)
+	if err != nil {
+		log.Printf("[%s] %s\n", peer.URL.Host, err.Error())
+		p.pool.ReleasePeer(peer)
+		return nil
+	}
+	upstream, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		log.Printf("[%s] %s\n", peer.URL.Host, err.Error())
+		p.pool.ReleasePeer(peer)
+		return nil
+	}
+
+	s = &udpSession{
+		client:   client,
+		backend:  peer,
+		upstream: upstream,
+		lastSeen: time.Now().UnixNano(),
+	}
+	p.mux.Lock()
+	// 并发情况下可能已经有其他报文建立了会话，以先建立的为准
+	if old, ok := p.sessions[key]; ok && old.backend.IsAlive() {
+		p.mux.Unlock()
+		_ = upstream.Close()
+		p.pool.ReleasePeer(peer)
+		return old
+	}
+	p.sessions[key] = s
+	udpSessions.Set(int64(len(p.sessions)))
+	p.mux.Unlock()
+
+	log.Printf("%s udp session pinned to %s\n", client, peer.URL.Host)
+	go p.relay(s)
+	return s
+}
+
+// relay 把后端的回复转发给原始客户端，会话空闲超时后退出
+func (p *UDPProxy) relay(s *udpSession) {
+	defer p.closeSession(s)
+
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		_ = s.upstream.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		n, err := s.upstream.Read(buffer)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// 读超时不代表会话空闲，客户端可能只发不收
+				idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastSeen)))
+				if idle < p.idleTimeout {
+					continue
+				}
+				log.Printf("%s udp session to %s expired\n", s.client, s.backend.URL.Host)
+				return
+			}
+			// 会话被关闭时读取会返回错误，不需要处理
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			// 连接型 UDP socket 收到 ICMP 端口不可达时会返回 connection refused，说明后端已经不可用
+			log.Printf("[%s] %s\n", s.backend.URL.Host, err.Error())
+			p.pool.MarkBackendStatus(s.backend.URL, false)
+			return
+		}
+
+		atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+		if _, err := p.conn.WriteToUDP(buffer[:n], s.client); err != nil {
+			log.Printf("%s %s\n", s.client, err.Error())
+		}
+	}
+}
+
+// full 会话数是否已经达到上限
+func (p *UDPProxy) full() bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return len(p.sessions) >= p.maxSessions
+}
+
+// closeSession 关闭会话并从会话表中移除，释放会话占用的后端名额
+func (p *UDPProxy) closeSession(s *udpSession) {
+	p.mux.Lock()
+	if cur, ok := p.sessions[s.client.String()]; ok && cur == s {
+		delete(p.sessions, s.client.String())
+		udpSessions.Set(int64(len(p.sessions)))
+	}
+	p.mux.Unlock()
+	_ = s.upstream.Close()
+	s.release.Do(func() { p.pool.ReleasePeer(s.backend) })
+}
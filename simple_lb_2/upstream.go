@@ -0,0 +1,73 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+
+	"loadbalancer"
+	"simple_lb_2/config"
+)
+
+// UpstreamConfig 命名的后端池，路由通过名称引用，例如接收镜像流量的影子池
+type UpstreamConfig struct {
+	// ProxyPass 后端列表，格式和 server.proxy_pass 相同
+	ProxyPass []string `mapstructure:"proxy_pass"`
+	// BackupThreshold 可用主后端的比例低于这个值时启用备用后端，和 server.backup_threshold 相同
+	BackupThreshold float64 `mapstructure:"backup_threshold"`
+	// Transport 连接配置，没有设置的字段使用 server.transport 中的值
+	Transport loadbalancer.TransportConfig `mapstructure:"transport"`
+	// Credentials 注入到转发请求和健康检测请求中的凭据，和 server.credentials 相同
+	Credentials []CredentialConfig `mapstructure:"credentials"`
+	// HealthCheckPath 健康检测请求的路径，和 server.health_check_path 相同
+	HealthCheckPath string `mapstructure:"health_check_path"`
+}
+
+// loadUpstreams 读取 [upstreams.<name>] 配置，为每个名称在 balancer 中创建一个后端池，由 balancer 负责健康检测
+func loadUpstreams(balancer *loadbalancer.LoadBalancer, defaults loadbalancer.BackendSpec, locality loadbalancer.Locality, transport loadbalancer.TransportConfig) error {
+	var cfgs map[string]UpstreamConfig
+	if err := config.RuntimeViper.UnmarshalKey("upstreams", &cfgs); err != nil {
+		return err
+	}
+	for name, cfg := range cfgs {
+		if name == loadbalancer.DefaultPool {
+			return fmt.Errorf("upstream %q: name is reserved", name)
+		}
+		specs := make([]*loadbalancer.BackendSpec, 0, len(cfg.ProxyPass))
+		for _, tok := range cfg.ProxyPass {
+			spec, err := loadbalancer.ParseBackendSpec(tok, defaults)
+			if err != nil {
+				return fmt.Errorf("upstream %q: %s", name, err)
+			}
+			specs = append(specs, spec)
+		}
+		if len(specs) == 0 {
+			return fmt.Errorf("upstream %q: proxy_pass is empty", name)
+		}
+		headers, err := newCredentials(name, cfg.Credentials)
+		if err != nil {
+			return err
+		}
+		pool, err := balancer.NewPool(name,
+			loadbalancer.WithBackupThreshold(cfg.BackupThreshold),
+			loadbalancer.WithLocality(locality),
+			loadbalancer.WithTransport(cfg.Transport.Inherit(transport)),
+			loadbalancer.WithHeaders(headers),
+			loadbalancer.WithHealthCheckPath(cfg.HealthCheckPath),
+		)
+		if err != nil {
+			return err
+		}
+		pool.SyncBackends("static", specs)
+	}
+
+	stats.Set("upstreams", expvar.Func(func() interface{} {
+		pools := make(map[string]interface{})
+		for name, pool := range balancer.Pools() {
+			if name != loadbalancer.DefaultPool {
+				pools[name] = pool.Stats()
+			}
+		}
+		return pools
+	}))
+	return nil
+}
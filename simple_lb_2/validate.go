@@ -0,0 +1,655 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+
+	"loadbalancer"
+	"simple_lb_2/config"
+)
+
+// ServerConfig [server] 配置
+type ServerConfig struct {
+	Port            int           `mapstructure:"port"`
+	ProxyPass       []string      `mapstructure:"proxy_pass"`
+	MaxConns        int           `mapstructure:"max_conns"`
+	QueueSize       int           `mapstructure:"queue_size"`
+	QueueTimeout    time.Duration `mapstructure:"queue_timeout"`
+	SlowStart       time.Duration `mapstructure:"slow_start"`
+	BackupThreshold float64       `mapstructure:"backup_threshold"`
+	// Transport default 后端池的连接配置，也是 upstreams 的默认值
+	Transport loadbalancer.TransportConfig `mapstructure:"transport"`
+	// Credentials default 后端池的凭据
+	Credentials     []CredentialConfig `mapstructure:"credentials"`
+	HealthCheckPath string             `mapstructure:"health_check_path"`
+	// Listener 接收客户端请求的超时时间和连接数限制
+	Listener     loadbalancer.ListenerConfig `mapstructure:"listener"`
+	MaxBodyBytes int64                       `mapstructure:"max_body_bytes"`
+}
+
+// L4Config [udp] 和 [tcp] 配置
+type L4Config struct {
+	Listen    string   `mapstructure:"listen"`
+	ProxyPass []string `mapstructure:"proxy_pass"`
+	// IdleTimeout UDP 会话和 TCP 连接的空闲超时时间
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	// MaxSessions 只用于 udp
+	MaxSessions int `mapstructure:"max_sessions"`
+	// SendProxyV2 只用于 tcp
+	SendProxyV2 bool `mapstructure:"send_proxy_v2"`
+}
+
+// ProxyProtocolConfig [proxy_protocol] 配置
+type ProxyProtocolConfig struct {
+	Enabled      bool     `mapstructure:"enabled"`
+	TrustedCIDRs []string `mapstructure:"trusted_cidrs"`
+}
+
+// AdminConfig [admin] 配置
+type AdminConfig struct {
+	Listen string `mapstructure:"listen"`
+}
+
+// fileConfig 配置文件的完整结构，用于校验，配置文件中出现这里没有的 key 时报错
+type fileConfig struct {
+	Server        ServerConfig                   `mapstructure:"server"`
+	UDP           L4Config                       `mapstructure:"udp"`
+	TCP           L4Config                       `mapstructure:"tcp"`
+	ProxyProtocol ProxyProtocolConfig            `mapstructure:"proxy_protocol"`
+	Locality      loadbalancer.Locality          `mapstructure:"locality"`
+	Admin         AdminConfig                    `mapstructure:"admin"`
+	Access        AccessConfig                   `mapstructure:"access"`
+	JWT           JWTConfig                      `mapstructure:"jwt"`
+	Rewrite       []RewriteRule                  `mapstructure:"rewrite"`
+	Routes        []*Route                       `mapstructure:"routes"`
+	Upstreams     map[string]UpstreamConfig      `mapstructure:"upstreams"`
+	Mirror        MirrorConfig                   `mapstructure:"mirror"`
+	RateLimit     []RateLimitRule                `mapstructure:"rate_limit"`
+	Concurrency   ConcurrencyConfig              `mapstructure:"concurrency"`
+	Cache         CacheConfig                    `mapstructure:"cache"`
+	Coalesce      CoalesceConfig                 `mapstructure:"coalesce"`
+	Compression   CompressionConfig              `mapstructure:"compression"`
+	Discovery     []loadbalancer.DiscoveryConfig `mapstructure:"discovery"`
+	History       config.HistoryConfig           `mapstructure:"history"`
+}
+
+// envPrefix 环境变量前缀，例如 SIMPLE_LB_SERVER_PORT 覆盖 server.port
+const envPrefix = "SIMPLE_LB_"
+
+// ConfigError 一个配置错误，Key 为出错的配置项路径，例如 server.proxy_pass[1]
+type ConfigError struct {
+	Key string
+	Msg string
+}
+
+func (e ConfigError) Error() string {
+	if e.Key == "" {
+		return e.Msg
+	}
+	return e.Key + ": " + e.Msg
+}
+
+// ConfigErrors 校验发现的所有错误，每行一个
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// configValidator 收集校验错误
+type configValidator struct {
+	errs ConfigErrors
+}
+
+func (c *configValidator) add(key string, format string, args ...interface{}) {
+	c.errs = append(c.errs, ConfigError{Key: key, Msg: fmt.Sprintf(format, args...)})
+}
+
+// validateConfig 校验 v 中的配置，返回所有错误
+func validateConfig(v *viper.Viper) error {
+	c := &configValidator{}
+	// 带有未知 key 的路由、后端池在严格模式下整个解码失败，再解码一次用于检查其他配置项
+	var strict, cfg fileConfig
+	if err := v.Unmarshal(&strict, func(dc *mapstructure.DecoderConfig) {
+		dc.ErrorUnused = true
+	}); err != nil {
+		c.decodeErrors(err)
+		_ = v.Unmarshal(&cfg)
+	} else {
+		cfg = strict
+	}
+	// 解码失败的配置项取零值，不再报告 "is required" 之类的错误
+	failed := make(map[string]bool)
+	for _, e := range c.errs {
+		failed[e.Key] = true
+	}
+	decoded := len(c.errs)
+	c.validate(&cfg)
+	errs := c.errs[:decoded]
+	for _, e := range c.errs[decoded:] {
+		if !failed[e.Key] {
+			errs = append(errs, e)
+		}
+	}
+	c.errs = errs
+	if len(c.errs) > 0 {
+		sort.SliceStable(c.errs, func(i, j int) bool { return c.errs[i].Key < c.errs[j].Key })
+		return c.errs
+	}
+	return nil
+}
+
+var (
+	invalidKeysRe = regexp.MustCompile(`^'([^']*)' has invalid keys: (.*)$`)
+	decodeErrorRe = regexp.MustCompile(`^error decoding '([^']*)': (.*)$`)
+	parseErrorRe  = regexp.MustCompile(`^cannot parse '([^']*)' (.*)$`)
+	keyErrorRe    = regexp.MustCompile(`^'([^']*)':? (.*)$`)
+	mapIndexRe    = regexp.MustCompile(`\[([^\]0-9][^\]]*)\]`)
+)
+
+// decodeErrors 把 mapstructure 的错误转换为按 key 路径区分的错误
+func (c *configValidator) decodeErrors(err error) {
+	merr, ok := err.(*mapstructure.Error)
+	if !ok {
+		c.add("", "%s", err)
+		return
+	}
+	for _, msg := range merr.Errors {
+		if m := invalidKeysRe.FindStringSubmatch(msg); m != nil {
+			for _, key := range strings.Split(m[2], ", ") {
+				c.add(joinKey(configKey(m[1]), key), "unknown key")
+			}
+			continue
+		}
+		matched := false
+		for _, re := range []*regexp.Regexp{decodeErrorRe, parseErrorRe, keyErrorRe} {
+			if m := re.FindStringSubmatch(msg); m != nil {
+				c.add(configKey(m[1]), "%s", m[2])
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			c.add("", "%s", msg)
+		}
+	}
+}
+
+// configKey mapstructure 把 map 中的元素写作 upstreams[shadow]，转换为 upstreams.shadow
+func configKey(name string) string {
+	return mapIndexRe.ReplaceAllString(name, ".$1")
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// validate 检查各项配置的取值
+func (c *configValidator) validate(cfg *fileConfig) {
+	switch {
+	case cfg.Server.Port == 0:
+		c.add("server.port", "is required")
+	case cfg.Server.Port < 0 || cfg.Server.Port > 65535:
+		c.add("server.port", "must be between 1 and 65535, got %d", cfg.Server.Port)
+	}
+	if len(cfg.Server.ProxyPass) == 0 && len(cfg.Discovery) == 0 {
+		c.add("server.proxy_pass", "at least one backend is required when no discovery is configured")
+	}
+	c.backends("server.proxy_pass", cfg.Server.ProxyPass)
+	c.nonNegative("server.max_conns", float64(cfg.Server.MaxConns))
+	c.nonNegative("server.queue_size", float64(cfg.Server.QueueSize))
+	c.nonNegative("server.queue_timeout", float64(cfg.Server.QueueTimeout))
+	c.nonNegative("server.slow_start", float64(cfg.Server.SlowStart))
+	c.ratio("server.backup_threshold", cfg.Server.BackupThreshold)
+	c.transport("server.transport", cfg.Server.Transport)
+	c.credentials("server.credentials", cfg.Server.Credentials)
+	c.healthCheckPath("server.health_check_path", cfg.Server.HealthCheckPath)
+	c.nonNegative("server.listener.read_header_timeout", float64(cfg.Server.Listener.ReadHeaderTimeout))
+	c.nonNegative("server.listener.read_timeout", float64(cfg.Server.Listener.ReadTimeout))
+	c.nonNegative("server.listener.write_timeout", float64(cfg.Server.Listener.WriteTimeout))
+	c.nonNegative("server.listener.idle_timeout", float64(cfg.Server.Listener.IdleTimeout))
+	c.nonNegative("server.listener.max_header_bytes", float64(cfg.Server.Listener.MaxHeaderBytes))
+	c.nonNegative("server.listener.max_conns", float64(cfg.Server.Listener.MaxConns))
+	c.nonNegative("server.listener.max_conns_per_ip", float64(cfg.Server.Listener.MaxConnsPerIP))
+	c.nonNegative("server.max_body_bytes", float64(cfg.Server.MaxBodyBytes))
+
+	c.listen("admin.listen", cfg.Admin.Listen)
+	c.l4("udp", cfg.UDP)
+	c.l4("tcp", cfg.TCP)
+	c.nonNegative("udp.idle_timeout", float64(cfg.UDP.IdleTimeout))
+	c.nonNegative("udp.max_sessions", float64(cfg.UDP.MaxSessions))
+	c.nonNegative("tcp.idle_timeout", float64(cfg.TCP.IdleTimeout))
+	for i, cidr := range cfg.ProxyProtocol.TrustedCIDRs {
+		if _, err := parseCIDRs([]string{cidr}); err != nil {
+			c.add(fmt.Sprintf("proxy_protocol.trusted_cidrs[%d]", i), "invalid CIDR %q", cidr)
+		}
+	}
+	c.ratio("locality.threshold", cfg.Locality.Threshold)
+	c.access("access.rules", cfg.Access.Rules)
+	c.nonNegative("jwt.leeway", float64(cfg.JWT.Leeway))
+	if cfg.JWT.JWKSFile != "" {
+		if _, err := loadJWKS(cfg.JWT.JWKSFile); err != nil {
+			c.add("jwt.jwks_file", "%s", err)
+		}
+	}
+	for i, cidr := range cfg.Access.TrustedProxies {
+		if _, err := parseCIDRs([]string{cidr}); err != nil {
+			c.add(fmt.Sprintf("access.trusted_proxies[%d]", i), "invalid CIDR %q", cidr)
+		}
+	}
+
+	for name, upstream := range cfg.Upstreams {
+		key := "upstreams." + name
+		if name == loadbalancer.DefaultPool {
+			c.add(key, "name %q is reserved for server.proxy_pass", name)
+		}
+		if len(upstream.ProxyPass) == 0 {
+			c.add(key+".proxy_pass", "at least one backend is required")
+		}
+		c.backends(key+".proxy_pass", upstream.ProxyPass)
+		c.ratio(key+".backup_threshold", upstream.BackupThreshold)
+		c.transport(key+".transport", upstream.Transport)
+		c.credentials(key+".credentials", upstream.Credentials)
+		c.healthCheckPath(key+".health_check_path", upstream.HealthCheckPath)
+	}
+	upstreamExists := func(name string) bool {
+		_, ok := cfg.Upstreams[name]
+		return ok || name == loadbalancer.DefaultPool
+	}
+
+	routeNames := make(map[string]int, len(cfg.Routes))
+	for i, route := range cfg.Routes {
+		// 解码出错的路由为 nil，错误已经记录
+		if route == nil {
+			continue
+		}
+		key := fmt.Sprintf("routes[%d]", i)
+		if route.Name == "" {
+			c.add(key+".name", "is required")
+		} else if j, ok := routeNames[route.Name]; ok {
+			c.add(key+".name", "duplicate route %q (also routes[%d])", route.Name, j)
+		} else {
+			routeNames[route.Name] = i
+		}
+		if !strings.HasPrefix(route.Prefix, "/") {
+			c.add(key+".prefix", "must start with /")
+		}
+		switch route.Priority {
+		case "", PriorityCritical, PriorityNormal, PriorityBestEffort:
+		default:
+			c.add(key+".priority", "must be one of %s, %s, %s", PriorityCritical, PriorityNormal, PriorityBestEffort)
+		}
+		if route.Mirror != "" && !upstreamExists(route.Mirror) {
+			c.add(key+".mirror", "unknown upstream %q", route.Mirror)
+		}
+		if route.MirrorPercent < 0 || route.MirrorPercent > 100 {
+			c.add(key+".mirror_percent", "must be between 0 and 100")
+		}
+		c.access(key+".access", route.Access)
+		if route.JWT && cfg.JWT.JWKSFile == "" {
+			c.add(key+".jwt", "requires jwt.jwks_file")
+		}
+		for j, claim := range route.JWTRequiredClaims {
+			if claim == "" || claim[0] == '=' {
+				c.add(fmt.Sprintf("%s.jwt_required_claims[%d]", key, j), "must be claim or claim=value")
+			}
+		}
+		for j, f := range route.JWTForwardClaims {
+			if i := strings.IndexByte(f, ':'); i <= 0 || i == len(f)-1 {
+				c.add(fmt.Sprintf("%s.jwt_forward_claims[%d]", key, j), "must be claim:Header")
+			}
+		}
+		if route.Hedge && route.HedgeDelay <= 0 && route.HedgePercentile <= 0 {
+			c.add(key+".hedge_delay", "hedge requires hedge_delay or hedge_percentile")
+		}
+		c.nonNegative(key+".hedge_delay", float64(route.HedgeDelay))
+		if route.HedgePercentile < 0 || route.HedgePercentile > 100 {
+			c.add(key+".hedge_percentile", "must be between 0 and 100")
+		}
+		if route.HedgeBudget < 0 || route.HedgeBudget > 100 {
+			c.add(key+".hedge_budget", "must be between 0 and 100")
+		}
+		for j, v := range route.Split {
+			if !upstreamExists(v.Upstream) {
+				c.add(fmt.Sprintf("%s.split[%d].upstream", key, j), "unknown upstream %q", v.Upstream)
+			}
+			c.nonNegative(fmt.Sprintf("%s.split[%d].weight", key, j), v.Weight)
+		}
+		if _, err := splitKeyFunc(route.SplitKey); err != nil {
+			c.add(key+".split_key", "%s", err)
+		}
+	}
+
+	for i, rule := range cfg.Rewrite {
+		key := fmt.Sprintf("rewrite[%d]", i)
+		if rule.Match != "" && rule.Prefix != "" {
+			c.add(key, "match and prefix cannot be used together")
+		}
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			c.add(key+".match", "%s", err)
+		}
+		if rule.Prefix != "" && !strings.HasPrefix(rule.Prefix, "/") {
+			c.add(key+".prefix", "must start with /")
+		}
+		if rule.Redirect != 0 && !redirectCodes[rule.Redirect] {
+			c.add(key+".redirect", "must be 301, 302, 307 or 308")
+		}
+		if rule.Redirect == 0 && strings.Contains(rule.Replace, "://") {
+			c.add(key+".replace", "a full URL requires redirect")
+		}
+		for j, kv := range rule.QueryAdd {
+			if strings.IndexByte(kv, '=') <= 0 {
+				c.add(fmt.Sprintf("%s.query_add[%d]", key, j), "must be k=v")
+			}
+		}
+	}
+
+	rateLimitNames := make(map[string]bool, len(cfg.RateLimit))
+	for i, rule := range cfg.RateLimit {
+		key := fmt.Sprintf("rate_limit[%d]", i)
+		if rule.Name != "" {
+			if rateLimitNames[rule.Name] {
+				c.add(key+".name", "duplicate rule name %q", rule.Name)
+			}
+			rateLimitNames[rule.Name] = true
+		}
+		if rule.Rate <= 0 {
+			c.add(key+".rate", "must be positive")
+		}
+		c.nonNegative(key+".burst", float64(rule.Burst))
+		if _, ok := routeNames[rule.Route]; rule.Route != "" && !ok {
+			c.add(key+".route", "unknown route %q", rule.Route)
+		}
+	}
+
+	for i, d := range cfg.Discovery {
+		key := fmt.Sprintf("discovery[%d]", i)
+		switch d.Type {
+		case "file":
+			if d.Path == "" {
+				c.add(key+".path", "is required for file discovery")
+			}
+		case "dns":
+			if d.Domain == "" {
+				c.add(key+".domain", "is required for dns discovery")
+			}
+		case "kubernetes":
+			if d.Service == "" {
+				c.add(key+".service", "is required for kubernetes discovery")
+			}
+		default:
+			c.add(key+".type", "must be one of file, dns, kubernetes")
+		}
+	}
+
+	switch cfg.Concurrency.Algorithm {
+	case "", "aimd", "gradient":
+	default:
+		c.add("concurrency.algorithm", "must be aimd or gradient")
+	}
+	c.nonNegative("cache.max_bytes", float64(cfg.Cache.MaxBytes))
+	c.nonNegative("cache.max_entry_bytes", float64(cfg.Cache.MaxEntryBytes))
+	c.nonNegative("mirror.max_inflight", float64(cfg.Mirror.MaxInflight))
+	c.nonNegative("mirror.max_body_bytes", float64(cfg.Mirror.MaxBodyBytes))
+
+	c.nonNegative("history.size", float64(cfg.History.Size))
+	c.nonNegative("history.probation", float64(cfg.History.Probation))
+	c.ratio("history.error_rate", cfg.History.ErrorRate)
+	c.nonNegative("history.min_requests", float64(cfg.History.MinRequests))
+}
+
+// backends 检查后端列表：格式正确、协议为 http 或 https、没有重复
+func (c *configValidator) backends(key string, specs []string) {
+	seen := make(map[string]int, len(specs))
+	for i, s := range specs {
+		k := fmt.Sprintf("%s[%d]", key, i)
+		spec, err := loadbalancer.ParseBackendSpec(s, loadbalancer.BackendSpec{})
+		if err != nil {
+			c.add(k, "%s", err)
+			continue
+		}
+		if spec.URL.Scheme != "http" && spec.URL.Scheme != "https" {
+			c.add(k, "backend %q: scheme must be http or https", spec.URL)
+			continue
+		}
+		if j, ok := seen[spec.URL.String()]; ok {
+			c.add(k, "duplicate backend %q (also %s[%d])", spec.URL, key, j)
+			continue
+		}
+		seen[spec.URL.String()] = i
+	}
+}
+
+// l4 检查四层负载均衡的配置，后端的协议需要和 section 相同
+func (c *configValidator) l4(section string, cfg L4Config) {
+	c.listen(section+".listen", cfg.Listen)
+	if cfg.Listen != "" && len(cfg.ProxyPass) == 0 {
+		c.add(section+".proxy_pass", "at least one backend is required when listen is set")
+	}
+	seen := make(map[string]int, len(cfg.ProxyPass))
+	for i, s := range cfg.ProxyPass {
+		k := fmt.Sprintf("%s.proxy_pass[%d]", section, i)
+		spec, err := loadbalancer.ParseBackendSpec(s, loadbalancer.BackendSpec{})
+		if err != nil {
+			c.add(k, "%s", err)
+			continue
+		}
+		u := spec.URL
+		if u.Scheme != section {
+			c.add(k, "backend %q: scheme must be %s", s, section)
+			continue
+		}
+		if j, ok := seen[u.Host]; ok {
+			c.add(k, "duplicate backend %q (also %s.proxy_pass[%d])", s, section, j)
+			continue
+		}
+		seen[u.Host] = i
+	}
+}
+
+// transport 检查连接配置，keep_alive 为负数表示关闭，其他的值不能为负数
+func (c *configValidator) transport(key string, cfg loadbalancer.TransportConfig) {
+	c.nonNegative(key+".dial_timeout", float64(cfg.DialTimeout))
+	c.nonNegative(key+".tls_handshake_timeout", float64(cfg.TLSHandshakeTimeout))
+	c.nonNegative(key+".response_header_timeout", float64(cfg.ResponseHeaderTimeout))
+	c.nonNegative(key+".idle_conn_timeout", float64(cfg.IdleConnTimeout))
+	c.nonNegative(key+".max_idle_conns_per_host", float64(cfg.MaxIdleConnsPerHost))
+	c.nonNegative(key+".max_conns_per_host", float64(cfg.MaxConnsPerHost))
+}
+
+// listen 检查监听地址，为空表示不开启
+func (c *configValidator) listen(key, addr string) {
+	if addr == "" {
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		c.add(key, "invalid address %q", addr)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		c.add(key, "port must be between 1 and 65535, got %q", port)
+	}
+}
+
+// credentials 检查凭据的来源和格式，文件和环境变量在启动时读取，这里不检查
+func (c *configValidator) credentials(key string, cfgs []CredentialConfig) {
+	for i, cfg := range cfgs {
+		k := fmt.Sprintf("%s[%d]", key, i)
+		if (cfg.File == "") == (cfg.Env == "") {
+			c.add(k, "exactly one of file and env is required")
+		}
+		switch cfg.Scheme {
+		case "", "bearer", "basic":
+		default:
+			c.add(k+".scheme", "must be bearer or basic")
+		}
+	}
+}
+
+func (c *configValidator) healthCheckPath(key, path string) {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		c.add(key, "must start with /")
+	}
+}
+
+// access 检查访问规则的格式
+func (c *configValidator) access(key string, rules []string) {
+	for i, rule := range rules {
+		if _, err := parseAccessRules([]string{rule}); err != nil {
+			c.add(fmt.Sprintf("%s[%d]", key, i), "%s", err)
+		}
+	}
+}
+
+func (c *configValidator) nonNegative(key string, v float64) {
+	if v < 0 {
+		c.add(key, "must not be negative")
+	}
+}
+
+func (c *configValidator) ratio(key string, v float64) {
+	if v < 0 || v > 1 {
+		c.add(key, "must be between 0 and 1")
+	}
+}
+
+// overrideKeys 返回可以通过环境变量和 -set 覆盖的配置项，值表示是否为列表
+// 只包括固定的配置项，routes、upstreams 这类数组和命名的配置只能在配置文件中修改
+func overrideKeys() map[string]bool {
+	keys := make(map[string]bool)
+	var walk func(prefix string, t reflect.Type)
+	walk = func(prefix string, t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			key := joinKey(prefix, f.Tag.Get("mapstructure"))
+			switch f.Type.Kind() {
+			case reflect.Struct:
+				walk(key, f.Type)
+			case reflect.Slice:
+				if f.Type.Elem().Kind() == reflect.String {
+					keys[key] = true
+				}
+			case reflect.Map, reflect.Ptr:
+			default:
+				keys[key] = false
+			}
+		}
+	}
+	walk("", reflect.TypeOf(fileConfig{}))
+	return keys
+}
+
+// configOverrides 收集环境变量和 -set key=value 指定的值，-set 优先
+// 环境变量名为 SIMPLE_LB_ 加上大写的 key，点换成下划线，例如 SIMPLE_LB_SERVER_PROXY_PASS
+// 列表的值用逗号分隔
+func configOverrides(sets []string) (map[string]interface{}, error) {
+	keys := overrideKeys()
+	raw := make(map[string]string)
+	for key := range keys {
+		env := envPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+		if value, ok := os.LookupEnv(env); ok {
+			raw[key] = value
+		}
+	}
+	for _, set := range sets {
+		kv := strings.SplitN(set, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("-set %q: expected key=value", set)
+		}
+		key := strings.ToLower(kv[0])
+		if _, ok := keys[key]; !ok {
+			return nil, fmt.Errorf("-set %q: unknown key %q", set, key)
+		}
+		raw[key] = kv[1]
+	}
+
+	values := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		if !keys[key] {
+			values[key] = value
+			continue
+		}
+		list := []interface{}{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		values[key] = list
+	}
+	return values, nil
+}
+
+// setFlags 可以重复的 -set key=value 参数
+type setFlags []string
+
+func (s *setFlags) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *setFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// loadConfig 读取配置文件，用环境变量和 -set 覆盖后校验
+func loadConfig(path string, sets []string) error {
+	overrides, err := configOverrides(sets)
+	if err != nil {
+		return err
+	}
+	if err := config.Load(path, overrides); err != nil {
+		return err
+	}
+	return validateConfig(config.RuntimeViper)
+}
+
+// runValidate simple_lb_2 validate [-set key=value] <file>，检查配置文件，有错误时返回 1
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	var sets setFlags
+	fs.Var(&sets, "set", "Override a config value, e.g. -set server.port=8080, can be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s validate [-set key=value] <file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	path := fs.Arg(0)
+	if err := loadConfig(path, sets); err != nil {
+		if errs, ok := err.(ConfigErrors); ok {
+			for _, e := range errs {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", path, e)
+			}
+			fmt.Fprintf(os.Stderr, "%d error(s)\n", len(errs))
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		}
+		return 1
+	}
+	fmt.Printf("%s: ok\n", path)
+	return 0
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// minimalConfig 可以通过校验的最小配置
+const minimalConfig = `
+[server]
+port = 8080
+proxy_pass = ["http://127.0.0.1:6000"]
+`
+
+// readTestConfig 从 TOML 字符串读取配置
+func readTestConfig(t *testing.T, content string) *viper.Viper {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// errorKeys 返回校验错误的 key 路径
+func errorKeys(err error) []string {
+	if err == nil {
+		return nil
+	}
+	var keys []string
+	for _, e := range err.(ConfigErrors) {
+		keys = append(keys, e.Key)
+	}
+	return keys
+}
+
+func TestValidateConfigKeyPaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		keys   []string
+	}{
+		{name: "minimal", config: minimalConfig},
+		{name: "missing port", config: `
+[server]
+proxy_pass = ["http://127.0.0.1:6000"]
+`, keys: []string{"server.port"}},
+		{name: "wrong type", config: `
+[server]
+port = "abc"
+proxy_pass = ["http://127.0.0.1:6000"]
+`, keys: []string{"server.port"}},
+		{name: "unknown top-level key", config: minimalConfig + `
+[serverr]
+port = 1
+`, keys: []string{"serverr"}},
+		{name: "unknown nested key", config: minimalConfig + `
+[server.listener]
+max_conn = 10
+`, keys: []string{"server.listener.max_conn"}},
+		{name: "upstream backend", config: minimalConfig + `
+[upstreams.x]
+proxy_pass = ["http://127.0.0.1:7000", "ftp://127.0.0.1:7001", "http://127.0.0.1:7000"]
+`, keys: []string{"upstreams.x.proxy_pass[1]", "upstreams.x.proxy_pass[2]"}},
+		{name: "upstream unknown key", config: minimalConfig + `
+[upstreams.x]
+proxy_pass = ["http://127.0.0.1:7000"]
+weight = 3
+`, keys: []string{"upstreams.x.weight"}},
+		{name: "backend parameter", config: `
+[server]
+port = 8080
+proxy_pass = ["http://127.0.0.1:6000 max_conns=-1", "http://127.0.0.1:6001 weight=2"]
+`, keys: []string{"server.proxy_pass[0]", "server.proxy_pass[1]"}},
+		{name: "routes", config: minimalConfig + `
+[[routes]]
+name = "api"
+prefix = "/api/"
+[[routes]]
+name = "api"
+prefix = "static"
+mirror = "missing"
+[[routes]]
+name = "other"
+prefix = "/other/"
+split = [{upstream = "default", weight = -1}]
+`, keys: []string{"routes[1].mirror", "routes[1].name", "routes[1].prefix", "routes[2].split[0].weight"}},
+		{name: "route unknown key", config: minimalConfig + `
+[[routes]]
+name = "api"
+prefix = "/api/"
+hedge_delays = "10ms"
+`, keys: []string{"routes[0].hedge_delays"}},
+		{name: "l4 backends", config: minimalConfig + `
+[udp]
+listen = ":9000"
+proxy_pass = ["udp://127.0.0.1:1234 max_conns=10", "tcp://127.0.0.1:1235"]
+`, keys: []string{"udp.proxy_pass[1]"}},
+		{name: "rate limit route", config: minimalConfig + `
+[[rate_limit]]
+key = "ip"
+route = "missing"
+rate = 0
+burst = 1
+`, keys: []string{"rate_limit[0].rate", "rate_limit[0].route"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(readTestConfig(t, tt.config))
+			if got := errorKeys(err); !reflect.DeepEqual(got, tt.keys) {
+				t.Errorf("error keys = %v, want %v\n%v", got, tt.keys, err)
+			}
+		})
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	values, err := configOverrides([]string{"server.port=9090", "server.proxy_pass=http://a:1, http://b:2,", "ADMIN.LISTEN=:3000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"server.port":       "9090",
+		"server.proxy_pass": []interface{}{"http://a:1", "http://b:2"},
+		"admin.listen":      ":3000",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("overrides = %v, want %v", values, want)
+	}
+
+	for _, set := range []string{"server.port", "routes=x", "server.bogus=1"} {
+		if _, err := configOverrides([]string{set}); err == nil {
+			t.Errorf("-set %q succeeded, want an error", set)
+		}
+	}
+}